@@ -13,12 +13,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("open %s: %v", os.Args[1], err)
 	}
-	l := kdl.NewLexer(f)
-	for {
-		tok := l.Next()
-		fmt.Println(tok)
-		if tok.String() == "EOF" {
-			return
-		}
+	toks, err := kdl.Tokenize(f)
+	for _, tok := range toks {
+		fmt.Printf("%s:%s: %s\n", os.Args[1], tok.Pos, tok)
+	}
+	if err != nil {
+		log.Fatalf("%s:%v", os.Args[1], err)
 	}
 }
@@ -0,0 +1,97 @@
+package kdl
+
+import (
+	"bytes"
+	"strings"
+)
+
+// DebugString returns a description of d's tree for tests and
+// troubleshooting, with one line per node, argument, property and
+// comment, and the kind of every value spelled out. Its output is
+// deterministic, but not KDL, and may change between versions.
+func (d *Document) DebugString() string {
+	var b bytes.Buffer
+	b.WriteString("document\n")
+	for _, n := range d.Nodes {
+		writeDebug(&b, n, 1)
+	}
+	for _, c := range d.Comments {
+		writeDebugLine(&b, 1, "comment ")
+		writeString(&b, c)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func writeDebug(b *bytes.Buffer, n *Node, depth int) {
+	for _, c := range n.Comments {
+		writeDebugLine(b, depth, "comment ")
+		writeString(b, c)
+		b.WriteByte('\n')
+	}
+	writeDebugLine(b, depth, "node ")
+	writeDebugAnnotation(b, n.TypeAnnotation)
+	writeString(b, n.Name)
+	b.WriteByte('\n')
+	written := make([]bool, len(n.EntryComments))
+	writeEntryComments := func(match func(EntryComment) bool) {
+		for i, c := range n.EntryComments {
+			if !written[i] && match(c) {
+				writeDebugLine(b, depth+1, "entry comment ")
+				writeString(b, c.Text)
+				b.WriteByte('\n')
+				written[i] = true
+			}
+		}
+	}
+	for i, v := range n.Args {
+		writeEntryComments(func(c EntryComment) bool { return c.Arg == i })
+		writeDebugLine(b, depth+1, "arg ")
+		writeDebugValue(b, v)
+	}
+	for i, p := range n.Props {
+		writeEntryComments(func(c EntryComment) bool { return c.Prop == i })
+		writeDebugLine(b, depth+1, "prop ")
+		writeString(b, p.Key)
+		b.WriteByte(' ')
+		writeDebugValue(b, p.Value)
+	}
+	writeEntryComments(func(EntryComment) bool { return true })
+	for _, c := range n.TrailingComments {
+		writeDebugLine(b, depth+1, "trailing comment ")
+		writeString(b, c)
+		b.WriteByte('\n')
+	}
+	for _, c := range n.Children {
+		writeDebug(b, c, depth+1)
+	}
+	for _, c := range n.EndComments {
+		writeDebugLine(b, depth+1, "end comment ")
+		writeString(b, c)
+		b.WriteByte('\n')
+	}
+}
+
+func writeDebugLine(b *bytes.Buffer, depth int, prefix string) {
+	b.WriteString(strings.Repeat("  ", depth))
+	b.WriteString(prefix)
+}
+
+// writeDebugValue writes v's annotation, kind and KDL text, and ends
+// the line.
+func writeDebugValue(b *bytes.Buffer, v Value) {
+	writeDebugAnnotation(b, v.TypeAnnotation)
+	b.WriteString(v.kind.String())
+	b.WriteByte(' ')
+	v.TypeAnnotation = ""
+	writeValue(b, v, V2)
+	b.WriteByte('\n')
+}
+
+func writeDebugAnnotation(b *bytes.Buffer, typ string) {
+	if typ != "" {
+		b.WriteByte('(')
+		writeString(b, typ)
+		b.WriteString(") ")
+	}
+}
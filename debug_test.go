@@ -0,0 +1,54 @@
+package kdl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDebugString(t *testing.T) {
+	const in = `// leading
+(svc)server "web" 1 (u8)2 1.5 #inf 18446744073709551616 true null port=80 /* name */ name=(id)"a" {
+    listen "a\nb" // trailing
+    "quoted node" {
+        leaf
+    }
+    // last
+}
+/* end */
+`
+	doc, err := ParseOptions{LexerOptions: LexerOptions{Comments: true}}.ParseString(in)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := `document
+  comment "// leading"
+  node ("svc") "server"
+    arg String "web"
+    arg Int 1
+    arg ("u8") Int 2
+    arg Float 1.5
+    arg Float #inf
+    arg Int 18446744073709551616
+    arg Bool #true
+    arg Null #null
+    prop "port" Int 80
+    entry comment "/* name */"
+    prop "name" ("id") String "a"
+    node "listen"
+      arg String "a\nb"
+      trailing comment "// trailing"
+    node "quoted node"
+      node "leaf"
+    end comment "// last"
+  comment "/* end */"
+`
+	got := doc.DebugString()
+	if diff := cmp.Diff(strings.Split(got, "\n"), strings.Split(want, "\n")); diff != "" {
+		t.Errorf("wrong DebugString (-got+want):\n%s", diff)
+	}
+	if again := doc.DebugString(); again != got {
+		t.Errorf("DebugString isn't deterministic")
+	}
+}
@@ -0,0 +1,110 @@
+package kdl
+
+import "io"
+
+// A Decoder reads the top-level nodes of a KDL document one at a
+// time, so that large documents can be processed without holding
+// them entirely in memory.
+type Decoder struct {
+	p   *parser
+	err error // sticky error, returned by all future calls to Next
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return ParseOptions{}.NewDecoder(r)
+}
+
+// NewDecoder is like the top-level NewDecoder, using the options in
+// o.
+func (o ParseOptions) NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{p: o.newParser(r)}
+}
+
+// Next returns the next top-level node of the document, including
+// all of its children. It returns io.EOF at the end of the document.
+func (d *Decoder) Next() (*Node, error) {
+	return d.next(false)
+}
+
+// Skip reads past the next top-level node, including its children,
+// without building it, which is cheaper than Next for nodes the
+// caller doesn't need. The node's syntax is still checked. It returns
+// io.EOF at the end of the document.
+func (d *Decoder) Skip() error {
+	_, err := d.next(true)
+	return err
+}
+
+// More reports whether there is another top-level node before the
+// end of the document, reading ahead past whitespace, comments and
+// slashdashed nodes but not into the node itself. It also returns
+// true if there is a syntax error next, so that Next reports it.
+func (d *Decoder) More() bool {
+	if d.err != nil || d.p.stopped(nil) {
+		return false
+	}
+	for {
+		switch tok := d.p.next(); tok.Type {
+		case TokenSpace, TokenNewline:
+		case TokenIgnoreNode:
+			// Slashdashed nodes aren't built, but belong to the next
+			// node's trivia, so the mark stays put.
+			mark, discard := d.p.mark, d.p.discard
+			d.p.discard = true
+			err := d.p.slashdashedNode()
+			d.p.mark, d.p.discard = mark, discard
+			if err != nil {
+				d.err = err
+				d.p.l.Close()
+				return true
+			}
+		case TokenEOF:
+			d.p.backup()
+			return false
+		default:
+			d.p.backup()
+			return true
+		}
+	}
+}
+
+// next parses the next top-level node, returning nil rather than the
+// node if discard is set.
+func (d *Decoder) next(discard bool) (*Node, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.p.discard = discard
+	var n *Node
+	var err error
+	if !d.p.stopped(nil) {
+		n, err = d.p.nextNode(nil)
+	}
+	if err == nil && n == nil {
+		err = io.EOF
+	}
+	if err != nil {
+		d.err = err
+		d.p.l.Close()
+		return nil, err
+	}
+	if discard {
+		return nil, nil
+	}
+	return n, nil
+}
+
+// InputOffset returns the offset in the input just past the last
+// node read by Next or Skip, including its terminator. With
+// ParseOptions.StopAfterNodes, once Next returns io.EOF, that's where
+// the decoder stopped reading.
+func (d *Decoder) InputOffset() int64 {
+	return int64(d.p.end)
+}
+
+// Close releases the decoder's resources. It must be called if the
+// caller stops calling Next before it returns an error or io.EOF.
+func (d *Decoder) Close() {
+	d.p.l.Close()
+}
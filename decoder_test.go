@@ -0,0 +1,230 @@
+package kdl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecoder(t *testing.T) {
+	const in = `first 1
+second {
+    child "a"
+}
+// comment between nodes
+
+third; fourth
+`
+	want := []*Node{
+		{Name: "first", Args: []Value{IntValue(1)}},
+		{Name: "second", Children: []*Node{{Name: "child", Args: []Value{StringValue("a")}}}},
+		{Name: "third"},
+		{Name: "fourth"},
+	}
+
+	d := NewDecoder(strings.NewReader(in))
+	defer d.Close()
+	var got []*Node
+	for {
+		n, err := d.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		got = append(got, n)
+	}
+	if diff := cmp.Diff(got, want, cmpValues); diff != "" {
+		t.Errorf("wrong nodes (-got+want):\n%s", diff)
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("Next after EOF returned %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderError(t *testing.T) {
+	d := NewDecoder(strings.NewReader("good 1\nbad {\n"))
+	defer d.Close()
+	if _, err := d.Next(); err != nil {
+		t.Fatalf("first Next failed: %v", err)
+	}
+	_, err := d.Next()
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("second Next returned %v, want ParseError", err)
+	}
+	if _, err2 := d.Next(); err2 != err {
+		t.Errorf("Next after error returned %v, want %v", err2, err)
+	}
+}
+
+func TestDecoderStreams(t *testing.T) {
+	// The decoder should return nodes as soon as they're complete,
+	// without waiting for the rest of the input.
+	pr, pw := io.Pipe()
+	d := NewDecoder(pr)
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		go fmt.Fprintf(pw, "node %d\n", i)
+		n, err := d.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if got, _ := n.Args[0].AsInt(); got != int64(i) {
+			t.Fatalf("got node %d, want %d", got, i)
+		}
+	}
+	pw.Close()
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("Next at end returned %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderSkip(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("big {\n")
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&b, "    child %d key=\"v\" { grandchild; }\n", i)
+	}
+	b.WriteString("}\nwanted 1 { c; }\nlast\n")
+
+	d := NewDecoder(strings.NewReader(b.String()))
+	defer d.Close()
+	if err := d.Skip(); err != nil {
+		t.Fatalf("Skip failed: %v", err)
+	}
+	n, err := d.Next()
+	if err != nil {
+		t.Fatalf("Next after Skip failed: %v", err)
+	}
+	want := &Node{Name: "wanted", Args: []Value{IntValue(1)}, Children: []*Node{{Name: "c"}}}
+	if diff := cmp.Diff(n, want, cmpValues); diff != "" {
+		t.Errorf("wrong node after Skip (-got+want):\n%s", diff)
+	}
+	if err := d.Skip(); err != nil {
+		t.Fatalf("second Skip failed: %v", err)
+	}
+	if err := d.Skip(); err != io.EOF {
+		t.Errorf("Skip at end returned %v, want io.EOF", err)
+	}
+
+	// Skipped nodes are still checked.
+	d = NewDecoder(strings.NewReader("bad { a = }\ngood"))
+	defer d.Close()
+	if err := d.Skip(); err == nil {
+		t.Errorf("Skip of invalid node succeeded, want error")
+	}
+}
+
+func TestDecoderMore(t *testing.T) {
+	const in = `first 1
+// comment about second
+second { child; }
+
+third; /- skipped
+// trailing comment
+`
+	opts := ParseOptions{LexerOptions: LexerOptions{Comments: true}}
+	d := opts.NewDecoder(strings.NewReader(in))
+	defer d.Close()
+	var got []*Node
+	for d.More() {
+		// More only reads ahead, so calling it again changes nothing.
+		if !d.More() {
+			t.Fatalf("second More returned false")
+		}
+		n, err := d.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		got = append(got, n)
+	}
+	want := []*Node{
+		{Name: "first", Args: []Value{IntValue(1)}},
+		{Name: "second", Comments: []string{"// comment about second"}, Children: []*Node{{Name: "child"}}},
+		{Name: "third"},
+	}
+	if diff := cmp.Diff(got, want, cmpValues); diff != "" {
+		t.Errorf("wrong nodes (-got+want):\n%s", diff)
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("Next after More returned false returned %v, want io.EOF", err)
+	}
+	if d.More() {
+		t.Errorf("More after EOF returned true")
+	}
+
+	// Syntax errors count as more, so that Next reports them.
+	d = NewDecoder(strings.NewReader("ok\n}"))
+	defer d.Close()
+	if _, err := d.Next(); err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	if !d.More() {
+		t.Fatalf("More before syntax error returned false")
+	}
+	if _, err := d.Next(); err == nil || err == io.EOF {
+		t.Errorf("Next at syntax error returned %v, want syntax error", err)
+	}
+	if d.More() {
+		t.Errorf("More after error returned true")
+	}
+}
+
+func TestStopAfterNodes(t *testing.T) {
+	const in = "a 1\nb {\n    c\n}\nd 2; e 3\nnot kdl at all {"
+	readers := map[string]func() io.Reader{
+		"reader": func() io.Reader { return struct{ io.Reader }{strings.NewReader(in)} },
+		"bufio":  func() io.Reader { return bufio.NewReader(strings.NewReader(in)) },
+	}
+	for name, mk := range readers {
+		t.Run(name, func(t *testing.T) {
+			r := mk()
+			opts := ParseOptions{StopAfterNodes: 2}
+			d := opts.NewDecoder(r)
+			var names []string
+			for {
+				n, err := d.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("Next failed: %v", err)
+				}
+				names = append(names, n.Name)
+			}
+			d.Close()
+			if diff := cmp.Diff(names, []string{"a", "b"}); diff != "" {
+				t.Errorf("wrong first document (-got+want):\n%s", diff)
+			}
+			if got, want := d.InputOffset(), int64(len("a 1\nb {\n    c\n}\n")); got != want {
+				t.Errorf("InputOffset() = %d, want %d", got, want)
+			}
+
+			// The second document follows on the same reader.
+			doc, err := opts.Parse(r)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			names = nil
+			for _, n := range doc.Nodes {
+				names = append(names, n.Name)
+			}
+			if diff := cmp.Diff(names, []string{"d", "e"}); diff != "" {
+				t.Errorf("wrong second document (-got+want):\n%s", diff)
+			}
+
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(rest), "not kdl at all {"; got != want {
+				t.Errorf("rest of input = %q, want %q", got, want)
+			}
+		})
+	}
+}
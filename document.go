@@ -0,0 +1,508 @@
+package kdl
+
+import (
+	"iter"
+	"slices"
+)
+
+// Document is a parsed KDL document.
+type Document struct {
+	Nodes []*Node // top-level nodes, in document order
+	// Comments are the comments after the last top-level node. Only
+	// set when parsing with LexerOptions.Comments.
+	Comments []string
+	// Trivia is the source text after the last top-level node. Only
+	// set when parsing with ParseOptions.KeepTrivia.
+	Trivia *Trivia
+}
+
+// Node is a single KDL node.
+type Node struct {
+	// TypeAnnotation is the node's (type) annotation, or empty if it
+	// has none.
+	TypeAnnotation string
+	Name           string
+	// Args are the node's arguments, in document order.
+	Args []Value
+	// Props are the node's properties, in document order. A key may
+	// appear more than once, in which case the last value wins.
+	Props []Prop
+	// Children are the nodes in the node's children block, in
+	// document order.
+	Children []*Node
+
+	// Comments are the comments preceding the node, EntryComments
+	// the block comments among its arguments and properties,
+	// EndComments the ones after its last child, before the closing
+	// bracket of its children block, and TrailingComments the rest,
+	// to the end of its line. Comments are kept verbatim, including
+	// their // or /* */ delimiters. They are only set when parsing
+	// with LexerOptions.Comments.
+	Comments         []string
+	EntryComments    []EntryComment
+	EndComments      []string
+	TrailingComments []string
+	// Trivia is the node's exact source text. Only set when parsing
+	// with ParseOptions.KeepTrivia.
+	Trivia *Trivia
+	// Span is where the node was in the parsed document, from its
+	// type annotation or name to the end of its last argument,
+	// property or children block, not including its terminator.
+	Span Span
+	// BlankLineBefore makes the encoder write a blank line before the
+	// node and its comments, unless it's the first node of its
+	// document or children block. The parser sets it for nodes that
+	// follow one or more blank lines when parsing with
+	// ParseOptions.KeepBlankLines.
+	BlankLineBefore bool
+}
+
+// Trivia is the source text of a node, as parsed with
+// ParseOptions.KeepTrivia. The encoder writes it back verbatim in
+// place of the node, as long as the node's type annotation, name,
+// arguments and properties are unchanged, and it only has children
+// if it had a children block.
+type Trivia struct {
+	// Leading is the whitespace, comments and slashdashed nodes
+	// before the node.
+	Leading string
+	// Head is the node itself, from its type annotation or name to
+	// its terminator, or to the opening bracket of its children
+	// block.
+	Head string
+	// Tail is the rest of the node's children block, after its last
+	// child, including the closing bracket and terminator. For a
+	// Document, it is everything after the last top-level node.
+	Tail string
+
+	parsed *Node // the node's entries as parsed, without children
+	block  bool  // whether the node had a children block
+}
+
+// An EntryComment is a block comment among a node's arguments and
+// properties, such as /* x */ in a 1 /* x */ 2.
+type EntryComment struct {
+	Text string
+	// Arg is the index in Args of the argument that the comment
+	// precedes, or -1, and Prop likewise for Props. If neither is a
+	// valid index, the comment follows the node's last entry, before
+	// its children block.
+	Arg, Prop int
+}
+
+// Span is a range of a parsed document's source text.
+type Span struct {
+	Start Pos // the first character
+	End   Pos // just past the last character
+}
+
+// Prop is a key=value property of a Node.
+type Prop struct {
+	Key   string
+	Value Value
+}
+
+// NewDocument returns a document with the given top-level nodes.
+func NewDocument(nodes ...*Node) *Document {
+	return &Document{Nodes: nodes}
+}
+
+// NewNode returns a node with the given name and arguments. Any
+// string is a valid name, the encoder quotes it if needed.
+func NewNode(name string, args ...Value) *Node {
+	return &Node{Name: name, Args: args}
+}
+
+// SetProp sets n's property key to v, replacing any existing values
+// of key, and returns n.
+func (n *Node) SetProp(key string, v Value) *Node {
+	set := false
+	keep := n.Props[:0]
+	for _, p := range n.Props {
+		switch {
+		case p.Key != key:
+			keep = append(keep, p)
+		case !set:
+			keep = append(keep, Prop{Key: key, Value: v})
+			set = true
+		}
+	}
+	n.Props = keep
+	if !set {
+		n.Props = append(n.Props, Prop{Key: key, Value: v})
+	}
+	return n
+}
+
+// AddChild appends c to n's children, and returns n.
+func (n *Node) AddChild(c *Node) *Node {
+	n.Children = append(n.Children, c)
+	return n
+}
+
+// RemoveChild removes n's first child called name, and reports
+// whether it had one.
+func (n *Node) RemoveChild(name string) bool {
+	for i, c := range n.Children {
+		if c.Name == name {
+			n.Children = slices.Delete(n.Children, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveProp removes every value of n's property key, so that n no
+// longer has that property, and reports whether it had it.
+func (n *Node) RemoveProp(key string) bool {
+	l := len(n.Props)
+	n.Props = slices.DeleteFunc(n.Props, func(p Prop) bool { return p.Key == key })
+	return len(n.Props) < l
+}
+
+// RemoveArg removes n's i-th argument, shifting the ones after it
+// down, and reports whether n had that many arguments.
+func (n *Node) RemoveArg(i int) bool {
+	if i < 0 || i >= len(n.Args) {
+		return false
+	}
+	n.Args = slices.Delete(n.Args, i, i+1)
+	return true
+}
+
+// Get returns the node found by following path from the top level of
+// the document, taking the first node with each name. It returns nil
+// if there is no such node.
+func (d *Document) Get(path ...string) *Node {
+	if d == nil || len(path) == 0 {
+		return nil
+	}
+	n := findNode(d.Nodes, path[0])
+	for _, name := range path[1:] {
+		n = n.Child(name)
+	}
+	return n
+}
+
+// Child returns n's first child called name, or nil if n has no such
+// child.
+func (n *Node) Child(name string) *Node {
+	if n == nil {
+		return nil
+	}
+	return findNode(n.Children, name)
+}
+
+// ChildrenNamed returns all of n's children called name, in document
+// order.
+func (n *Node) ChildrenNamed(name string) []*Node {
+	if n == nil {
+		return nil
+	}
+	var ret []*Node
+	for _, c := range n.Children {
+		if c.Name == name {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// Prop returns the value of n's property key, and whether n has that
+// property. If the property appears more than once, the last value
+// is returned.
+func (n *Node) Prop(key string) (Value, bool) {
+	if n == nil {
+		return Value{}, false
+	}
+	for i := len(n.Props) - 1; i >= 0; i-- {
+		if n.Props[i].Key == key {
+			return n.Props[i].Value, true
+		}
+	}
+	return Value{}, false
+}
+
+// AllProps returns an iterator over n's properties, like iterating
+// over an insertion-ordered map: each key is yielded once, at the
+// position where it first appears, with its last value.
+func (n *Node) AllProps() iter.Seq2[string, Value] {
+	return func(yield func(string, Value) bool) {
+		if n == nil {
+			return
+		}
+		seen := map[string]bool{}
+		for _, p := range n.Props {
+			if seen[p.Key] {
+				continue
+			}
+			seen[p.Key] = true
+			v, _ := n.Prop(p.Key)
+			if !yield(p.Key, v) {
+				return
+			}
+		}
+	}
+}
+
+// Arg returns n's i-th argument, and whether n has that many
+// arguments.
+func (n *Node) Arg(i int) (Value, bool) {
+	if n == nil || i < 0 || i >= len(n.Args) {
+		return Value{}, false
+	}
+	return n.Args[i], true
+}
+
+// NodeAt returns the innermost node whose Span contains pos, or nil if
+// there is none, such as between nodes or for a document that wasn't
+// parsed. A Span contains the positions from its start up to, but not
+// including, its end. pos is compared by line and column, or by
+// offset if its Line is zero.
+func (d *Document) NodeAt(pos Pos) *Node {
+	if d == nil {
+		return nil
+	}
+	return nodeAt(d.Nodes, pos)
+}
+
+func nodeAt(nodes []*Node, pos Pos) *Node {
+	for _, n := range nodes {
+		if n.Span.contains(pos) {
+			if c := nodeAt(n.Children, pos); c != nil {
+				return c
+			}
+			return n
+		}
+	}
+	return nil
+}
+
+// ValueAt returns the argument or property value whose Span contains
+// pos, and whether there is one, comparing positions like NodeAt.
+// Property keys aren't part of their value.
+func (d *Document) ValueAt(pos Pos) (Value, bool) {
+	n := d.NodeAt(pos)
+	if n == nil {
+		return Value{}, false
+	}
+	for _, v := range n.Args {
+		if v.span.contains(pos) {
+			return v, true
+		}
+	}
+	for _, p := range n.Props {
+		if p.Value.span.contains(pos) {
+			return p.Value, true
+		}
+	}
+	return Value{}, false
+}
+
+// contains reports whether p is in s, as described in NodeAt.
+func (s Span) contains(p Pos) bool {
+	if p.Line == 0 {
+		return s.Start.Offset <= p.Offset && p.Offset < s.End.Offset
+	}
+	before := func(a, b Pos) bool {
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	}
+	return !before(p, s.Start) && before(p, s.End)
+}
+
+// Clone returns a deep copy of d, which shares no memory with d.
+func (d *Document) Clone() *Document {
+	if d == nil {
+		return nil
+	}
+	return &Document{
+		Nodes:    cloneNodes(d.Nodes),
+		Comments: cloneStrings(d.Comments),
+		Trivia:   d.Trivia.clone(),
+	}
+}
+
+// Clone returns a deep copy of n and its descendants, which shares no
+// memory with n.
+func (n *Node) Clone() *Node {
+	if n == nil {
+		return nil
+	}
+	return &Node{
+		TypeAnnotation:   n.TypeAnnotation,
+		Name:             n.Name,
+		Children:         cloneNodes(n.Children),
+		Comments:         cloneStrings(n.Comments),
+		EntryComments:    cloneEntryComments(n.EntryComments),
+		EndComments:      cloneStrings(n.EndComments),
+		TrailingComments: cloneStrings(n.TrailingComments),
+		Args:             cloneValues(n.Args),
+		Props:            cloneProps(n.Props),
+		Trivia:           n.Trivia.clone(),
+		Span:             n.Span,
+		BlankLineBefore:  n.BlankLineBefore,
+	}
+}
+
+// StripTrivia removes the comments and trivia from d and all of its
+// nodes, leaving only their semantic content, as if d had been parsed
+// without LexerOptions.Comments and ParseOptions.KeepTrivia.
+// Slashdashed nodes, arguments, properties and children blocks are
+// never part of the parsed document, except in its trivia, so this
+// drops them from the encoder's output too.
+func (d *Document) StripTrivia() {
+	d.Comments = nil
+	d.Trivia = nil
+	for _, n := range d.Nodes {
+		n.stripTrivia()
+	}
+}
+
+func (n *Node) stripTrivia() {
+	n.Comments = nil
+	n.EntryComments = nil
+	n.EndComments = nil
+	n.TrailingComments = nil
+	n.Trivia = nil
+	for _, c := range n.Children {
+		c.stripTrivia()
+	}
+}
+
+func (t *Trivia) clone() *Trivia {
+	if t == nil {
+		return nil
+	}
+	ret := *t
+	ret.parsed = t.parsed.Clone()
+	return &ret
+}
+
+// unchanged reports whether n still matches the source text recorded
+// in its trivia.
+func (t *Trivia) unchanged(n *Node) bool {
+	p := t.parsed
+	if p == nil || n.TypeAnnotation != p.TypeAnnotation || n.Name != p.Name || (len(n.Children) > 0 && !t.block) {
+		return false
+	}
+	if len(n.Args) != len(p.Args) || len(n.Props) != len(p.Props) {
+		return false
+	}
+	for i := range n.Args {
+		if !n.Args[i].Equal(p.Args[i]) {
+			return false
+		}
+	}
+	for i := range n.Props {
+		if n.Props[i].Key != p.Props[i].Key || !n.Props[i].Value.Equal(p.Props[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal reports whether d and o have the same nodes, according to
+// Node.Equal. Comments are ignored.
+func (d *Document) Equal(o *Document) bool {
+	if d == nil || o == nil {
+		return d == o
+	}
+	return nodesEqual(d.Nodes, o.Nodes)
+}
+
+// Equal reports whether n and o are semantically the same node: they
+// have the same type annotation and name, equal arguments in the
+// same order, the same effective properties in any order, and equal
+// children. Formatting and comments are ignored, as are properties
+// overridden by a later one with the same key.
+func (n *Node) Equal(o *Node) bool {
+	if n == nil || o == nil {
+		return n == o
+	}
+	if n.TypeAnnotation != o.TypeAnnotation || n.Name != o.Name || len(n.Args) != len(o.Args) {
+		return false
+	}
+	for i := range n.Args {
+		if !n.Args[i].Equal(o.Args[i]) {
+			return false
+		}
+	}
+	np, op := uniqueProps(append([]Prop(nil), n.Props...)), uniqueProps(append([]Prop(nil), o.Props...))
+	if len(np) != len(op) {
+		return false
+	}
+	for _, p := range np {
+		if v, ok := o.Prop(p.Key); !ok || !p.Value.Equal(v) {
+			return false
+		}
+	}
+	return nodesEqual(n.Children, o.Children)
+}
+
+func nodesEqual(a, b []*Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func cloneNodes(nodes []*Node) []*Node {
+	if nodes == nil {
+		return nil
+	}
+	ret := make([]*Node, len(nodes))
+	for i, n := range nodes {
+		ret[i] = n.Clone()
+	}
+	return ret
+}
+
+func cloneValues(vs []Value) []Value {
+	if vs == nil {
+		return nil
+	}
+	ret := make([]Value, len(vs))
+	for i, v := range vs {
+		ret[i] = v.clone()
+	}
+	return ret
+}
+
+func cloneProps(props []Prop) []Prop {
+	if props == nil {
+		return nil
+	}
+	ret := make([]Prop, len(props))
+	for i, p := range props {
+		ret[i] = Prop{Key: p.Key, Value: p.Value.clone()}
+	}
+	return ret
+}
+
+func cloneStrings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	return append([]string(nil), ss...)
+}
+
+func cloneEntryComments(cs []EntryComment) []EntryComment {
+	if cs == nil {
+		return nil
+	}
+	return append([]EntryComment(nil), cs...)
+}
+
+func findNode(nodes []*Node, name string) *Node {
+	for _, n := range nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
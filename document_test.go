@@ -0,0 +1,387 @@
+package kdl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLookup(t *testing.T) {
+	doc, err := Parse(strings.NewReader(`server "web" port=80 port=8080 {
+    listen "a"
+    listen "b"
+    tls {
+        cert "/etc/cert.pem"
+    }
+}
+server "db"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := doc.Get("server", "tls", "cert")
+	if cert == nil {
+		t.Fatal("Get(server, tls, cert) = nil")
+	}
+	if v, ok := cert.Arg(0); !ok {
+		t.Error("cert.Arg(0) missing")
+	} else if s, _ := v.AsString(); s != "/etc/cert.pem" {
+		t.Errorf("cert.Arg(0) = %q, want /etc/cert.pem", s)
+	}
+	if _, ok := cert.Arg(1); ok {
+		t.Error("cert.Arg(1) found, want missing")
+	}
+	if _, ok := cert.Arg(-1); ok {
+		t.Error("cert.Arg(-1) found, want missing")
+	}
+
+	for _, path := range [][]string{
+		{"nope"},
+		{"server", "nope"},
+		{"server", "nope", "deeper"},
+		{"server", "tls", "cert", "deeper"},
+		{},
+	} {
+		if n := doc.Get(path...); n != nil {
+			t.Errorf("Get(%q) = %v, want nil", path, n)
+		}
+	}
+
+	server := doc.Get("server")
+	if v, _ := server.Arg(0); !v.Equal(StringValue("web")) {
+		t.Errorf("Get(server) found the wrong server %v", v)
+	}
+	if v, ok := server.Prop("port"); !ok {
+		t.Error("Prop(port) missing")
+	} else if i, _ := v.AsInt(); i != 8080 {
+		t.Errorf("Prop(port) = %d, want the last value 8080", i)
+	}
+	if _, ok := server.Prop("nope"); ok {
+		t.Error("Prop(nope) found, want missing")
+	}
+
+	if got := len(server.ChildrenNamed("listen")); got != 2 {
+		t.Errorf("ChildrenNamed(listen) returned %d nodes, want 2", got)
+	}
+	if got := len(server.ChildrenNamed("nope")); got != 0 {
+		t.Errorf("ChildrenNamed(nope) returned %d nodes, want 0", got)
+	}
+	if c := server.Child("listen"); c == nil {
+		t.Error("Child(listen) = nil")
+	} else if v, _ := c.Arg(0); !v.Equal(StringValue("a")) {
+		t.Errorf("Child(listen) returned the wrong node %v", v)
+	}
+
+	var nilNode *Node
+	if nilNode.Child("x") != nil || nilNode.ChildrenNamed("x") != nil {
+		t.Error("child lookup on nil node returned nodes")
+	}
+	if _, ok := nilNode.Prop("x"); ok {
+		t.Error("Prop on nil node found a value")
+	}
+	if _, ok := nilNode.Arg(0); ok {
+		t.Error("Arg on nil node found a value")
+	}
+	var nilDoc *Document
+	if nilDoc.Get("x") != nil {
+		t.Error("Get on nil document returned a node")
+	}
+}
+
+func TestClone(t *testing.T) {
+	const in = `// leading
+server "web" 123456789012345678901234567890 port=80 {
+    listen "a" // trailing
+    tls {
+        cert "/etc/cert.pem"
+    }
+}
+/* end */
+`
+	parse := func() *Document {
+		doc, err := ParseOptions{LexerOptions: LexerOptions{Comments: true}}.Parse(strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+	orig, want := parse(), parse()
+
+	c := orig.Clone()
+	if diff := cmp.Diff(c, want, cmpValues); diff != "" {
+		t.Fatalf("Clone is different from the original (-got+want):\n%s", diff)
+	}
+
+	n := c.Nodes[0]
+	n.Name = "changed"
+	n.Args[0] = StringValue("changed")
+	if bi, _ := orig.Nodes[0].Args[1].AsBigInt(); bi == nil {
+		t.Fatal("original lost its big integer")
+	}
+	n.Args[1].bi.SetInt64(1)
+	n.Props[0].Value = IntValue(1)
+	n.Comments[0] = "// changed"
+	n.Children[0].TrailingComments[0] = "// changed"
+	n.Children[0].Args[0] = StringValue("changed")
+	n.Children[1].Children[0].Name = "changed"
+	n.Children = append(n.Children[:0], &Node{Name: "new"})
+	c.Comments[0] = "/* changed */"
+	c.Nodes = append(c.Nodes, &Node{Name: "new"})
+
+	if diff := cmp.Diff(orig, want, cmpValues); diff != "" {
+		t.Errorf("mutating the clone changed the original (-got+want):\n%s", diff)
+	}
+
+	// Trivia is copied too, including the entries it compares the
+	// node against.
+	kept, err := ParseOptions{KeepTrivia: true}.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc := kept.Clone()
+	if kc.Nodes[0].Trivia == kept.Nodes[0].Trivia {
+		t.Fatal("Clone shares the node's Trivia")
+	}
+	kc.Nodes[0].Trivia.parsed.Args[0] = StringValue("changed")
+	kc.Nodes[0].Trivia.parsed.Props[0].Value = IntValue(1)
+	if p := kept.Nodes[0].Trivia.parsed; !p.Args[0].Equal(StringValue("web")) || !p.Props[0].Value.Equal(IntValue(80)) {
+		t.Errorf("mutating the clone's trivia changed the original's: %v %v", p.Args, p.Props)
+	}
+
+	if got := (*Document)(nil).Clone(); got != nil {
+		t.Errorf("nil Document.Clone() = %v, want nil", got)
+	}
+	if got := (*Node)(nil).Clone(); got != nil {
+		t.Errorf("nil Node.Clone() = %v, want nil", got)
+	}
+}
+
+func TestSetProp(t *testing.T) {
+	n := NewNode("n")
+	n.Props = []Prop{{"a", IntValue(1)}, {"b", IntValue(2)}, {"a", IntValue(3)}}
+	n.SetProp("a", IntValue(4)).SetProp("c", IntValue(5))
+	want := []Prop{{"a", IntValue(4)}, {"b", IntValue(2)}, {"c", IntValue(5)}}
+	if diff := cmp.Diff(n.Props, want, cmpValues); diff != "" {
+		t.Errorf("wrong props (-got+want):\n%s", diff)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	n := NewNode("n", IntValue(1), IntValue(2), IntValue(3))
+	n.Props = []Prop{{"a", IntValue(1)}, {"b", IntValue(2)}, {"a", IntValue(3)}}
+	n.AddChild(NewNode("x")).AddChild(NewNode("y", IntValue(1))).AddChild(NewNode("y", IntValue(2)))
+
+	if !n.RemoveArg(1) || n.RemoveArg(2) || n.RemoveArg(-1) {
+		t.Errorf("RemoveArg reported the wrong results")
+	}
+	if !n.RemoveProp("a") || n.RemoveProp("a") || n.RemoveProp("c") {
+		t.Errorf("RemoveProp reported the wrong results")
+	}
+	if !n.RemoveChild("y") || n.RemoveChild("z") {
+		t.Errorf("RemoveChild reported the wrong results")
+	}
+
+	want := NewNode("n", IntValue(1), IntValue(3))
+	want.Props = []Prop{{"b", IntValue(2)}}
+	want.AddChild(NewNode("x")).AddChild(NewNode("y", IntValue(2)))
+	if diff := cmp.Diff(n, want, cmpValues); diff != "" {
+		t.Errorf("wrong node after removals (-got+want):\n%s", diff)
+	}
+	if _, ok := n.Prop("a"); ok {
+		t.Errorf("removed property a is still set")
+	}
+
+	for n.RemoveArg(0) {
+	}
+	for n.RemoveChild("x") || n.RemoveChild("y") {
+	}
+	if len(n.Args) != 0 || len(n.Children) != 0 {
+		t.Errorf("removing everything left args %v and children %v", n.Args, n.Children)
+	}
+}
+
+func TestNodeAt(t *testing.T) {
+	const in = `a 1 key="v"
+b {
+    c 2 {
+        d
+    }
+    e
+}
+`
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(sub string) int { return strings.Index(in, sub) }
+	tests := []struct {
+		pos  Pos
+		want string // node name, or "" for none
+	}{
+		{Pos{Offset: 0}, "a"},
+		{Pos{Offset: at("1")}, "a"},
+		{Pos{Offset: at(`"v"`) + 2}, "a"},
+		{Pos{Offset: at(`"v"`) + 3}, ""}, // the newline ending a
+		{Pos{Offset: at("b")}, "b"},
+		{Pos{Offset: at("c 2")}, "c"},
+		{Pos{Offset: at("2 {")}, "c"},
+		{Pos{Offset: at("d")}, "d"},
+		{Pos{Offset: at("d") - 1}, "c"}, // indentation inside c's block
+		{Pos{Offset: at("e\n")}, "e"},
+		{Pos{Offset: len(in) - 2}, "b"}, // b's closing bracket
+		{Pos{Offset: len(in)}, ""},
+
+		{Pos{Line: 1, Column: 1}, "a"},
+		{Pos{Line: 3, Column: 5}, "c"},
+		{Pos{Line: 4, Column: 9}, "d"},
+		{Pos{Line: 4, Column: 10}, "c"},
+		{Pos{Line: 6, Column: 1}, "b"},
+		{Pos{Line: 8, Column: 1}, ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if n := doc.NodeAt(test.pos); n != nil {
+			got = n.Name
+		}
+		if got != test.want {
+			t.Errorf("NodeAt(%+v) = %q, want %q", test.pos, got, test.want)
+		}
+	}
+
+	if v, ok := doc.ValueAt(Pos{Offset: at(`"v"`) + 1}); !ok || !v.Equal(StringValue("v")) {
+		t.Errorf("ValueAt in property value = %v, %v, want \"v\"", v, ok)
+	}
+	if v, ok := doc.ValueAt(Pos{Line: 3, Column: 7}); !ok || !v.Equal(IntValue(2)) {
+		t.Errorf("ValueAt in argument = %v, %v, want 2", v, ok)
+	}
+	if v, ok := doc.ValueAt(Pos{Offset: at("key")}); ok {
+		t.Errorf("ValueAt in property key = %v, want none", v)
+	}
+
+	built := NewDocument(NewNode("x"))
+	if n := built.NodeAt(Pos{Offset: 0}); n != nil {
+		t.Errorf("NodeAt in constructed document = %v, want nil", n)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"node 0x10 a=1 a=2 { c; }", "// comment\nnode 16 a=2 {\n    c\n}", true},
+		{`node "a\tb" r"raw"`, "node \"a\\u{9}b\" \"raw\"", true},
+		{"node 1.5e3 b=true c=null", "node 1500.0 c=null b=true", true},
+		{"node 123456789012345678901234567890", "node 0x18EE90FF6C373E0EE4E3F0AD2", true},
+		{"(t)node (u8)1", "(t)node (u8)0b1", true},
+		{"a; b", "a\nb", true},
+
+		{"node 1", "node 1.0", false},
+		{"node 1 2", "node 2 1", false},
+		{"node 1", "node 1 2", false},
+		{"node a=1", "node a=1 b=2", false},
+		{"node a=1 a=2", "node a=1", false},
+		{"node (u8)1", "node 1", false},
+		{"(t)node", "node", false},
+		{"node #nan #inf #-inf", "node #nan #inf #-inf", true},
+		{"node 0.0", "node -0.0", true},
+
+		{"node #inf", "node #-inf", false},
+		{"node #nan", "node #inf", false},
+		{"node { a; }", "node { b; }", false},
+		{"node { a; }", "node", false},
+		{"a; b", "b; a", false},
+	}
+	for _, test := range tests {
+		a, err := ParseString(test.a)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", test.a, err)
+		}
+		b, err := ParseString(test.b)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", test.b, err)
+		}
+		if got := a.Equal(b); got != test.want {
+			t.Errorf("%q.Equal(%q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got := b.Equal(a); got != test.want {
+			t.Errorf("%q.Equal(%q) = %v, want %v", test.b, test.a, got, test.want)
+		}
+	}
+
+	if !(*Document)(nil).Equal(nil) || (*Node)(nil).Equal(NewNode("n")) {
+		t.Error("wrong result comparing nil")
+	}
+}
+
+func TestPropOrder(t *testing.T) {
+	doc, err := ParseString("node b=1 a=2 c=3 a=4 10 d=5")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	type kv struct {
+		Key   string
+		Value int64
+	}
+	var got []kv
+	for k, v := range doc.Nodes[0].AllProps() {
+		i, _ := v.AsInt()
+		got = append(got, kv{k, i})
+	}
+	want := []kv{{"b", 1}, {"a", 4}, {"c", 3}, {"d", 5}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong AllProps order (-got+want):\n%s", diff)
+	}
+
+	var b strings.Builder
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if got, want := b.String(), "node 10 b=1 a=2 c=3 a=4 d=5\n"; got != want {
+		t.Errorf("Encode = %q, want properties in source order %q", got, want)
+	}
+}
+
+func TestStripTrivia(t *testing.T) {
+	const in = `// The server.
+server "web" /-"old" port=80 /-port=8080 { // trailing
+    /* first */ listen "a"
+    /-listen "b"
+    tls /-{
+        cert "x"
+    }
+}
+/-server "db"
+// The end.
+`
+	opts := ParseOptions{LexerOptions: LexerOptions{Comments: true}, KeepTrivia: true}
+	doc, err := opts.ParseString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.StripTrivia()
+
+	want, err := ParseString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(doc, want, cmpValues); diff != "" {
+		t.Errorf("wrong stripped document (-got+want):\n%s", diff)
+	}
+
+	var b strings.Builder
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	const wantOut = `server "web" port=80 {
+    listen "a"
+    tls
+}
+`
+	if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(wantOut, "\n")); diff != "" {
+		t.Errorf("wrong encoding of stripped document (-got+want):\n%s", diff)
+	}
+}
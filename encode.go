@@ -0,0 +1,491 @@
+package kdl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An Encoder writes KDL documents to an output stream.
+type Encoder struct {
+	w    io.Writer
+	opts EncoderOptions
+	err  error // first value that couldn't be written, reset by Encode
+}
+
+// EncoderOptions configures the output of an Encoder.
+type EncoderOptions struct {
+	// Indent is the string written once per level of nesting before
+	// each node in a children block, such as "\t" to indent with
+	// tabs. Empty means four spaces.
+	Indent string
+	// Semicolons ends each node with a semicolon, as well as a
+	// newline, except where a // comment ends the node's line.
+	// Compact output always separates nodes with semicolons.
+	Semicolons bool
+	// Compact writes the document on a single line, with children
+	// blocks inline and nodes separated by semicolons. A // comment
+	// still ends its line.
+	Compact bool
+	// SortProperties writes each node's properties sorted by key,
+	// rather than in document order. Properties with the same key
+	// keep their relative order, so the last one still wins.
+	SortProperties bool
+	// PreserveIntFormat writes integers parsed from a document as
+	// they were written, keeping their radix, digit case and
+	// underscores, rather than in plain decimal.
+	PreserveIntFormat bool
+	// NumberFormat is how floats are written. The zero value writes
+	// them in the shortest form that parses back to the same number.
+	// Integers are unaffected, see PreserveIntFormat.
+	NumberFormat NumberFormat
+	// PreserveStringStyle writes strings parsed from raw strings as
+	// raw strings, with the same number of # around them unless the
+	// string needs more, rather than as quoted strings, in the raw
+	// string syntax of Version.
+	// Multi-line raw strings are written quoted in V2.
+	PreserveStringStyle bool
+	// Version is the version of the KDL spec to write. Zero means V2,
+	// which writes keywords as #true, #false, #null, #inf, #-inf and
+	// #nan, and raw strings as #"..."#. V1 writes true, false, null
+	// and r"...", and has no way to write infinities and NaN, which
+	// make Encode fail.
+	Version Version
+}
+
+// NumberFormat is a way of writing floats, for EncoderOptions.
+type NumberFormat int
+
+const (
+	ShortestNumbers   NumberFormat = iota // like strconv's 'g' format: 0.5, 1.0e+06 and 1.0e-07
+	DecimalNumbers                        // never with an exponent: 0.5, 1000000.0 and 0.0000001
+	ScientificNumbers                     // always with an exponent: 5.0e-01, 1.0e+06 and 1.0e-07
+	PreservedNumbers                      // as parsed, or as ShortestNumbers for floats built in Go
+)
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return EncoderOptions{}.NewEncoder(w)
+}
+
+// NewEncoder is like the top-level NewEncoder, using the options in
+// o.
+func (o EncoderOptions) NewEncoder(w io.Writer) *Encoder {
+	if o.Indent == "" {
+		o.Indent = "    "
+	}
+	if o.Version == 0 {
+		o.Version = V2
+	}
+	return &Encoder{
+		w:    w,
+		opts: o,
+	}
+}
+
+// Encode writes the KDL encoding of doc to the stream.
+func (e *Encoder) Encode(doc *Document) error {
+	var b bytes.Buffer
+	e.err = nil
+	if e.opts.Compact {
+		for i, n := range doc.Nodes {
+			if i > 0 {
+				separate(&b)
+			}
+			e.encodeCompact(&b, n)
+		}
+		for _, c := range doc.Comments {
+			if b.Len() > 0 && !endsLine(&b) {
+				b.WriteByte(' ')
+			}
+			b.WriteString(c)
+		}
+		if b.Len() > 0 && !endsLine(&b) {
+			b.WriteByte('\n')
+		}
+	} else {
+		e.encodeNodes(&b, doc.Nodes, 0)
+		if doc.Trivia != nil {
+			b.WriteString(doc.Trivia.Tail)
+		} else {
+			for _, c := range doc.Comments {
+				b.WriteString(c)
+				b.WriteByte('\n')
+			}
+		}
+	}
+	if e.err != nil {
+		return e.err
+	}
+	_, err := e.w.Write(b.Bytes())
+	return err
+}
+
+// WriteTo writes n and its descendants to w as a standalone KDL
+// document, formatted like an Encoder with default options would.
+func (n *Node) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	e := NewEncoder(w)
+	e.encodeNode(&b, n, 0)
+	if e.err != nil {
+		return 0, e.err
+	}
+	return b.WriteTo(w)
+}
+
+// encodeNodes writes a sequence of nodes at the same depth.
+func (e *Encoder) encodeNodes(b *bytes.Buffer, nodes []*Node, depth int) {
+	for i, n := range nodes {
+		if i > 0 && n.BlankLineBefore && n.Trivia == nil {
+			if !endsLine(b) {
+				b.WriteByte('\n')
+			}
+			b.WriteByte('\n')
+		}
+		e.encodeNode(b, n, depth)
+	}
+}
+
+func (e *Encoder) encodeNode(b *bytes.Buffer, n *Node, depth int) {
+	if n.Trivia != nil {
+		e.encodeTrivia(b, n, depth)
+		return
+	}
+	if b.Len() > 0 && !endsLine(b) {
+		// Follows a node written from its trivia that didn't end its
+		// line.
+		b.WriteByte('\n')
+	}
+	indent := strings.Repeat(e.opts.Indent, depth)
+	for _, c := range n.Comments {
+		b.WriteString(indent)
+		b.WriteString(c)
+		b.WriteByte('\n')
+	}
+	b.WriteString(indent)
+	e.encodeEntries(b, n)
+	if len(n.Children) > 0 || len(n.EndComments) > 0 {
+		b.WriteString(" {\n")
+		e.encodeNodes(b, n.Children, depth+1)
+		for _, c := range n.EndComments {
+			b.WriteString(indent + e.opts.Indent)
+			b.WriteString(c)
+			b.WriteByte('\n')
+		}
+		b.WriteString(indent)
+		b.WriteByte('}')
+	}
+	writeTrailingComments(b, n.TrailingComments, indent)
+	if tc := n.TrailingComments; len(tc) == 0 || !strings.HasPrefix(tc[len(tc)-1], "//") {
+		e.terminate(b)
+	}
+	b.WriteByte('\n')
+}
+
+// encodeTrivia writes n from its source text, re-encoding only the
+// parts of it that have changed since it was parsed. Comments are
+// part of the source text, so n.Comments and n.TrailingComments are
+// ignored.
+func (e *Encoder) encodeTrivia(b *bytes.Buffer, n *Node, depth int) {
+	t := n.Trivia
+	b.WriteString(t.Leading)
+	switch {
+	case t.unchanged(n):
+		b.WriteString(t.Head)
+	case t.block:
+		e.encodeEntries(b, n)
+		// The block's trivia starts the next line.
+		b.WriteString(" {")
+	case len(n.Children) == 0:
+		e.encodeEntries(b, n)
+		e.terminate(b)
+		b.WriteByte('\n')
+		return
+	default:
+		e.encodeEntries(b, n)
+		b.WriteString(" {\n")
+	}
+	for _, c := range n.Children {
+		e.encodeNode(b, c, depth+1)
+	}
+	if t.block {
+		b.WriteString(t.Tail)
+	} else if len(n.Children) > 0 {
+		if !endsLine(b) {
+			b.WriteByte('\n')
+		}
+		b.WriteString(strings.Repeat(e.opts.Indent, depth))
+		b.WriteByte('}')
+		e.terminate(b)
+		b.WriteByte('\n')
+	}
+}
+
+// terminate writes a semicolon after a node, if the options ask for
+// one.
+func (e *Encoder) terminate(b *bytes.Buffer) {
+	if e.opts.Semicolons {
+		b.WriteByte(';')
+	}
+}
+
+// encodeCompact writes n on a single line, with its children inline,
+// and without a terminator.
+func (e *Encoder) encodeCompact(b *bytes.Buffer, n *Node) {
+	for _, c := range n.Comments {
+		b.WriteString(c)
+		if strings.HasPrefix(c, "//") {
+			b.WriteByte('\n')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	e.encodeEntries(b, n)
+	if len(n.Children) > 0 || len(n.EndComments) > 0 {
+		b.WriteString(" {")
+		for i, c := range n.Children {
+			if i > 0 {
+				separate(b)
+			} else {
+				b.WriteByte(' ')
+			}
+			e.encodeCompact(b, c)
+		}
+		writeTrailingComments(b, n.EndComments, "")
+		if endsLine(b) || strings.HasPrefix(lastComment(n.EndComments), "//") {
+			b.WriteString("\n}")
+		} else {
+			b.WriteString(" }")
+		}
+	}
+	writeTrailingComments(b, n.TrailingComments, "")
+	if tc := n.TrailingComments; len(tc) > 0 && strings.HasPrefix(tc[len(tc)-1], "//") {
+		b.WriteByte('\n')
+	}
+}
+
+// separate writes a separator between two nodes written by
+// encodeCompact, unless a // comment already ended the first one.
+func separate(b *bytes.Buffer) {
+	if !endsLine(b) {
+		b.WriteString("; ")
+	}
+}
+
+// endsLine reports whether b ends with a newline.
+func endsLine(b *bytes.Buffer) bool {
+	bs := b.Bytes()
+	return len(bs) > 0 && bs[len(bs)-1] == '\n'
+}
+
+// encodeEntries writes n's type annotation, name, arguments and
+// properties, and the comments among them.
+func (e *Encoder) encodeEntries(b *bytes.Buffer, n *Node) {
+	writeAnnotation(b, n.TypeAnnotation)
+	writeIdentifier(b, n.Name)
+	written := make([]bool, len(n.EntryComments))
+	writeComments := func(match func(EntryComment) bool) {
+		for i, c := range n.EntryComments {
+			if !written[i] && match(c) {
+				b.WriteByte(' ')
+				b.WriteString(c.Text)
+				written[i] = true
+			}
+		}
+	}
+	for i, v := range n.Args {
+		writeComments(func(c EntryComment) bool { return c.Arg == i })
+		b.WriteByte(' ')
+		e.writeValue(b, v)
+	}
+	type indexed struct {
+		Prop
+		i int
+	}
+	props := make([]indexed, len(n.Props))
+	for i, p := range n.Props {
+		props[i] = indexed{p, i}
+	}
+	if e.opts.SortProperties {
+		sort.SliceStable(props, func(i, j int) bool { return props[i].Key < props[j].Key })
+	}
+	for _, p := range props {
+		writeComments(func(c EntryComment) bool { return c.Prop == p.i })
+		b.WriteByte(' ')
+		writeIdentifier(b, p.Key)
+		b.WriteByte('=')
+		e.writeValue(b, p.Value)
+	}
+	writeComments(func(EntryComment) bool { return true })
+}
+
+// lastComment returns the last of comments, or "" if there are none.
+func lastComment(comments []string) string {
+	if len(comments) == 0 {
+		return ""
+	}
+	return comments[len(comments)-1]
+}
+
+// writeTrailingComments writes comments after a node on the same
+// line, except that a // comment runs to the end of the line, so
+// anything after it goes on its own line.
+func writeTrailingComments(b *bytes.Buffer, comments []string, indent string) {
+	lineComment := false
+	for _, c := range comments {
+		if lineComment {
+			b.WriteByte('\n')
+			b.WriteString(indent)
+		} else {
+			b.WriteByte(' ')
+		}
+		b.WriteString(c)
+		lineComment = strings.HasPrefix(c, "//")
+	}
+}
+
+// writeIdentifier writes s as a bare identifier if possible, or a
+// quoted string otherwise.
+func writeIdentifier(b *bytes.Buffer, s string) {
+	if IsValidIdentifier(s) {
+		b.WriteString(s)
+	} else {
+		writeString(b, s)
+	}
+}
+
+// writeAnnotation writes the type annotation typ, if any.
+func writeAnnotation(b *bytes.Buffer, typ string) {
+	if typ != "" {
+		b.WriteByte('(')
+		writeIdentifier(b, typ)
+		b.WriteByte(')')
+	}
+}
+
+// writeValue writes v, keeping the original format of integers and
+// strings if the options ask for it. If v can't be written, it
+// records the error in e.err.
+func (e *Encoder) writeValue(b *bytes.Buffer, v Value) {
+	var err error
+	switch hashes, raw := v.RawHashes(); {
+	case e.opts.PreserveIntFormat && v.kind == KindInt && v.lit != "":
+		writeAnnotation(b, v.TypeAnnotation)
+		b.WriteString(v.lit)
+	case v.kind == KindFloat && e.opts.NumberFormat != ShortestNumbers:
+		writeAnnotation(b, v.TypeAnnotation)
+		err = writeFloatFormat(b, v, e.opts.NumberFormat, e.opts.Version)
+	case e.opts.PreserveStringStyle && raw:
+		writeAnnotation(b, v.TypeAnnotation)
+		writeRawString(b, v.str, hashes, e.opts.Version)
+	default:
+		err = writeValue(b, v, e.opts.Version)
+	}
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+// writeValue writes v in the syntax of KDL version ver, or fails if
+// that version can't represent it.
+func writeValue(b *bytes.Buffer, v Value, ver Version) error {
+	writeAnnotation(b, v.TypeAnnotation)
+	switch v.kind {
+	case KindNull:
+		return writeKeyword(b, "null", ver)
+	case KindString:
+		writeString(b, v.str)
+	case KindInt:
+		if v.bi != nil {
+			b.WriteString(v.bi.String())
+		} else {
+			b.WriteString(strconv.FormatInt(v.i, 10))
+		}
+	case KindFloat:
+		if v.bf != nil {
+			b.WriteString(withFraction(v.bf.Text('g', -1)))
+		} else {
+			return writeFloat(b, v.f, ver)
+		}
+	case KindBool:
+		return writeKeyword(b, strconv.FormatBool(v.b), ver)
+	default:
+		panic(fmt.Sprintf("unknown value kind %s", v.kind))
+	}
+	return nil
+}
+
+// writeKeyword writes the keyword kw, one of true, false, null, inf,
+// -inf and nan, in the syntax of KDL version ver: with a leading # in
+// V2, and bare in V1, which has no inf, -inf or nan.
+func writeKeyword(b *bytes.Buffer, kw string, ver Version) error {
+	if ver != V1 {
+		b.WriteByte('#')
+	} else if kw != "true" && kw != "false" && kw != "null" {
+		return fmt.Errorf("cannot write #%s in KDL v1", kw)
+	}
+	b.WriteString(kw)
+	return nil
+}
+
+// writeFloatFormat writes the float v in the given format.
+func writeFloatFormat(b *bytes.Buffer, v Value, format NumberFormat, ver Version) error {
+	if format == PreservedNumbers && v.lit != "" && !strings.HasPrefix(v.lit, "#") {
+		b.WriteString(v.lit)
+		return nil
+	}
+	verb := byte('g')
+	switch format {
+	case DecimalNumbers:
+		verb = 'f'
+	case ScientificNumbers:
+		verb = 'e'
+	}
+	switch {
+	case v.bf != nil:
+		b.WriteString(withFraction(v.bf.Text(verb, -1)))
+	case math.IsInf(v.f, 0) || math.IsNaN(v.f):
+		return writeFloat(b, v.f, ver)
+	default:
+		b.WriteString(withFraction(strconv.FormatFloat(v.f, verb, -1, 64)))
+	}
+	return nil
+}
+
+func writeFloat(b *bytes.Buffer, f float64, ver Version) error {
+	switch {
+	case math.IsInf(f, 1):
+		return writeKeyword(b, "inf", ver)
+	case math.IsInf(f, -1):
+		return writeKeyword(b, "-inf", ver)
+	case math.IsNaN(f):
+		return writeKeyword(b, "nan", ver)
+	default:
+		b.WriteString(withFraction(strconv.FormatFloat(f, 'g', -1, 64)))
+	}
+	return nil
+}
+
+// withFraction adds a zero fractional part to the formatted float s
+// if it has none, since KDL only lexes a number as a float if it has
+// a fractional part.
+func withFraction(s string) string {
+	if strings.Contains(s, ".") {
+		return s
+	}
+	if i := strings.IndexByte(s, 'e'); i >= 0 {
+		return s[:i] + ".0" + s[i:]
+	}
+	return s + ".0"
+}
+
+// writeString writes s as a quoted string, escaping as needed.
+func writeString(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	b.WriteString(Escape(s))
+	b.WriteByte('"')
+}
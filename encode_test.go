@@ -0,0 +1,701 @@
+package kdl
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestEncode(t *testing.T) {
+	doc := &Document{
+		Nodes: []*Node{
+			{
+				Name: "node",
+				Args: []Value{
+					StringValue("arg"),
+					IntValue(-42),
+					FloatValue(1.5),
+					FloatValue(3),
+					FloatValue(1e21),
+					FloatValue(math.Inf(-1)),
+					BoolValue(true),
+					NullValue(),
+				},
+				Props: []Prop{
+					{Key: "key", Value: StringValue("a \"quoted\"\n\tvalue\\")},
+					{Key: "quoted key", Value: IntValue(1)},
+					{Key: "true", Value: BoolValue(false)},
+				},
+				Children: []*Node{
+					{Name: "child", Children: []*Node{{Name: "grandchild"}}},
+					{Name: "123"},
+				},
+			},
+			{Name: "", Args: []Value{StringValue("\x00\x1f")}},
+			{Name: "ident-with~chars!", Props: []Prop{{Key: "-key", Value: IntValue(0)}, {Key: "-1", Value: IntValue(1)}}},
+			{Name: "annotated", Args: []Value{{TypeAnnotation: "u8", kind: KindInt, i: 1}, {TypeAnnotation: "my type", kind: KindNull}}},
+		},
+	}
+	want := `node "arg" -42 1.5 3.0 1.0e+21 #-inf #true #null key="a \"quoted\"\n\tvalue\\" "quoted key"=1 "true"=#false {
+    child {
+        grandchild
+    }
+    "123"
+}
+"" "\u{0}\u{1f}"
+ident-with~chars! -key=0 "-1"=1
+annotated (u8)1 ("my type")#null
+`
+
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(want, "\n")); diff != "" {
+		t.Errorf("wrong encoding (-got+want):\n%s", diff)
+	}
+
+	doc2, err := Parse(&b)
+	if err != nil {
+		t.Fatalf("parsing encoded document: %v", err)
+	}
+	if diff := cmp.Diff(doc2, doc, cmpValues); diff != "" {
+		t.Errorf("round trip changed document (-got+want):\n%s", diff)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	ms, err := filepath.Glob("testdata/valid/*.kdl")
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+
+	for _, n := range ms {
+		t.Run(n, func(t *testing.T) {
+			bs, err := os.ReadFile(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := Parse(bytes.NewBuffer(bs))
+			if err != nil {
+				t.Skipf("document doesn't parse: %v", err)
+			}
+			for _, opts := range []EncoderOptions{
+				{},
+				{Indent: "\t"},
+				{Indent: "\t", Semicolons: true},
+				{Compact: true},
+			} {
+				var b bytes.Buffer
+				if err := opts.NewEncoder(&b).Encode(doc); err != nil {
+					t.Fatalf("Encode(%+v) failed: %v", opts, err)
+				}
+				doc2, err := Parse(bytes.NewBuffer(b.Bytes()))
+				if err != nil {
+					t.Fatalf("parsing document encoded with %+v: %v\n%s", opts, err, b.String())
+				}
+				if diff := cmp.Diff(doc2, doc, cmpValues); diff != "" {
+					t.Errorf("round trip with %+v changed document (-got+want):\n%s\n%s", opts, diff, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeComments(t *testing.T) {
+	in := `// leading
+a 1 /* inner */ 2 // trailing
+b {
+  /* child */ c
+  // dangling
+} // after
+// end
+`
+	want := `// leading
+a 1 /* inner */ 2 // trailing
+b {
+    /* child */
+    c
+    // dangling
+} // after
+// end
+`
+
+	opts := ParseOptions{LexerOptions: LexerOptions{Comments: true}}
+	doc, err := opts.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(want, "\n")); diff != "" {
+		t.Errorf("wrong encoding (-got+want):\n%s", diff)
+	}
+
+	// Leading block comments move to their own lines, so the
+	// document can change on the first round trip, but the encoding
+	// is stable after that.
+	doc2, err := opts.Parse(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("parsing encoded document: %v", err)
+	}
+	var b2 bytes.Buffer
+	if err := NewEncoder(&b2).Encode(doc2); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if diff := cmp.Diff(strings.Split(b2.String(), "\n"), strings.Split(want, "\n")); diff != "" {
+		t.Errorf("round trip changed encoding (-got+want):\n%s", diff)
+	}
+}
+
+func TestEncodeCommentsInPlace(t *testing.T) {
+	// Comments among entries and at the end of children blocks stay
+	// where they were, with any options.
+	tests := []struct {
+		in   string
+		opts EncoderOptions
+		want string
+	}{
+		{
+			in: "a 1 /* x */ 2\n",
+		},
+		{
+			in: "a /* first */ 1 /* x */ y=2 /* before z */ z=3 /* after */ {\n    b\n}\n",
+		},
+		{
+			in:   "a z=1 /* y */ y=2\n",
+			opts: EncoderOptions{SortProperties: true},
+			want: "a /* y */ y=2 z=1\n",
+		},
+		{
+			in: "a {\n    b {\n        c\n        // end of b\n    }\n    // end of a\n}\n",
+		},
+		{
+			in: "a {\n    // only a comment\n}\n",
+		},
+		{
+			in:   "a 1 /* x */ 2 {\n    b\n    // end\n}\n",
+			opts: EncoderOptions{Compact: true},
+			want: "a 1 /* x */ 2 { b // end\n}\n",
+		},
+		{
+			in:   "a {\n    b\n    /* end */\n}\n",
+			opts: EncoderOptions{Compact: true},
+			want: "a { b /* end */ }\n",
+		},
+	}
+	popts := ParseOptions{LexerOptions: LexerOptions{Comments: true}}
+	for _, test := range tests {
+		want := test.want
+		if want == "" {
+			want = test.in
+		}
+		doc, err := popts.Parse(strings.NewReader(test.in))
+		if err != nil {
+			t.Fatalf("parsing %q: %v", test.in, err)
+		}
+		var b bytes.Buffer
+		if err := test.opts.NewEncoder(&b).Encode(doc); err != nil {
+			t.Fatalf("Encode(%q) failed: %v", test.in, err)
+		}
+		if diff := cmp.Diff(b.String(), want); diff != "" {
+			t.Errorf("wrong encoding of %q with %+v (-got+want):\n%s", test.in, test.opts, diff)
+		}
+
+		doc2, err := popts.Parse(&b)
+		if err != nil {
+			t.Fatalf("parsing encoded %q: %v", test.in, err)
+		}
+		if !doc2.Equal(doc) {
+			t.Errorf("round trip of %q changed document:\n%s", test.in, doc2.DebugString())
+		}
+	}
+}
+
+func TestEncoderOptions(t *testing.T) {
+	const in = `// top
+node 1 z=1 a=2 z=3 {
+    child "x" {
+        grandchild
+    } // trailing
+    other /* c */
+}
+last
+`
+	tests := []struct {
+		opts EncoderOptions
+		want string
+	}{
+		{
+			EncoderOptions{},
+			in,
+		},
+		{
+			EncoderOptions{Indent: "\t"},
+			"// top\nnode 1 z=1 a=2 z=3 {\n\tchild \"x\" {\n\t\tgrandchild\n\t} // trailing\n\tother /* c */\n}\nlast\n",
+		},
+		{
+			EncoderOptions{Semicolons: true},
+			"// top\nnode 1 z=1 a=2 z=3 {\n    child \"x\" {\n        grandchild;\n    } // trailing\n    other /* c */;\n};\nlast;\n",
+		},
+		{
+			EncoderOptions{Indent: "\t", Semicolons: true},
+			"// top\nnode 1 z=1 a=2 z=3 {\n\tchild \"x\" {\n\t\tgrandchild;\n\t} // trailing\n\tother /* c */;\n};\nlast;\n",
+		},
+		{
+			EncoderOptions{Compact: true, Semicolons: true},
+			"// top\nnode 1 z=1 a=2 z=3 { child \"x\" { grandchild } // trailing\nother /* c */ }; last\n",
+		},
+		{
+			EncoderOptions{SortProperties: true},
+			strings.Replace(in, "z=1 a=2 z=3", "a=2 z=1 z=3", 1),
+		},
+		{
+			EncoderOptions{Compact: true},
+			"// top\nnode 1 z=1 a=2 z=3 { child \"x\" { grandchild } // trailing\nother /* c */ }; last\n",
+		},
+		{
+			EncoderOptions{Compact: true, SortProperties: true, Indent: "  "},
+			"// top\nnode 1 a=2 z=1 z=3 { child \"x\" { grandchild } // trailing\nother /* c */ }; last\n",
+		},
+	}
+
+	popts := ParseOptions{LexerOptions: LexerOptions{Comments: true}}
+	doc, err := popts.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := test.opts.NewEncoder(&b).Encode(doc); err != nil {
+			t.Fatalf("Encode(%+v) failed: %v", test.opts, err)
+		}
+		if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(test.want, "\n")); diff != "" {
+			t.Errorf("wrong encoding with %+v (-got+want):\n%s", test.opts, diff)
+		}
+
+		doc2, err := popts.Parse(&b)
+		if err != nil {
+			t.Fatalf("parsing document encoded with %+v: %v", test.opts, err)
+		}
+		if got, _ := doc2.Get("node").Prop("z"); !got.Equal(IntValue(3)) {
+			t.Errorf("round trip with %+v: z=%v, want 3", test.opts, got)
+		}
+		if diff := cmp.Diff(doc2, doc, cmpValues, cmpopts.IgnoreFields(rawNode{}, "Props")); diff != "" {
+			t.Errorf("round trip with %+v changed document (-got+want):\n%s", test.opts, diff)
+		}
+	}
+}
+
+func TestNodeWriteTo(t *testing.T) {
+	doc, err := Parse(strings.NewReader(`config {
+    server "web" port=80 {
+        tls true
+    }
+}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	n := doc.Get("config", "server")
+
+	var b bytes.Buffer
+	got, err := n.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	want := `server "web" port=80 {
+    tls #true
+}
+`
+	if diff := cmp.Diff(b.String(), want); diff != "" {
+		t.Errorf("wrong output (-got+want):\n%s", diff)
+	}
+	if got != int64(len(want)) {
+		t.Errorf("WriteTo returned %d, want %d", got, len(want))
+	}
+
+	doc2, err := Parse(&b)
+	if err != nil {
+		t.Fatalf("parsing written node: %v", err)
+	}
+	if diff := cmp.Diff(doc2.Nodes, []*Node{n}, cmpValues); diff != "" {
+		t.Errorf("written node parsed differently (-got+want):\n%s", diff)
+	}
+}
+
+func TestPreserveIntFormat(t *testing.T) {
+	in := "node 0xFF 0o17 0b1010 1_000 -0x10 +5 (u8)0xff 0x1_0000_0000_0000_0000 a=0xFF b=1.5\n"
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	doc.Nodes[0].Args = append(doc.Nodes[0].Args, IntValue(255))
+
+	tests := []struct {
+		opts EncoderOptions
+		want string
+	}{
+		{
+			EncoderOptions{PreserveIntFormat: true},
+			"node 0xFF 0o17 0b1010 1_000 -0x10 +5 (u8)0xff 0x1_0000_0000_0000_0000 255 a=0xFF b=1.5\n",
+		},
+		{
+			EncoderOptions{},
+			"node 255 15 10 1000 -16 5 (u8)255 18446744073709551616 255 a=255 b=1.5\n",
+		},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := test.opts.NewEncoder(&b).Encode(doc); err != nil {
+			t.Fatalf("Encode(%+v) failed: %v", test.opts, err)
+		}
+		if diff := cmp.Diff(b.String(), test.want); diff != "" {
+			t.Errorf("wrong encoding with %+v (-got+want):\n%s", test.opts, diff)
+		}
+	}
+}
+
+func TestPreserveStringStyle(t *testing.T) {
+	in := `node r#"a"b"# r"plain" r##"x"#y"## "quoted\n" key=(t)r#"v"#` + "\n"
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	doc.Nodes[0].Args = append(doc.Nodes[0].Args, StringValue("new"))
+
+	tests := []struct {
+		opts EncoderOptions
+		want string
+	}{
+		{
+			EncoderOptions{PreserveStringStyle: true},
+			`node #"a"b"# #"plain"# ##"x"#y"## "quoted\n" "new" key=(t)#"v"#` + "\n",
+		},
+		{
+			EncoderOptions{},
+			`node "a\"b" "plain" "x\"#y" "quoted\n" "new" key=(t)"v"` + "\n",
+		},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := test.opts.NewEncoder(&b).Encode(doc); err != nil {
+			t.Fatalf("Encode(%+v) failed: %v", test.opts, err)
+		}
+		if diff := cmp.Diff(b.String(), test.want); diff != "" {
+			t.Errorf("wrong encoding with %+v (-got+want):\n%s", test.opts, diff)
+		}
+	}
+}
+
+func TestNumberFormat(t *testing.T) {
+	doc, err := ParseString("n 1000000.0 1e6 1.0e-7 0.000_1 1.5 123.456e3 1e21 -0.0 (f32)2.5 #nan 1\n")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	doc.Nodes = append(doc.Nodes, NewNode("built", FloatValue(1e-7), FloatValue(math.Inf(-1))))
+
+	tests := []struct {
+		format NumberFormat
+		want   string
+	}{
+		{
+			ShortestNumbers,
+			"n 1.0e+06 1.0e+06 1.0e-07 0.0001 1.5 123456.0 1.0e+21 -0.0 (f32)2.5 #nan 1\nbuilt 1.0e-07 #-inf\n",
+		},
+		{
+			DecimalNumbers,
+			"n 1000000.0 1000000.0 0.0000001 0.0001 1.5 123456.0 1000000000000000000000.0 -0.0 (f32)2.5 #nan 1\nbuilt 0.0000001 #-inf\n",
+		},
+		{
+			ScientificNumbers,
+			"n 1.0e+06 1.0e+06 1.0e-07 1.0e-04 1.5e+00 1.23456e+05 1.0e+21 -0.0e+00 (f32)2.5e+00 #nan 1\nbuilt 1.0e-07 #-inf\n",
+		},
+		{
+			PreservedNumbers,
+			"n 1000000.0 1e6 1.0e-7 0.000_1 1.5 123.456e3 1e21 -0.0 (f32)2.5 #nan 1\nbuilt 1.0e-07 #-inf\n",
+		},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := (EncoderOptions{NumberFormat: test.format}).NewEncoder(&b).Encode(doc); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if got := b.String(); got != test.want {
+			t.Errorf("NumberFormat %d: Encode = %q, want %q", test.format, got, test.want)
+		}
+		doc2, err := Parse(&b)
+		if err != nil {
+			t.Errorf("NumberFormat %d: parsing encoded document: %v", test.format, err)
+		} else if !doc2.Equal(doc) {
+			t.Errorf("NumberFormat %d: round trip changed document:\n%s", test.format, doc2.DebugString())
+		}
+	}
+}
+
+func TestEncodeVersion(t *testing.T) {
+	in := "node null #true false r#\"a\"b\"# r\"x\ny\" 1.5\n"
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tests := []struct {
+		ver  Version
+		want string
+	}{
+		{0, "node #null #true #false #\"a\"b\"# \"x\\ny\" 1.5\n"},
+		{V2, "node #null #true #false #\"a\"b\"# \"x\\ny\" 1.5\n"},
+		{V1, "node null true false r#\"a\"b\"# r\"x\ny\" 1.5\n"},
+	}
+	for _, test := range tests {
+		opts := EncoderOptions{Version: test.ver, PreserveStringStyle: true}
+		var b bytes.Buffer
+		if err := opts.NewEncoder(&b).Encode(doc); err != nil {
+			t.Fatalf("Encode(%+v) failed: %v", opts, err)
+		}
+		if diff := cmp.Diff(b.String(), test.want); diff != "" {
+			t.Errorf("wrong encoding with %+v (-got+want):\n%s", opts, diff)
+		}
+
+		// The output parses under the version it was written for.
+		ver := test.ver
+		if ver == 0 {
+			ver = V2
+		}
+		popts := ParseOptions{LexerOptions: LexerOptions{Version: ver}}
+		doc2, err := popts.Parse(&b)
+		if err != nil {
+			t.Fatalf("parsing document encoded with %+v: %v", opts, err)
+		}
+		if !doc2.Equal(doc) {
+			t.Errorf("round trip with %+v changed document:\n%s", opts, doc2.DebugString())
+		}
+	}
+
+	// KDL v1 has no infinities or NaN.
+	for _, f := range []float64{math.Inf(1), math.Inf(-1), math.NaN()} {
+		var b bytes.Buffer
+		err := EncoderOptions{Version: V1}.NewEncoder(&b).Encode(NewDocument(NewNode("n", FloatValue(f))))
+		if err == nil {
+			t.Errorf("Encode(%v) in KDL v1 succeeded, want error", f)
+		}
+		if b.Len() != 0 {
+			t.Errorf("Encode(%v) in KDL v1 wrote %q, want nothing", f, b.String())
+		}
+	}
+}
+
+func TestSpecialFloats(t *testing.T) {
+	doc, err := ParseString("node #inf #-inf #nan x=#nan")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	n := doc.Nodes[0]
+	checks := []struct {
+		v    Value
+		want func(float64) bool
+	}{
+		{n.Args[0], func(f float64) bool { return math.IsInf(f, 1) }},
+		{n.Args[1], func(f float64) bool { return math.IsInf(f, -1) }},
+		{n.Args[2], math.IsNaN},
+		{n.Props[0].Value, math.IsNaN},
+	}
+	for i, c := range checks {
+		if f, ok := c.v.AsFloat(); !ok || !c.want(f) {
+			t.Errorf("value %d: AsFloat() = %v, %v", i, f, ok)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if got, want := b.String(), "node #inf #-inf #nan x=#nan\n"; got != want {
+		t.Errorf("Encode = %q, want %q", got, want)
+	}
+	doc2, err := Parse(&b)
+	if err != nil {
+		t.Fatalf("parsing encoded document: %v", err)
+	}
+	if !doc2.Equal(doc) {
+		t.Errorf("round trip changed document:\n%s", doc2.DebugString())
+	}
+
+	// Built with FloatValue rather than parsed.
+	b.Reset()
+	built := NewDocument(NewNode("node", FloatValue(math.Inf(1)), FloatValue(math.Inf(-1)), FloatValue(math.NaN())))
+	if err := NewEncoder(&b).Encode(built); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if got, want := b.String(), "node #inf #-inf #nan\n"; got != want {
+		t.Errorf("Encode = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeExoticSpaces(t *testing.T) {
+	// Unicode spaces separate entries on input, but the encoder only
+	// writes ASCII spaces between them, and quotes identifiers that
+	// contain them.
+	doc, err := ParseString("node\u00a01\u3000k=\"a\u00a0b\"\u2000{\n\u2003child\n}\n")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	doc.Nodes = append(doc.Nodes, NewNode("non\u00a0breaking", StringValue("x\u2028y")).SetProp("k\u00a0ey", IntValue(2)))
+	doc.Nodes[1].TypeAnnotation = "t\u00a0t"
+
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	want := "node 1 k=\"a\u00a0b\" {\n    child\n}\n" +
+		"(\"t\u00a0t\")\"non\u00a0breaking\" \"x\\u{2028}y\" \"k\u00a0ey\"=2\n"
+	if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(want, "\n")); diff != "" {
+		t.Errorf("wrong encoding (-got+want):\n%s", diff)
+	}
+	doc2, err := Parse(&b)
+	if err != nil {
+		t.Fatalf("parsing encoded document: %v", err)
+	}
+	if !doc2.Equal(doc) {
+		t.Errorf("round trip changed document:\n%s", doc2.DebugString())
+	}
+}
+
+func TestKeepTrivia(t *testing.T) {
+	ms, err := filepath.Glob("testdata/valid/*.kdl")
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	ins := map[string]string{
+		"handwritten": "\ufeff// leading\r\n\r\n(t)a 1   /* x */ 2 key=\"v\" {\n\t/-b\n\tc; d {e}\n\n  // end\n} // after\n/- f 3\n\n  \\\n g\n/* done */",
+	}
+	for _, n := range ms {
+		bs, err := os.ReadFile(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ins[n] = string(bs)
+	}
+
+	opts := ParseOptions{KeepTrivia: true}
+	for name, in := range ins {
+		t.Run(name, func(t *testing.T) {
+			doc, err := opts.Parse(strings.NewReader(in))
+			if err != nil {
+				t.Skipf("document doesn't parse: %v", err)
+			}
+			var b bytes.Buffer
+			if err := NewEncoder(&b).Encode(doc); err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			if diff := cmp.Diff(b.String(), in); diff != "" {
+				t.Errorf("round trip changed document (-got+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestKeepTriviaChanged(t *testing.T) {
+	in := `// top
+a 1 // one
+b   2 {
+    c  3
+    d  4 /* four */
+}
+e 5; f 6
+`
+	tests := []struct {
+		name   string
+		change func(*Document)
+		want   string
+	}{
+		{
+			"arg",
+			func(d *Document) { d.Nodes[1].Children[0].Args[0] = IntValue(30) },
+			`// top
+a 1 // one
+b   2 {
+    c 30
+    d  4 /* four */
+}
+e 5; f 6
+`,
+		},
+		{
+			"prop on parent",
+			func(d *Document) { d.Nodes[1].SetProp("x", BoolValue(true)) },
+			`// top
+a 1 // one
+b 2 x=#true {
+    c  3
+    d  4 /* four */
+}
+e 5; f 6
+`,
+		},
+		{
+			"new children",
+			func(d *Document) { d.Nodes[0].AddChild(NewNode("z")) },
+			`// top
+a 1 {
+    z
+}
+b   2 {
+    c  3
+    d  4 /* four */
+}
+e 5; f 6
+`,
+		},
+		{
+			"removed children",
+			func(d *Document) { d.Nodes[1].Children = nil },
+			`// top
+a 1 // one
+b   2 {}
+e 5; f 6
+`,
+		},
+		{
+			"new nodes",
+			func(d *Document) {
+				d.Nodes[1].AddChild(NewNode("y"))
+				d.Nodes = append(d.Nodes, NewNode("g", IntValue(7)))
+			},
+			`// top
+a 1 // one
+b   2 {
+    c  3
+    d  4 /* four */
+    y
+}
+e 5; f 6
+g 7
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := ParseOptions{KeepTrivia: true}.Parse(strings.NewReader(in))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			test.change(doc)
+			var b bytes.Buffer
+			if err := NewEncoder(&b).Encode(doc); err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(test.want, "\n")); diff != "" {
+				t.Errorf("wrong encoding (-got+want):\n%s", diff)
+			}
+		})
+	}
+}
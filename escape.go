@@ -0,0 +1,177 @@
+package kdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Escape returns s with the characters that can't appear literally
+// in a quoted KDL string replaced by escape sequences. Unicode
+// newlines such as U+2028 are escaped too, so that the string stays
+// on one line. The result doesn't include the surrounding quotes.
+func Escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 || r == 0x7F || newline(r) {
+				fmt.Fprintf(&b, `\u{%x}`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
+// RawString returns s as a raw string in the syntax of KDL version
+// ver, with its delimiters: r"a\b" or r#"say "hi""# in V1, and
+// #"a\b"# or #"say "hi""# in V2, which zero means. It uses the fewest
+// # that make the end of the string unambiguous, which in V1 is none
+// if s has no quotes. V2 raw strings can't span lines, so in V2 a
+// string with newlines is returned quoted, as by Escape.
+func RawString(s string, ver Version) string {
+	var b bytes.Buffer
+	writeRawString(&b, s, 0, ver)
+	return b.String()
+}
+
+// writeRawString writes s as a raw string in the syntax of KDL
+// version ver, with at least hashes # around it, or more if s needs
+// them. In V2, it writes a string with newlines quoted instead.
+func writeRawString(b *bytes.Buffer, s string, hashes int, ver Version) {
+	hashes = max(hashes, rawHashes(s))
+	switch {
+	case ver == V1:
+		b.WriteByte('r')
+	case strings.ContainsFunc(s, newline):
+		writeString(b, s)
+		return
+	default:
+		// V2 raw strings have at least one #.
+		hashes = max(hashes, 1)
+	}
+	delim := strings.Repeat("#", hashes)
+	b.WriteString(delim)
+	b.WriteByte('"')
+	b.WriteString(s)
+	b.WriteByte('"')
+	b.WriteString(delim)
+}
+
+// rawHashes returns the fewest # needed around s as a raw string: one
+// more than the longest run of # following a quote in s, or none if s
+// has no quotes.
+func rawHashes(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != '"' {
+			continue
+		}
+		run := 0
+		for i+1+run < len(s) && s[i+1+run] == '#' {
+			run++
+		}
+		n = max(n, run+1)
+	}
+	return n
+}
+
+// Unescape decodes the escape sequences in s, the text between the
+// quotes of a quoted KDL string. It is the inverse of Escape.
+func Unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	rd := strings.NewReader(s)
+	next := func() rune {
+		r, _, err := rd.ReadRune()
+		if err != nil {
+			return eof
+		}
+		return r
+	}
+	var b strings.Builder
+	for r := next(); r != eof; r = next() {
+		if r != '\\' {
+			b.WriteRune(r)
+			continue
+		}
+		r, err := unescapeRune(next)
+		if err != nil {
+			return "", err
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+// unescapeRune decodes the escape sequence following a backslash,
+// reading it from next, which returns eof at the end of the input.
+func unescapeRune(next func() rune) (rune, error) {
+	switch r := next(); r {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '\\':
+		return '\\', nil
+	case '/':
+		return '/', nil
+	case '"':
+		return '"', nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'u':
+		if r = next(); r != '{' {
+			return 0, fmt.Errorf("expected open bracket after \\u, got %q", string(r))
+		}
+		var ret rune
+		for i := 0; ; i++ {
+			r = next()
+			switch {
+			case r == '}':
+				if i == 0 {
+					return 0, errors.New("no hex in \\u escape sequence")
+				}
+				if ret > unicode.MaxRune || (ret >= 0xD800 && ret <= 0xDFFF) {
+					return 0, fmt.Errorf("invalid code point U+%04X in \\u escape sequence", ret)
+				}
+				return ret, nil
+			case i == 6:
+				return 0, errors.New("too many hex digits in \\u escape sequence")
+			case r >= '0' && r <= '9':
+				ret = (ret << 4) + (r - '0')
+			case r >= 'a' && r <= 'f':
+				ret = (ret << 4) + (r - 'a' + 10)
+			case r >= 'A' && r <= 'F':
+				ret = (ret << 4) + (r - 'A' + 10)
+			default:
+				return 0, fmt.Errorf("unexpected hex in \\u escape sequence, got %q", string(r))
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unknown escape sequence \\%s", string(r))
+	}
+}
@@ -0,0 +1,126 @@
+package kdl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: `plain`, want: "plain"},
+		{in: `\n`, want: "\n"},
+		{in: `\r`, want: "\r"},
+		{in: `\t`, want: "\t"},
+		{in: `\\`, want: `\`},
+		{in: `\/`, want: "/"},
+		{in: `\"`, want: `"`},
+		{in: `\b`, want: "\b"},
+		{in: `\f`, want: "\f"},
+		{in: `a\nb\tc`, want: "a\nb\tc"},
+		{in: `\u{41}`, want: "A"},
+		{in: `\u{e9}\u{E9}`, want: "éé"},
+		{in: `\u{1F600}`, want: "\U0001F600"},
+		{in: `\u{10FFFF}`, want: "\U0010FFFF"},
+		{in: `\u{0}`, want: "\x00"},
+
+		{in: `\q`, wantErr: `unknown escape sequence \q`},
+		{in: `\`, wantErr: `unknown escape sequence`},
+		{in: `\u41`, wantErr: `expected open bracket after \u, got "4"`},
+		{in: `\u{}`, wantErr: `no hex in \u escape sequence`},
+		{in: `\u{0010FFFF}`, wantErr: `too many hex digits in \u escape sequence`},
+		{in: `\u{12g}`, wantErr: `unexpected hex in \u escape sequence, got "g"`},
+		{in: `\u{41`, wantErr: `unexpected hex in \u escape sequence`},
+		{in: `\u{110000}`, wantErr: `invalid code point U+110000 in \u escape sequence`},
+		{in: `\u{D800}`, wantErr: `invalid code point U+D800 in \u escape sequence`},
+	}
+
+	for _, test := range tests {
+		got, err := Unescape(test.in)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Unescape(%q) = %q, %v, want error containing %q", test.in, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unescape(%q) failed: %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("Unescape(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"\n\r\t", `\n\r\t`},
+		{`a\b`, `a\\b`},
+		{`say "hi"`, `say \"hi\"`},
+		{"\b\f", `\b\f`},
+		{"/", "/"},
+		{"\x00\x1f\x7f", `\u{0}\u{1f}\u{7f}`},
+		{"é\U0001F600", "é\U0001F600"},
+		{"a\u0085b\u2028c\u2029", `a\u{85}b\u{2028}c\u{2029}`},
+		{"a\u00a0b\u3000", "a\u00a0b\u3000"},
+	}
+
+	for _, test := range tests {
+		got := Escape(test.in)
+		if got != test.want {
+			t.Errorf("Escape(%q) = %q, want %q", test.in, got, test.want)
+		}
+		back, err := Unescape(got)
+		if err != nil {
+			t.Errorf("Unescape(Escape(%q)) failed: %v", test.in, err)
+		} else if back != test.in {
+			t.Errorf("Unescape(Escape(%q)) = %q, want the original", test.in, back)
+		}
+	}
+}
+
+func TestRawString(t *testing.T) {
+	tests := []struct {
+		in     string
+		v1, v2 string
+	}{
+		{"plain", `r"plain"`, `#"plain"#`},
+		{"", `r""`, `#""#`},
+		{`a\b`, `r"a\b"`, `#"a\b"#`},
+		{`say "hi"`, `r#"say "hi""#`, `#"say "hi""#`},
+		{`"`, `r#"""#`, `#"""#`},
+		{`a"#b`, `r##"a"#b"##`, `##"a"#b"##`},
+		{`a"##b"#`, `r###"a"##b"#"###`, `###"a"##b"#"###`},
+		{`#"#`, `r##"#"#"##`, `##"#"#"##`},
+		{"a#b", `r"a#b"`, `#"a#b"#`},
+		{"line\nbreak", "r\"line\nbreak\"", `"line\nbreak"`},
+	}
+
+	for _, test := range tests {
+		for _, v := range []struct {
+			version Version
+			want    string
+		}{{V1, test.v1}, {V2, test.v2}, {0, test.v2}} {
+			got := RawString(test.in, v.version)
+			if got != v.want {
+				t.Errorf("RawString(%q, %d) = %q, want %q", test.in, v.version, got, v.want)
+				continue
+			}
+			if v.version == 0 {
+				continue
+			}
+			opts := ParseOptions{LexerOptions: LexerOptions{Version: v.version}}
+			doc, err := opts.ParseString("node " + got)
+			if err != nil {
+				t.Errorf("parsing RawString(%q, %d) failed: %v", test.in, v.version, err)
+			} else if s, _ := doc.Nodes[0].Args[0].AsString(); s != test.in {
+				t.Errorf("parsing RawString(%q, %d) = %q, want the original", test.in, v.version, s)
+			}
+		}
+	}
+}
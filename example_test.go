@@ -0,0 +1,99 @@
+package kdl_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/danderson/go-kdl"
+)
+
+// Duration is a time.Duration that encodes as a string like "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalKDL() (*kdl.Value, error) {
+	v := kdl.StringValue(time.Duration(d).String())
+	return &v, nil
+}
+
+func (d *Duration) UnmarshalKDL(v *kdl.Value) error {
+	s, ok := v.AsString()
+	if !ok {
+		return fmt.Errorf("duration must be a string, not %s", v.Kind())
+	}
+	pd, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(pd)
+	return nil
+}
+
+func ExampleMarshaler() {
+	type Config struct {
+		Timeout Duration `kdl:"timeout"`
+		Retry   struct {
+			Backoff Duration `kdl:"backoff,prop"`
+		} `kdl:"retry"`
+	}
+
+	var cfg Config
+	err := kdl.Unmarshal([]byte(`timeout "1m30s"
+retry backoff="250ms"`), &cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(time.Duration(cfg.Timeout), time.Duration(cfg.Retry.Backoff))
+
+	cfg.Timeout *= 2
+	out, err := kdl.Marshal(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(string(out))
+	// Output:
+	// 1m30s 250ms
+	// timeout "3m0s"
+	// retry backoff="250ms"
+}
+
+func ExampleNewLexer() {
+	l := kdl.NewLexerBytes([]byte(`server "web" port=80`))
+	for tok := range l.All() {
+		switch tok.Type {
+		case kdl.TokenIdentifier:
+			fmt.Printf("%s identifier %s\n", tok.Pos, tok.Value)
+		case kdl.TokenString, kdl.TokenInt:
+			fmt.Printf("%s literal %s\n", tok.Pos, tok.Value)
+		case kdl.TokenErr:
+			log.Fatal(tok.Err)
+		}
+	}
+	// Output:
+	// 1:1 identifier server
+	// 1:8 literal web
+	// 1:14 identifier port
+	// 1:19 literal 80
+}
+
+func ExampleNewNode() {
+	doc := kdl.NewDocument(
+		kdl.NewNode("title", kdl.StringValue("example")),
+		kdl.NewNode("server", kdl.StringValue("web")).
+			SetProp("port", kdl.IntValue(80)).
+			SetProp("tls", kdl.BoolValue(true)).
+			SetProp("port", kdl.IntValue(8080)).
+			AddChild(kdl.NewNode("listen", kdl.StringValue("0.0.0.0"))).
+			AddChild(kdl.NewNode("allowed hosts", kdl.StringValue("a"), kdl.StringValue("b"))),
+	)
+	if err := kdl.NewEncoder(os.Stdout).Encode(doc); err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// title "example"
+	// server "web" port=8080 tls=#true {
+	//     listen "0.0.0.0"
+	//     "allowed hosts" "a" "b"
+	// }
+}
@@ -0,0 +1,118 @@
+package kdl
+
+import (
+	"bytes"
+	"io"
+)
+
+// Format reads a KDL document from r and writes it to w in canonical
+// form: indented with four spaces, one node per line, with numbers
+// in decimal, strings quoted with minimal escaping, identifiers
+// unquoted where possible, and properties sorted by key with
+// overridden duplicates removed. Slashdashed content is dropped.
+//
+// Comments are kept. Block comments among a node's arguments and
+// properties, and comments at the end of a children block, stay in
+// place, and others move to the start or end of the node they belong
+// to. Documents that differ only in formatting produce
+// byte-identical output.
+//
+// Format reads documents written for either KDL v1 or v2, and writes
+// KDL v2, converting v1's true, false, null and r"raw strings" to
+// #true, #false, #null and #"raw strings"#. Set FormatOptions.Version
+// to read and write a single version instead.
+func Format(r io.Reader, w io.Writer) error {
+	return FormatOptions{}.Format(r, w)
+}
+
+// FormatOptions configures the behavior of Format.
+type FormatOptions struct {
+	// KeepBlankLines keeps blank lines between nodes, collapsing each
+	// run of them into one, so that groups of nodes stay apart.
+	// Documents that differ only in their blank lines then format
+	// differently.
+	KeepBlankLines bool
+	// Version is the version of the KDL spec that documents are read
+	// and written in, as for LexerOptions.Version and
+	// EncoderOptions.Version. Zero reads either version and writes V2.
+	Version Version
+}
+
+// Format is like the top-level Format, using the options in o.
+func (o FormatOptions) Format(r io.Reader, w io.Writer) error {
+	popts := ParseOptions{
+		LexerOptions:   LexerOptions{Comments: true, Version: o.Version},
+		KeepBlankLines: o.KeepBlankLines,
+	}
+	doc, err := popts.Parse(r)
+	if err != nil {
+		return err
+	}
+	dedupeProps(doc.Nodes)
+	eopts := EncoderOptions{SortProperties: true, Version: o.Version}
+	return eopts.NewEncoder(w).Encode(doc)
+}
+
+// FormatBytes is like Format, for a document held in memory. It
+// returns the canonical form of src, or the first syntax error in it.
+func FormatBytes(src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if err := Format(bytes.NewReader(src), &b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// dedupeProps removes properties that are overridden by a later
+// property with the same key from nodes and their descendants.
+func dedupeProps(nodes []*Node) {
+	for _, n := range nodes {
+		remapPropComments(n)
+		n.Props = uniqueProps(n.Props)
+		dedupeProps(n.Children)
+	}
+}
+
+// remapPropComments updates the property indices in n.EntryComments
+// for the properties that uniqueProps is about to remove. A comment
+// before a removed property moves to the next one that's kept.
+func remapPropComments(n *Node) {
+	if len(n.EntryComments) == 0 {
+		return
+	}
+	last := map[string]int{}
+	for i, p := range n.Props {
+		last[p.Key] = i
+	}
+	next := make([]int, len(n.Props)+1) // new index of the first kept property at or after each index
+	next[len(n.Props)] = -1
+	kept := len(last)
+	for i := len(n.Props) - 1; i >= 0; i-- {
+		next[i] = next[i+1]
+		if last[n.Props[i].Key] == i {
+			kept--
+			next[i] = kept
+		}
+	}
+	for i, c := range n.EntryComments {
+		if c.Prop >= 0 && c.Prop < len(n.Props) {
+			n.EntryComments[i].Prop = next[c.Prop]
+		}
+	}
+}
+
+// uniqueProps returns the props that aren't overridden by a later
+// property with the same key, in their original order. It reuses the
+// storage of props.
+func uniqueProps(props []Prop) []Prop {
+	seen := map[string]bool{}
+	keep := len(props)
+	for i := len(props) - 1; i >= 0; i-- {
+		if p := props[i]; !seen[p.Key] {
+			seen[p.Key] = true
+			keep--
+			props[keep] = p
+		}
+	}
+	return props[keep:]
+}
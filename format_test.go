@@ -0,0 +1,206 @@
+package kdl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFormat(t *testing.T) {
+	ms, err := filepath.Glob("testdata/format/*.kdl")
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+
+	for _, n := range ms {
+		t.Run(n, func(t *testing.T) {
+			bs, err := os.ReadFile(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(strings.Replace(n, "/format/", "/format_want/", 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := Format(bytes.NewReader(bs), &b); err != nil {
+				t.Fatalf("Format failed: %v", err)
+			}
+			if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(string(want), "\n")); diff != "" {
+				t.Errorf("wrong output (-got+want):\n%s", diff)
+			}
+
+			got, err := FormatBytes(bs)
+			if err != nil {
+				t.Fatalf("FormatBytes failed: %v", err)
+			}
+			if diff := cmp.Diff(strings.Split(string(got), "\n"), strings.Split(string(want), "\n")); diff != "" {
+				t.Errorf("wrong FormatBytes output (-got+want):\n%s", diff)
+			}
+
+			// Canonical output is its own canonical form.
+			var b2 bytes.Buffer
+			if err := Format(bytes.NewReader(want), &b2); err != nil {
+				t.Fatalf("Format of canonical form failed: %v", err)
+			}
+			if diff := cmp.Diff(strings.Split(b2.String(), "\n"), strings.Split(string(want), "\n")); diff != "" {
+				t.Errorf("formatting canonical form changed it (-got+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFormatEquivalent(t *testing.T) {
+	var out []string
+	for _, n := range []string{"testdata/format/equivalent_a.kdl", "testdata/format/equivalent_b.kdl"} {
+		f, err := os.Open(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var b bytes.Buffer
+		if err := Format(f, &b); err != nil {
+			t.Fatalf("Format(%s) failed: %v", n, err)
+		}
+		out = append(out, b.String())
+	}
+	if out[0] != out[1] {
+		t.Errorf("equivalent documents formatted differently:\n%s\n%s", out[0], out[1])
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	var b bytes.Buffer
+	if err := Format(strings.NewReader("node {"), &b); err == nil {
+		t.Errorf("Format of invalid document succeeded, want error")
+	}
+	if b.Len() != 0 {
+		t.Errorf("Format of invalid document wrote %q, want nothing", b.String())
+	}
+
+	// FormatBytes returns the parser's first error as is.
+	const in = "a 1\nb \"unclosed\nc {"
+	_, want := ParseString(in)
+	out, err := FormatBytes([]byte(in))
+	if err == nil || err.Error() != want.Error() {
+		t.Errorf("FormatBytes error = %v, want %v", err, want)
+	}
+	var serr *SyntaxError
+	if !errors.As(err, &serr) || serr.Category != SyntaxUnterminatedString {
+		t.Errorf("FormatBytes error = %v, want a SyntaxUnterminatedString *SyntaxError", err)
+	}
+	if out != nil {
+		t.Errorf("FormatBytes of invalid document returned %q, want nil", out)
+	}
+}
+
+func TestFormatBlankLines(t *testing.T) {
+	const in = `a 1
+b 2
+
+// section two
+c 3
+
+
+
+d { x; y
+
+    z
+}
+/- skipped
+e;
+
+f;   g
+/* block */
+h
+`
+	const want = `a 1
+b 2
+
+// section two
+c 3
+
+d {
+    x
+    y
+
+    z
+}
+e
+
+f
+g
+/* block */
+h
+`
+	var b bytes.Buffer
+	if err := (FormatOptions{KeepBlankLines: true}).Format(strings.NewReader(in), &b); err != nil {
+		t.Fatalf("Format failed: %v", err)
+	}
+	if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(want, "\n")); diff != "" {
+		t.Errorf("wrong output (-got+want):\n%s", diff)
+	}
+
+	// Blank lines are dropped by default.
+	b.Reset()
+	if err := Format(strings.NewReader(in), &b); err != nil {
+		t.Fatalf("Format failed: %v", err)
+	}
+	if strings.Contains(b.String(), "\n\n") {
+		t.Errorf("Format kept blank lines without KeepBlankLines:\n%s", b.String())
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	in := "a true null r#\"x\"y\"# 1.5\n"
+	tests := []struct {
+		version Version
+		want    string
+	}{
+		{0, "a #true #null \"x\\\"y\" 1.5\n"},
+		{V1, "a true null \"x\\\"y\" 1.5\n"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := (FormatOptions{Version: test.version}).Format(strings.NewReader(in), &b); err != nil {
+			t.Errorf("Format with Version %d failed: %v", test.version, err)
+			continue
+		}
+		if got := b.String(); got != test.want {
+			t.Errorf("Format with Version %d = %q, want %q", test.version, got, test.want)
+		}
+	}
+
+	// V2 doesn't read v1 documents.
+	if err := (FormatOptions{Version: V2}).Format(strings.NewReader(in), io.Discard); err == nil {
+		t.Errorf("Format with V2 of a v1 document succeeded, want an error")
+	}
+}
+
+func TestFormatPropComments(t *testing.T) {
+	// A comment before an overridden property moves to the next
+	// property that's kept.
+	tests := []struct {
+		in, want string
+	}{
+		{"a /* x */ b=1 /* y */ b=2 c=3\n", "a /* x */ /* y */ b=2 c=3\n"},
+		{"a c=1 /* b */ b=2 /* gone */ c=3\n", "a /* b */ b=2 /* gone */ c=3\n"},
+		{"a b=1 /* x */ b=2\n", "a /* x */ b=2\n"},
+	}
+	for _, test := range tests {
+		got, err := FormatBytes([]byte(test.in))
+		if err != nil {
+			t.Fatalf("FormatBytes(%q) failed: %v", test.in, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("FormatBytes(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/danderson/go-kdl
 
-go 1.16
+go 1.23
 
-require github.com/google/go-cmp v0.5.6 // indirect
+require github.com/google/go-cmp v0.5.6
@@ -0,0 +1,267 @@
+package kdl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ToJSON converts doc to JSON, using the JSON-in-KDL (JiK)
+// conventions. doc must have exactly one top-level node, whose name
+// is ignored. Each node is converted to a JSON value as follows:
+//
+//   - A node annotated (array) is an array of its arguments followed
+//     by its children, and a node annotated (object) is an object
+//     with a member for each property and child, keyed by its name.
+//   - A node with a single argument and nothing else is that
+//     argument's value.
+//   - A node with several arguments, or with arguments and children
+//     that are all named "-", is an array.
+//   - A node with properties, or with children not all named "-", is
+//     an object.
+//
+// Nodes that mix arguments with properties or named children,
+// unannotated empty nodes, and floats that are infinite or NaN have
+// no JSON equivalent and are reported as errors. Other type
+// annotations and comments are dropped.
+func ToJSON(doc *Document) ([]byte, error) {
+	if len(doc.Nodes) != 1 {
+		return nil, fmt.Errorf("JSON-in-KDL document must have exactly one top-level node, got %d", len(doc.Nodes))
+	}
+	var b bytes.Buffer
+	if err := writeJSON(&b, doc.Nodes[0]); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// FromJSON converts a JSON document to KDL, using the JSON-in-KDL
+// conventions described in ToJSON. The result has a single top-level
+// node named "-".
+//
+// Arrays of two or more literals become a node's arguments, and
+// other arrays children named "-". Objects become children named
+// after their keys, so that their order is preserved. Empty arrays
+// and objects, and objects whose keys are all "-", are annotated
+// (array) or (object) to tell them apart. Converting the result back
+// with ToJSON produces equivalent JSON.
+func FromJSON(data []byte) (*Document, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	n, err := nodeFromJSON(d, "-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after top-level JSON value")
+	}
+	return &Document{Nodes: []*Node{n}}, nil
+}
+
+// isJSONArray reports whether n's children are all named "-", so
+// that n converts to a JSON array.
+func isJSONArray(n *Node) bool {
+	for _, c := range n.Children {
+		if c.Name != "-" {
+			return false
+		}
+	}
+	return len(n.Props) == 0
+}
+
+func writeJSON(b *bytes.Buffer, n *Node) error {
+	switch {
+	case n.TypeAnnotation == "array":
+		if len(n.Props) > 0 {
+			return fmt.Errorf("(array) node %q has properties", n.Name)
+		}
+		return writeJSONArray(b, n)
+	case n.TypeAnnotation == "object":
+		if len(n.Args) > 0 {
+			return fmt.Errorf("(object) node %q has arguments", n.Name)
+		}
+		return writeJSONObject(b, n)
+	case len(n.Args) == 0 && len(n.Props) == 0 && len(n.Children) == 0:
+		return fmt.Errorf("node %q is empty, which is ambiguous in JSON-in-KDL without an (array) or (object) annotation", n.Name)
+	case len(n.Args) == 1 && len(n.Props) == 0 && len(n.Children) == 0:
+		return writeJSONValue(b, n.Args[0])
+	case isJSONArray(n):
+		return writeJSONArray(b, n)
+	case len(n.Args) > 0:
+		return fmt.Errorf("node %q has both arguments and properties or named children, which JSON-in-KDL can't represent", n.Name)
+	default:
+		return writeJSONObject(b, n)
+	}
+}
+
+func writeJSONArray(b *bytes.Buffer, n *Node) error {
+	b.WriteByte('[')
+	for i, v := range n.Args {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if err := writeJSONValue(b, v); err != nil {
+			return err
+		}
+	}
+	for i, c := range n.Children {
+		if i > 0 || len(n.Args) > 0 {
+			b.WriteByte(',')
+		}
+		if err := writeJSON(b, c); err != nil {
+			return err
+		}
+	}
+	b.WriteByte(']')
+	return nil
+}
+
+func writeJSONObject(b *bytes.Buffer, n *Node) error {
+	b.WriteByte('{')
+	props := uniqueProps(append([]Prop(nil), n.Props...))
+	for i, p := range props {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeJSONString(b, p.Key)
+		b.WriteByte(':')
+		if err := writeJSONValue(b, p.Value); err != nil {
+			return err
+		}
+	}
+	for i, c := range n.Children {
+		if i > 0 || len(props) > 0 {
+			b.WriteByte(',')
+		}
+		writeJSONString(b, c.Name)
+		b.WriteByte(':')
+		if err := writeJSON(b, c); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+func writeJSONValue(b *bytes.Buffer, v Value) error {
+	switch v.kind {
+	case KindNull:
+		b.WriteString("null")
+	case KindString:
+		writeJSONString(b, v.str)
+	case KindBool:
+		b.WriteString(strconv.FormatBool(v.b))
+	case KindInt:
+		if v.bi != nil {
+			b.WriteString(v.bi.String())
+		} else {
+			b.WriteString(strconv.FormatInt(v.i, 10))
+		}
+	case KindFloat:
+		switch {
+		case v.bf != nil:
+			b.WriteString(withFraction(v.bf.Text('g', -1)))
+		case math.IsInf(v.f, 0) || math.IsNaN(v.f):
+			return fmt.Errorf("float %v has no JSON equivalent", v.f)
+		default:
+			b.WriteString(withFraction(strconv.FormatFloat(v.f, 'g', -1, 64)))
+		}
+	}
+	return nil
+}
+
+func writeJSONString(b *bytes.Buffer, s string) {
+	e := json.NewEncoder(b)
+	e.SetEscapeHTML(false)
+	e.Encode(s)             // can't fail for a string
+	b.Truncate(b.Len() - 1) // Encode adds a newline
+}
+
+// nodeFromJSON reads the next JSON value from d and converts it into
+// a node called name.
+func nodeFromJSON(d *json.Decoder, name string) (*Node, error) {
+	tok, err := d.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := &Node{Name: name}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			for d.More() {
+				c, err := nodeFromJSON(d, "-")
+				if err != nil {
+					return nil, err
+				}
+				n.Children = append(n.Children, c)
+			}
+			if len(n.Children) == 0 {
+				n.TypeAnnotation = "array"
+			}
+			// Arrays of literals are more readable as arguments, as
+			// long as there are enough of them to tell them apart
+			// from a single literal.
+			if len(n.Children) >= 2 && allLiterals(n.Children) {
+				for _, c := range n.Children {
+					n.Args = append(n.Args, c.Args[0])
+				}
+				n.Children = nil
+			}
+		} else {
+			for d.More() {
+				key, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				c, err := nodeFromJSON(d, key.(string))
+				if err != nil {
+					return nil, err
+				}
+				n.Children = append(n.Children, c)
+			}
+			if isJSONArray(n) {
+				// Empty, or would look like an array.
+				n.TypeAnnotation = "object"
+			}
+		}
+		if _, err := d.Token(); err != nil { // closing delimiter
+			return nil, err
+		}
+	case string:
+		n.Args = []Value{StringValue(t)}
+	case bool:
+		n.Args = []Value{BoolValue(t)}
+	case nil:
+		n.Args = []Value{NullValue()}
+	case json.Number:
+		var v Value
+		if strings.ContainsAny(t.String(), ".eE") {
+			v, err = parseFloat(t.String())
+		} else {
+			v, err = parseInt(t.String())
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.Args = []Value{v}
+	}
+	return n, nil
+}
+
+// allLiterals reports whether nodes all convert to JSON literals.
+func allLiterals(nodes []*Node) bool {
+	for _, n := range nodes {
+		if len(n.Args) != 1 || len(n.Props) != 0 || len(n.Children) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package kdl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: `- "str"`, want: `"str"`},
+		{in: `- 1`, want: `1`},
+		{in: `- 1.0`, want: `1.0`},
+		{in: `- -2.5e10`, want: `-2.5e+10`},
+		{in: `- true`, want: `true`},
+		{in: `- null`, want: `null`},
+		{in: `- 123456789012345678901234567890`, want: `123456789012345678901234567890`},
+		{in: `- "<a&b>\n"`, want: `"<a&b>\n"`},
+		{in: `- 1 2 3`, want: `[1,2,3]`},
+		{in: "- { - 1; }", want: `[1]`},
+		{in: "- 1 { - 2; - a=1; }", want: `[1,2,{"a":1}]`},
+		{in: `- a=1 b="x"`, want: `{"a":1,"b":"x"}`},
+		{in: `- a=1 b=2 a=3`, want: `{"b":2,"a":3}`},
+		{in: "- a=1 { b 2; c { - 1; - 2; }; }", want: `{"a":1,"b":2,"c":[1,2]}`},
+		{in: "ignored { - true; }", want: `[true]`},
+		{in: "(array)-", want: `[]`},
+		{in: "(object)-", want: `{}`},
+		{in: "(array)- 1", want: `[1]`},
+		{in: "(object)- { - 1; }", want: `{"-":1}`},
+		{in: "- { (array)a; (object)b; }", want: `{"a":[],"b":{}}`},
+		{in: "(other)- 1", want: `1`},
+		{in: "(array)- a=1", wantErr: "(array) node \"-\" has properties"},
+		{in: "(object)- 1", wantErr: "(object) node \"-\" has arguments"},
+
+		{in: "", wantErr: "exactly one top-level node, got 0"},
+		{in: "a 1; b 2", wantErr: "exactly one top-level node, got 2"},
+		{in: "-", wantErr: `node "-" is empty, which is ambiguous`},
+		{in: "- 1 a=2", wantErr: "both arguments and properties"},
+		{in: "- 1 { a 2; }", wantErr: "both arguments and properties or named children"},
+		{in: "- #inf", wantErr: "no JSON equivalent"},
+		{in: "- #nan", wantErr: "no JSON equivalent"},
+	}
+
+	for _, test := range tests {
+		doc, err := ParseString(test.in)
+		if err != nil {
+			t.Fatalf("ParseString(%q) failed: %v", test.in, err)
+		}
+		got, err := ToJSON(doc)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ToJSON(%q) = %s, %v, want error containing %q", test.in, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ToJSON(%q) failed: %v", test.in, err)
+		} else if string(got) != test.want {
+			t.Errorf("ToJSON(%q) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string // KDL
+		wantErr string
+	}{
+		{in: `"str"`, want: `- "str"`},
+		{in: `-1`, want: `- -1`},
+		{in: `1.5`, want: `- 1.5`},
+		{in: `1e400`, want: `- 1.0e+400`},
+		{in: `18446744073709551616`, want: `- 18446744073709551616`},
+		{in: `null`, want: `- #null`},
+		{in: `[1, "two", false]`, want: `- 1 "two" #false`},
+		{in: `[1]`, want: "- {\n    - 1\n}"},
+		{in: `[[1, 2], {"a": null}]`, want: "- {\n    - 1 2\n    - {\n        a #null\n    }\n}"},
+		{in: `{"b": 1, "a": [true, true], "-": 2}`, want: "- {\n    b 1\n    a #true #true\n    - 2\n}"},
+		{in: `{"key with spaces": "<&>"}`, want: "- {\n    \"key with spaces\" \"<&>\"\n}"},
+
+		{in: `[]`, want: `(array)-`},
+		{in: `{}`, want: `(object)-`},
+		{in: `{"a": {}, "b": []}`, want: "- {\n    (object)a\n    (array)b\n}"},
+		{in: `{"-": 1}`, want: "(object)- {\n    - 1\n}"},
+		{in: `[1,`, wantErr: "unexpected end of JSON input"},
+		{in: `1 2`, wantErr: "unexpected data after"},
+		{in: ``, wantErr: "unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		doc, err := FromJSON([]byte(test.in))
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("FromJSON(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FromJSON(%q) failed: %v", test.in, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := NewEncoder(&b).Encode(doc); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if diff := cmp.Diff(b.String(), test.want+"\n"); diff != "" {
+			t.Errorf("FromJSON(%q) wrong KDL (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	const in = `{"name":"example","version":1.0,"big":123456789012345678901234567890,"tags":["a","b","c"],"single":["x"],"nested":{"deep":[{"k":null},[1,2],true]},"-":false,"empty":[],"none":{},"dashes":{"-":[1]},"esc":"tab\tquote\"<>"}`
+	doc, err := FromJSON([]byte(in))
+	if err != nil {
+		t.Fatalf("FromJSON failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	doc, err = ParseBytes(b.Bytes())
+	if err != nil {
+		t.Fatalf("reparsing KDL failed: %v\n%s", err, b.String())
+	}
+	got, err := ToJSON(doc)
+	if err != nil {
+		t.Fatalf("ToJSON failed: %v", err)
+	}
+	if string(got) != in {
+		t.Errorf("JSON didn't round trip:\ngot:  %s\nwant: %s", got, in)
+	}
+}
@@ -2,34 +2,41 @@ package kdl
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// The newline and whitespace characters of the KDL spec. Form feed
+// and vertical tab are newlines, and \r\n counts as a single newline.
 const (
-	newlineChars = "\x0D\x0A\x85\x0C\u2028\u2029"
-	spaceChars   = "\t \xA0\u1680\u2000\u2001\u2002\u2003\u2004\u2005\u2006\u2007\u2008\u2009\u200A\u202F\u205F\u3000"
+	bom          = '\uFEFF'
+	newlineChars = "\x0D\x0A\u0085\x0B\x0C\u2028\u2029"
+	spaceChars   = "\t \u00A0\u1680\u2000\u2001\u2002\u2003\u2004\u2005\u2006\u2007\u2008\u2009\u200A\u202F\u205F\u3000"
 )
 
-func identifierCharacter(r rune) bool {
+// identifierCharacter reports whether r can appear in a bare
+// identifier under version v. V2 allows < > and , but not #, and
+// other versions the reverse.
+func identifierCharacter(r rune, v Version) bool {
 	if r < 0x20 || r > 0x10FFFF {
 		return false
 	}
 
-	if space(r) || newline(r) {
+	if space(r) || newline(r) || r == bom {
 		return false
 	}
 
-	const excluded = `\/<>{};=,"`
-	for _, e := range excluded {
-		if r == e {
-			return false
-		}
+	excluded := `\/<>{}()[];=,"`
+	if v == V2 {
+		excluded = `\/{}()[];="#`
 	}
-
-	return true
+	return !strings.ContainsRune(excluded, r)
 }
 
 func digit(r rune) bool {
@@ -40,8 +47,41 @@ func numberStart(r rune) bool {
 	return digit(r) || r == '+' || r == '-'
 }
 
-func identifierStart(r rune) bool {
-	return identifierCharacter(r) && !digit(r)
+func identifierStart(r rune, v Version) bool {
+	return identifierCharacter(r, v) && !digit(r)
+}
+
+// IsValidIdentifier reports whether s can be written as a bare,
+// unquoted KDL identifier under both V1 and V2. Strings that are
+// empty, contain characters not allowed in identifiers by either
+// version, or would lex as something else, such as a number, keyword
+// or raw string, must be quoted.
+func IsValidIdentifier(s string) bool {
+	if s == "" || v2BareKeyword(s) {
+		return false
+	}
+	if strings.HasPrefix(s, "r#") {
+		return false // raw string
+	}
+	t := s
+	if t[0] == '+' || t[0] == '-' {
+		t = t[1:]
+	}
+	if len(t) > 1 && t[0] == '.' && digit(rune(t[1])) {
+		return false // looks like a number, which KDL v2 doesn't allow
+	}
+	for i, r := range s {
+		if !identifierCharacter(r, V1) || !identifierCharacter(r, V2) {
+			return false
+		}
+		switch {
+		case i == 0 && digit(r):
+			return false
+		case i == 1 && numberStart(rune(s[0])) && digit(r):
+			return false // a signed number
+		}
+	}
+	return true
 }
 
 func newline(r rune) bool {
@@ -52,135 +92,657 @@ func space(r rune) bool {
 	return strings.IndexRune(spaceChars, r) >= 0
 }
 
-//go:generate stringer -type=tokenType -trimprefix=tok
+//go:generate stringer -type=TokenType -trimprefix=Token
 
-type tokenType int
+// TokenType is the kind of a lexical token.
+type TokenType int
 
 const (
-	tokEOF tokenType = iota
-	tokErr
-	tokInt
-	tokFloat
-	tokNewline
-	tokIgnoreNode
-	tokSpace
-	tokIdentifier
-	tokString
-	tokEqual
-	tokOpenBracket
-	tokCloseBracket
-	tokSemicolon
+	TokenEOF          TokenType = iota // end of the document
+	TokenErr                           // lexing error, in Token.Err
+	TokenInt                           // integer literal, such as -1_000 or 0xff
+	TokenFloat                         // float literal, or #inf, #-inf or #nan
+	TokenNewline                       // a newline, or a // comment ending one
+	TokenIgnoreNode                    // slashdash, /-
+	TokenSpace                         // whitespace, block comments and line continuations
+	TokenIdentifier                    // bare identifier
+	TokenString                        // quoted, raw or multi-line string, decoded
+	TokenEqual                         // =
+	TokenOpenBracket                   // {
+	TokenCloseBracket                  // }
+	TokenSemicolon                     // ;
+	TokenBool                          // true or false, with or without #
+	TokenNull                          // null or #null
+	TokenOpenParen                     // (
+	TokenCloseParen                    // )
+	TokenComment                       // comment, if LexerOptions.Comments is set
 )
 
-type token struct {
-	typ tokenType
-	err error  // for tokErr
-	str string // for tokIdentifier, tokString, tokInt, tokFloat
+//go:generate stringer -type=SyntaxCategory -trimprefix=Syntax
+
+// SyntaxCategory classifies a SyntaxError.
+type SyntaxCategory int
+
+const (
+	SyntaxOther               SyntaxCategory = iota // none of the below
+	SyntaxUnexpectedRune                            // a rune that can't start or continue a token
+	SyntaxBadNumber                                 // malformed number
+	SyntaxBadKeyword                                // unknown #keyword
+	SyntaxBadComment                                // unknown or disallowed kind of comment
+	SyntaxUnterminatedComment                       // /* comment without its */
+	SyntaxUnterminatedString                        // string without its closing quote
+	SyntaxBadMultilineString                        // malformed multi-line string
+	SyntaxBadEscape                                 // unknown or malformed escape sequence
+	SyntaxBadNewline                                // newline that LexerOptions.Newlines disallows
+	SyntaxBadLineContinuation                       // backslash not followed by a newline
+	SyntaxBadUTF8                                   // input isn't valid UTF-8
+	SyntaxReadError                                 // reading the input failed
+	SyntaxWrongVersion                              // syntax from a KDL version other than LexerOptions.Version
+	SyntaxInternal                                  // a bug in the lexer, rather than a problem with the input
+)
+
+// A SyntaxError describes why lexing failed. Parse and the lexer
+// return it wrapped in other errors, use errors.As to get at it.
+type SyntaxError struct {
+	Pos      Pos // where lexing stopped
+	Category SyntaxCategory
+	// Rune is the last rune read, or -1 if lexing stopped at the end
+	// of the input.
+	Rune rune
+	// Text is the text of the token being lexed, as read so far.
+	Text string
+	Err  error // what went wrong
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether e matches target, one of the sentinel errors
+// below, according to its Category.
+func (e *SyntaxError) Is(target error) bool {
+	switch target {
+	case ErrUnexpectedEOF:
+		switch e.Category {
+		case SyntaxUnterminatedComment, SyntaxUnterminatedString:
+			return true
+		case SyntaxBadEscape, SyntaxBadMultilineString, SyntaxBadLineContinuation:
+			return e.Rune == eof
+		}
+	case ErrInvalidEscape:
+		return e.Category == SyntaxBadEscape
+	case ErrInvalidNumber:
+		return e.Category == SyntaxBadNumber
+	}
+	return false
+}
+
+// Sentinel errors for common kinds of syntax error, for use with
+// errors.Is. Errors returned by Parse and the lexer match them without
+// their messages changing, and an error can match more than one.
+var (
+	// ErrUnexpectedEOF means that the input ended in the middle of
+	// something, such as a string, comment or children block, and
+	// might parse with more of it.
+	ErrUnexpectedEOF = errors.New("unexpected EOF")
+	// ErrInvalidEscape means that a string has an unknown or
+	// malformed escape sequence.
+	ErrInvalidEscape = errors.New("invalid escape sequence")
+	// ErrInvalidNumber means that a number is malformed.
+	ErrInvalidNumber = errors.New("invalid number")
+)
+
+// Pos is a position in a KDL document.
+type Pos struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // column number in runes, starting at 1
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// A Token is a lexical token of a KDL document.
+type Token struct {
+	Pos      // start of the token, or where lexing stopped for TokenErr
+	End  Pos // just past the end of the token
+	Type TokenType
+	// Value is the token's text, for the types whose text varies.
+	// Strings are decoded, literals are verbatim, and comments
+	// include their delimiters.
+	Value string // for TokenIdentifier, TokenString, TokenInt, TokenFloat, TokenBool, TokenComment
+	Err   error  // for TokenErr
+	// Raw is the token's source text, including any quotes and
+	// escapes, if lexing with LexerOptions.RawText.
+	Raw string
+	// Diagnostics are the invalid escape sequences in a TokenString,
+	// which LexerOptions.LenientEscapes kept rather than failing on.
+	Diagnostics []*SyntaxError
+	// block is set for TokenComment if it's a /* */ comment rather
+	// than a // comment.
+	block bool
+	// raw is set for TokenString if it's a raw string, and hashes is
+	// the number of # around it.
+	raw    bool
+	hashes int
+	// panicked is set for TokenErr if reading the input panicked, and
+	// is what it panicked with, for Next to panic with in turn.
+	panicked interface{}
 }
 
-func (t token) String() string {
-	switch t.typ {
-	case tokErr:
-		return fmt.Sprintf("%s (%s)", t.typ, t.err)
-	case tokIdentifier, tokString, tokInt, tokFloat:
-		return fmt.Sprintf("%s (%q)", t.typ, t.str)
+func (t Token) String() string {
+	switch t.Type {
+	case TokenErr:
+		return fmt.Sprintf("%s (%s)", t.Type, t.Err)
+	case TokenIdentifier, TokenString, TokenInt, TokenFloat, TokenBool, TokenComment:
+		return fmt.Sprintf("%s (%q)", t.Type, t.Value)
 	default:
-		return t.typ.String()
+		return t.Type.String()
 	}
 }
 
 type lexer struct {
-	tokens chan token
+	opts   LexerOptions
+	tokens chan Token
 	close  chan struct{} // closed by Close
 
-	r  *bufio.Reader
-	rs []rune
-	// TODO: will we ever need to peek >1 rune? If not, can save some
-	// array nonsense here.
-	peekrs       []rune // if non-zero, un-next()-ed runes in reverse order (last first)
-	atEOF        bool   // flips once to true when lexer finds EOF
-	lastWasSpace bool   // last emitted token was a tokSpace
+	// If stepped, the lexer waits on step after emitting each token,
+	// and Next sends on it before reading any but the first token.
+	stepped bool
+	step    chan struct{}
+	read    bool // Next has returned a token, only used by Next
+
+	r            io.RuneReader
+	br           *bufio.Reader // buffers r if it isn't an io.RuneReader, kept for reuse by Reset
+	rs           []rune
+	peekrs       []rune         // if non-zero, un-next()-ed runes in reverse order (last first)
+	peeked       []rune         // reused by peekN for its result
+	cur          cursor         // position of the next rune to be read
+	start        Pos            // position of the first rune in rs
+	hist         []cursor       // cursor before each rune consumed since start, for backup
+	raw          []rune         // runes consumed since start, before decoding escapes, if LexerOptions.RawText
+	atEOF        bool           // flips once to true when lexer finds EOF
+	nextEOF      bool           // the last next returned eof, so backup has nothing to undo
+	readErr      *SyntaxError   // if non-nil, why atEOF flipped before the real EOF
+	lastWasSpace bool           // last emitted token was a TokenSpace
+	diags        []*SyntaxError // for the next token, see Token.Diagnostics
+
+	// buf is reused by text to encode short texts, and texts caches
+	// the ones it has allocated, by hash, so that repeated
+	// identifiers, numbers and strings share one string. texts is
+	// only allocated once ntexts texts have been made, so that small
+	// documents don't pay for it.
+	buf    [maxTextLen * utf8.UTFMax]byte
+	texts  *[256]string
+	ntexts int
 }
 
-func NewLexer(r io.Reader) *lexer {
-	var br *bufio.Reader
-	if sr, ok := r.(*bufio.Reader); ok {
-		br = sr
-	} else {
-		br = bufio.NewReader(r)
+// byteRuneReader reads runes from r one byte at a time, so that it
+// never reads past the rune it returns.
+type byteRuneReader struct {
+	r   io.Reader
+	buf [utf8.UTFMax]byte
+}
+
+func (b *byteRuneReader) ReadRune() (rune, int, error) {
+	n := 0
+	for {
+		if _, err := io.ReadFull(b.r, b.buf[n:n+1]); err == io.EOF && n > 0 {
+			// Truncated rune, which is invalid UTF-8.
+			return utf8.RuneError, 1, nil
+		} else if err != nil {
+			return 0, 0, err
+		}
+		n++
+		if utf8.FullRune(b.buf[:n]) {
+			r, size := utf8.DecodeRune(b.buf[:n])
+			return r, size, nil
+		}
+	}
+}
+
+// cursor is a Pos, plus enough state to advance it correctly.
+type cursor struct {
+	Pos
+	afterCR bool // last consumed rune was \r, a following \n doesn't start a new line
+}
+
+func (c *cursor) advance(r rune) {
+	n := utf8.RuneLen(r)
+	if n < 0 {
+		n = 1
+	}
+	c.Offset += n
+	switch {
+	case r == '\n' && c.afterCR:
+		// Second half of a \r\n, the line already advanced.
+	case newline(r):
+		c.Line++
+		c.Column = 1
+	case r == bom:
+		// Zero width, doesn't occupy a column.
+	default:
+		c.Column++
 	}
+	c.afterCR = r == '\r'
+}
+
+// LexerOptions configures the behavior of the lexer.
+type LexerOptions struct {
+	// Comments makes the lexer emit a TokenComment for each comment,
+	// rather than discarding them.
+	Comments bool
+	// DisallowBlockComments makes /* */ comments an error, for
+	// dialects that only allow // comments.
+	DisallowBlockComments bool
+	// Newlines restricts which newlines may end a line. By default,
+	// any of KDL's newline characters can, and \r\n counts as one.
+	// It applies to newlines between tokens, at the end of // comments
+	// and line continuations, and in multi-line strings.
+	Newlines Newlines
+	// Version is the version of the KDL spec to follow. V1 and V2
+	// each reject the other's syntax: V1 rejects multi-line strings
+	// and escaped whitespace with a SyntaxWrongVersion error, and
+	// lexes a leading # as part of an identifier, as KDL v1 does, so
+	// #keywords and #"raw strings"# don't parse. V2 rejects r"raw
+	// strings" and the bare words true, false, null, inf, -inf and nan
+	// with a SyntaxWrongVersion error. Zero follows V2, but also
+	// accepts V1's bare true, false and null and r"raw strings", which
+	// is enough to read most documents written for either. Bare
+	// identifiers follow V1's rules unless Version is V2, which allows
+	// < > and , in them, but not #. Zero allows # too, except as the
+	// first character, where it starts a keyword or raw string.
+	Version Version
+	// LenientEscapes keeps an invalid escape sequence in a string as
+	// written, such as \q, and reports it in the token's Diagnostics,
+	// rather than failing. ParseAll includes them in its errors.
+	LenientEscapes bool
+	// ExtraSpaces are runes to treat as whitespace between tokens, in
+	// addition to KDL's own, such as "," for a dialect that separates
+	// arguments with commas. They are still literal inside strings.
+	// Letters, digits, newlines, control characters and runes that
+	// mean something else in KDL, such as = or #, can't be spaces; the
+	// lexer fails on its first token if ExtraSpaces has any.
+	ExtraSpaces string
+	// RawText makes the lexer set each token's Raw to its source
+	// text, from Pos to End, for tools such as highlighters that need
+	// the input as written. It doesn't change which tokens are
+	// emitted or where they are: block comments that aren't kept are
+	// part of the TokenSpace around them, but // comments that aren't
+	// kept, and whitespace after a kept block comment, are in no
+	// token's raw text.
+	RawText bool
+}
+
+// Version is a version of the KDL spec.
+type Version int
+
+const (
+	V1 Version = 1 // KDL 1.0.0
+	V2 Version = 2 // KDL 2.0.0
+)
+
+// Newlines is a newline convention that LexerOptions can enforce.
+type Newlines int
+
+const (
+	AnyNewlines  Newlines = iota // any of KDL's newline characters
+	LFNewlines                   // only \n
+	CRLFNewlines                 // only \r\n
+)
+
+func NewLexer(r io.Reader) *lexer {
+	return LexerOptions{}.NewLexer(r)
+}
+
+// NewLexer is like the top-level NewLexer, using the options in o.
+func (o LexerOptions) NewLexer(r io.Reader) *lexer {
+	return o.newLexer(r, false)
+}
+
+// NewLexerBytes returns a lexer that reads from bs. It behaves like
+// NewLexer, but decodes runes straight from bs without buffering.
+func NewLexerBytes(bs []byte) *lexer {
+	return LexerOptions{}.NewLexerBytes(bs)
+}
+
+// NewLexerBytes is like the top-level NewLexerBytes, using the
+// options in o.
+func (o LexerOptions) NewLexerBytes(bs []byte) *lexer {
+	return o.newLexer(bytes.NewReader(bs), false)
+}
+
+// newLexer returns a lexer for r. A stepped lexer doesn't lex a token
+// until the previous one has been read, and doesn't buffer r, so
+// that it never reads further into r than the caller has asked for.
+func (o LexerOptions) newLexer(r io.Reader, stepped bool) *lexer {
 	ret := &lexer{
-		tokens: make(chan token),
-		close:  make(chan struct{}),
-		r:      br,
-		rs:     make([]rune, 0, 1024),
+		opts:    o,
+		stepped: stepped,
+		rs:      make([]rune, 0, 64),
+		hist:    make([]cursor, 0, 64),
 	}
-	go ret.lex()
+	ret.restart(r)
 	return ret
 }
 
-func (l *lexer) Next() token {
+// Reset stops the lexer, discarding any tokens not yet read, and
+// starts it again on r with the same options. It reuses the lexer's
+// buffers, which saves allocations when lexing many documents.
+//
+// Reset waits for the lexer's goroutine to stop, so it blocks if
+// that goroutine is blocked reading the previous input.
+func (l *lexer) Reset(r io.Reader) {
+	l.Close()
+	for range l.tokens {
+		// Drain until the goroutine exits and closes the channel.
+	}
+	l.restart(r)
+}
+
+// restart resets l's state to lex r from the start, keeping its
+// options and buffers, and starts its goroutine. r is read directly
+// if it's an io.RuneReader, or through l.br otherwise.
+func (l *lexer) restart(r io.Reader) {
+	rr, ok := r.(io.RuneReader)
+	br := l.br
+	var step chan struct{}
+	if l.stepped {
+		step = make(chan struct{}, 1)
+		if !ok {
+			rr, ok = &byteRuneReader{r: r}, true
+		}
+	}
+	if !ok {
+		if br == nil {
+			br = bufio.NewReader(r)
+		} else {
+			br.Reset(r)
+		}
+		rr = br
+	}
+	*l = lexer{
+		opts:    l.opts,
+		stepped: l.stepped,
+		step:    step,
+		tokens:  make(chan Token),
+		close:   make(chan struct{}),
+		r:       rr,
+		br:      br,
+		rs:      l.rs[:0],
+		peekrs:  l.peekrs[:0],
+		peeked:  l.peeked[:0],
+		hist:    l.hist[:0],
+		raw:     l.raw[:0],
+		texts:   l.texts,
+		cur:     cursor{Pos: Pos{Line: 1, Column: 1}},
+		start:   Pos{Line: 1, Column: 1},
+	}
+	go l.lex()
+}
+
+func (l *lexer) Next() Token {
+	if l.step != nil && l.read {
+		// Let the lexer go on to the token after the last one read.
+		// It may already have stopped, so don't wait for it.
+		select {
+		case l.step <- struct{}{}:
+		default:
+		}
+	}
+	l.read = true
 	// Handily, when the channel is closed, the zero value is
-	// returned, whose typ is tokEOF. So, we EOF for ever once
+	// returned, whose Type is TokenEOF. So, we EOF for ever once
 	// closed.
-	return <-l.tokens
+	tok := <-l.tokens
+	if tok.panicked != nil {
+		panic(tok.panicked)
+	}
+	return tok
+}
+
+// Close stops the lexer goroutine. It must be called if the caller
+// stops reading tokens before EOF.
+func (l *lexer) Close() {
+	select {
+	case <-l.close:
+	default:
+		close(l.close)
+	}
+}
+
+// All returns an iterator over the remaining tokens, up to and
+// including the first TokenEOF or TokenErr. Stopping the iteration early
+// closes the lexer.
+func (l *lexer) All() iter.Seq[Token] {
+	return func(yield func(Token) bool) {
+		for {
+			tok := l.Next()
+			if !yield(tok) {
+				l.Close()
+				return
+			}
+			if tok.Type == TokenEOF || tok.Type == TokenErr {
+				return
+			}
+		}
+	}
+}
+
+// Tokenize lexes all of r, returning its tokens up to and including
+// the final TokenEOF, which carries the position of the end of the
+// input. If lexing fails, it returns the tokens before the error,
+// and a *ParseError describing it.
+func Tokenize(r io.Reader) ([]Token, error) {
+	return LexerOptions{}.Tokenize(r)
+}
+
+// Tokenize is like the top-level Tokenize, using the options in o.
+func (o LexerOptions) Tokenize(r io.Reader) ([]Token, error) {
+	var ret []Token
+	for tok := range o.NewLexer(r).All() {
+		if tok.Type == TokenErr {
+			return ret, &ParseError{Pos: tok.Pos, Err: tok.Err, tok: tok}
+		}
+		ret = append(ret, tok)
+	}
+	return ret, nil
 }
 
 var lexClosed = errors.New("lexer closed")
 
-func (l *lexer) emit(t token) {
-	if t.typ == tokSpace && l.lastWasSpace {
+func (l *lexer) emit(t Token) {
+	if t.Type == TokenSpace && l.lastWasSpace {
 		l.ignore()
 		return
 	}
-	l.lastWasSpace = t.typ == tokSpace
+	// A block comment separates tokens like whitespace does, so the
+	// whitespace around one is a single separator.
+	l.lastWasSpace = t.Type == TokenSpace || (t.Type == TokenComment && t.block)
+	t.Pos = l.start
+	t.End = l.cur.Pos
+	if l.opts.RawText {
+		t.Raw = l.text(l.raw)
+	}
+	t.Diagnostics, l.diags = l.diags, nil
 	select {
 	case l.tokens <- t:
-		l.rs = l.rs[:0]
+		l.ignore()
 	case <-l.close:
 		// Will get recovered at the top level of lex()
 		panic(lexClosed)
 	}
+	if l.step != nil {
+		select {
+		case <-l.step:
+		case <-l.close:
+			panic(lexClosed)
+		}
+	}
 }
 
-func (l *lexer) err(format string, args ...interface{}) lexFn {
+func (l *lexer) err(cat SyntaxCategory, format string, args ...interface{}) lexFn {
+	r := l.last()
+	switch {
+	case len(l.peekrs) > 0:
+		r = l.peekrs[len(l.peekrs)-1]
+	case l.atEOF:
+		r = eof
+	}
+	return l.fail(&SyntaxError{
+		Pos:      l.cur.Pos,
+		Category: cat,
+		Rune:     r,
+		Text:     string(l.rs),
+		Err:      fmt.Errorf(format, args...),
+	})
+}
+
+// fail emits err as a TokenErr, ending lexing.
+func (l *lexer) fail(err *SyntaxError) lexFn {
 	l.lastWasSpace = false
+	if l.readErr != nil {
+		// Whatever went wrong was caused by the input ending early,
+		// the read error is the real problem.
+		err, l.readErr = l.readErr, nil
+	}
 	select {
-	case l.tokens <- token{typ: tokErr, err: fmt.Errorf(format, args...)}:
+	case l.tokens <- Token{Pos: l.cur.Pos, Type: TokenErr, Err: err}:
 	case <-l.close:
 		panic(lexClosed)
 	}
 	return nil // Will break out of the top-level lex loop and clean up.
 }
 
+// maxTextLen is the length in runes of the longest token text that
+// text caches, and cacheAfter the number of texts it makes before it
+// starts caching them.
+const (
+	maxTextLen = 32
+	cacheAfter = 64
+)
+
+// text returns rs as a string. Short texts that were recently seen
+// are returned without allocating.
+func (l *lexer) text(rs []rune) string {
+	if len(rs) == 0 {
+		return ""
+	}
+	if len(rs) > maxTextLen {
+		return string(rs)
+	}
+	buf := l.buf[:0]
+	for _, r := range rs {
+		buf = utf8.AppendRune(buf, r)
+	}
+	if l.texts == nil {
+		if l.ntexts++; l.ntexts < cacheAfter {
+			return string(buf)
+		}
+		l.texts = new([256]string)
+	}
+	// FNV-1a, folded to an index into texts.
+	h := uint32(2166136261)
+	for _, b := range buf {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	h = (h ^ h>>8 ^ h>>16 ^ h>>24) & 0xff
+	if s := l.texts[h]; s == string(buf) {
+		return s
+	}
+	s := string(buf)
+	l.texts[h] = s
+	return s
+}
+
 const eof = -1 // outside the valid range for unicode codepoints
 
 func (l *lexer) next() (r rune) {
 	if len(l.peekrs) > 0 {
-		l.rs = append(l.rs, l.peekrs[len(l.peekrs)-1])
+		r = l.peekrs[len(l.peekrs)-1]
 		l.peekrs = l.peekrs[:len(l.peekrs)-1]
-		return l.last()
+		l.consume(r)
+		l.nextEOF = false
+		return r
 	}
 	if l.atEOF {
+		l.nextEOF = true
 		return eof
 	}
 
-	r, _, err := l.r.ReadRune()
+	r, n, err := l.readRune()
 	if err == io.EOF {
 		l.atEOF = true
+		l.nextEOF = true
 		return eof
 	} else if err != nil {
-		// TODO: something else?
 		l.atEOF = true
+		l.readErr = &SyntaxError{
+			Pos:      l.cur.Pos,
+			Category: SyntaxReadError,
+			Rune:     eof,
+			Text:     string(l.rs),
+			Err:      fmt.Errorf("reading at offset %d: %w", l.cur.Offset, err),
+		}
+		l.nextEOF = true
+		return eof
+	} else if r == utf8.RuneError && n == 1 {
+		l.atEOF = true
+		l.readErr = &SyntaxError{
+			Pos:      l.cur.Pos,
+			Category: SyntaxBadUTF8,
+			Rune:     utf8.RuneError,
+			Text:     string(l.rs),
+			Err:      fmt.Errorf("invalid UTF-8 at offset %d", l.cur.Offset),
+		}
+		l.nextEOF = true
 		return eof
 	}
-	l.rs = append(l.rs, r)
+	l.consume(r)
+	l.nextEOF = false
 	return r
 }
 
+// readerPanic is what readRune panics with when the underlying
+// reader panics.
+type readerPanic struct {
+	v interface{}
+}
+
+// readRune reads a rune from the input, marking any panic from the
+// reader as the caller's problem rather than the lexer's.
+func (l *lexer) readRune() (rune, int, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(readerPanic{r})
+		}
+	}()
+	return l.r.ReadRune()
+}
+
+// consume adds r to the current token and advances the position
+// past it.
+func (l *lexer) consume(r rune) {
+	l.rs = append(l.rs, r)
+	l.hist = append(l.hist, l.cur)
+	if l.opts.RawText {
+		l.raw = append(l.raw, r)
+	}
+	l.cur.advance(r)
+}
+
+// backup un-reads the last rune returned by next. Runes consumed
+// before it can be backed up over in turn, even once the lexer has
+// found EOF.
 func (l *lexer) backup() {
-	if l.atEOF {
+	if l.nextEOF {
 		// "backing up" from EOF is meaningless, therefore do nothing.
+		l.nextEOF = false
 		return
 	}
 	if len(l.rs) == 0 {
@@ -188,6 +750,11 @@ func (l *lexer) backup() {
 	}
 	l.peekrs = append(l.peekrs, l.rs[len(l.rs)-1])
 	l.rs = l.rs[:len(l.rs)-1]
+	l.cur = l.hist[len(l.hist)-1]
+	l.hist = l.hist[:len(l.hist)-1]
+	if l.opts.RawText {
+		l.raw = l.raw[:len(l.raw)-1]
+	}
 }
 
 func (l *lexer) peek() rune {
@@ -196,6 +763,74 @@ func (l *lexer) peek() rune {
 	return r
 }
 
+// peekN returns the next n runes without consuming them, or fewer if
+// the input ends first. The returned slice is only valid until the
+// next call to peekN.
+func (l *lexer) peekN(n int) []rune {
+	rs := l.peeked[:0]
+	for len(rs) < n {
+		r := l.next()
+		if r == eof {
+			l.backup()
+			break
+		}
+		rs = append(rs, r)
+	}
+	for range rs {
+		l.backup()
+	}
+	l.peeked = rs
+	return rs
+}
+
+// badExtraSpace returns the first rune in o.ExtraSpaces that can't be
+// whitespace, if any.
+func (o LexerOptions) badExtraSpace() (rune, bool) {
+	for _, r := range o.ExtraSpaces {
+		if r < 0x20 || r == 0x7F || r == bom || newline(r) || unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(`\/(){};="#+-._`, r) {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// space reports whether r is whitespace between tokens, including
+// LexerOptions.ExtraSpaces.
+func (l *lexer) space(r rune) bool {
+	return space(r) || (l.opts.ExtraSpaces != "" && strings.ContainsRune(l.opts.ExtraSpaces, r))
+}
+
+// identifierCharacter reports whether r can appear in a bare
+// identifier, under the lexer's version and except for
+// LexerOptions.ExtraSpaces.
+func (l *lexer) identifierCharacter(r rune) bool {
+	return identifierCharacter(r, l.opts.Version) && !l.space(r)
+}
+
+// rawStringAhead reports whether the input continues with the rest
+// of a raw string after its leading r: any number of #, then a ".
+func (l *lexer) rawStringAhead() bool {
+	for n := 1; ; n++ {
+		rs := l.peekN(n)
+		if len(rs) < n {
+			return false
+		}
+		switch rs[n-1] {
+		case '"':
+			return true
+		case '#':
+		default:
+			return false
+		}
+	}
+}
+
+// blockCommentAhead reports whether the input continues with /*.
+func (l *lexer) blockCommentAhead() bool {
+	rs := l.peekN(2)
+	return len(rs) == 2 && rs[0] == '/' && rs[1] == '*'
+}
+
 // returns last consumed rune
 func (l *lexer) last() rune {
 	if len(l.rs) == 0 {
@@ -206,6 +841,9 @@ func (l *lexer) last() rune {
 
 func (l *lexer) ignore() {
 	l.rs = l.rs[:0]
+	l.hist = l.hist[:0]
+	l.raw = l.raw[:0]
+	l.start = l.cur.Pos
 }
 
 func (l *lexer) accept(valid string) bool {
@@ -216,21 +854,33 @@ func (l *lexer) accept(valid string) bool {
 	return false
 }
 
-func (l *lexer) acceptNewline() bool {
+// acceptNewline consumes a newline, counting \r\n as one, and
+// reports whether there was one. It returns an error if the newline
+// isn't one that LexerOptions.Newlines allows.
+func (l *lexer) acceptNewline() (bool, error) {
 	r := l.next()
+	crlf := false
 	switch {
 	case r == eof:
-		return false
+		return false, nil
 	case r == '\r':
-		if l.peek() == '\n' {
-			l.next()
-		}
-		return true
-	case newline(r):
-		return true
-	default:
-		return false
+		crlf = l.accept("\n")
+	case !newline(r):
+		l.backup()
+		return false, nil
+	}
+
+	nl := string(r)
+	if crlf {
+		nl = "\r\n"
 	}
+	switch {
+	case l.opts.Newlines == LFNewlines && nl != "\n":
+		return true, fmt.Errorf("newline %q not allowed, expected \"\\n\"", nl)
+	case l.opts.Newlines == CRLFNewlines && nl != "\r\n":
+		return true, fmt.Errorf("newline %q not allowed, expected \"\\r\\n\"", nl)
+	}
+	return true, nil
 }
 
 func (l *lexer) acceptRun(valid string) {
@@ -241,121 +891,225 @@ func (l *lexer) acceptRun(valid string) {
 
 // until consumes runes until it encounters a rune in invalid, or
 // EOF. Returns whether the read was interrupted by EOF or invalid
-// characters.
+// characters. It reads each rune once, and only backs up over the
+// one that stops it.
 func (l *lexer) until(invalid string) (notEOF bool) {
-	for strings.IndexRune(invalid, l.peek()) < 0 && l.peek() != eof {
-		l.next()
-	}
-	if l.peek() == eof {
-		return false
+	for {
+		r := l.next()
+		if r == eof {
+			return false
+		}
+		if strings.IndexRune(invalid, r) >= 0 {
+			l.backup()
+			return true
+		}
 	}
-	return true
 }
 
-type lexFn func() lexFn
+type lexFn func(*lexer) lexFn
 
 func (l *lexer) lex() {
 	defer func() {
-		close(l.tokens)
-		if r := recover(); r != nil {
-			if r != lexClosed {
-				panic(r)
+		r := recover()
+		tok := Token{Pos: l.cur.Pos, Type: TokenErr}
+		switch r := r.(type) {
+		case nil:
+		case readerPanic:
+			// Panicking here would crash the whole program from
+			// this goroutine, where the caller can't recover, so
+			// Next panics for us instead.
+			tok.Err = fmt.Errorf("reader panicked: %v", r.v)
+			tok.panicked = r.v
+		default:
+			if r == lexClosed {
+				break
+			}
+			// A bug in the lexer. Report it as an error in its own
+			// category, so that tests and fuzzing can tell it apart
+			// from bad input.
+			tok.Err = &SyntaxError{
+				Pos:      l.cur.Pos,
+				Category: SyntaxInternal,
+				Rune:     l.last(),
+				Text:     string(l.rs),
+				Err:      fmt.Errorf("internal lexer error: %v", r),
+			}
+		}
+		if tok.Err != nil {
+			select {
+			case l.tokens <- tok:
+			case <-l.close:
 			}
 		}
+		close(l.tokens)
 	}()
 
-	for st := l.lexAny; st != nil; {
-		st = st()
+	if r, ok := l.opts.badExtraSpace(); ok {
+		l.err(SyntaxOther, "LexerOptions.ExtraSpaces can't include %q", r)
+		return
+	}
+
+	// A byte order mark is allowed, and ignored, as the very first
+	// character of the document.
+	if l.peek() == bom {
+		l.next()
+		l.ignore()
+	}
+
+	for st := lexAny; st != nil; {
+		st = st(l)
+	}
+	if l.readErr != nil {
+		l.fail(l.readErr)
+		return
 	}
+	// Explicitly emit EOF, so that it carries the final position.
+	l.emit(Token{Type: TokenEOF})
 }
 
-func (l *lexer) lexAny() lexFn {
+func lexAny(l *lexer) lexFn {
 	r := l.peek()
 	switch {
 	case r == eof:
 		return nil
 	case numberStart(r):
-		return l.lexNumber
-	case identifierStart(r):
-		return l.lexIdentifier
+		return lexNumber
+	case r == '#' && l.opts.Version != V1:
+		// KDL v1 allows # anywhere in an identifier, so only later
+		// versions have #keywords and #"raw strings"#.
+		if l.rawStringAhead() {
+			return lexRawString
+		}
+		return lexKeyword
+	case l.identifierCharacter(r) && !digit(r):
+		return lexIdentifier
 	case r == '"':
-		return l.lexString
+		return lexString
 	case r == '=':
 		l.next()
-		l.emit(token{typ: tokEqual})
-		return l.lexAny
+		l.emit(Token{Type: TokenEqual})
+		return lexAny
 	case r == '{':
 		l.next()
-		l.emit(token{typ: tokOpenBracket})
-		return l.lexAny
+		l.emit(Token{Type: TokenOpenBracket})
+		return lexAny
 	case r == '}':
 		l.next()
-		l.emit(token{typ: tokCloseBracket})
-		return l.lexAny
+		l.emit(Token{Type: TokenCloseBracket})
+		return lexAny
 	case r == ';':
 		l.next()
-		l.emit(token{typ: tokSemicolon})
-		return l.lexAny
+		l.emit(Token{Type: TokenSemicolon})
+		return lexAny
+	case r == '(':
+		l.next()
+		l.emit(Token{Type: TokenOpenParen})
+		return lexAny
+	case r == ')':
+		l.next()
+		l.emit(Token{Type: TokenCloseParen})
+		return lexAny
 	case r == '/':
-		return l.lexComment
-	case space(r):
-		return l.lexSpace
+		return lexComment
+	case l.space(r), r == '\\':
+		return lexSpace
 	case newline(r):
-		return l.lexNewline
+		return lexNewline
+	case r == bom:
+		return l.err(SyntaxUnexpectedRune, "byte order mark is only allowed at the start of the document")
 	default:
-		return l.err("don't know how to lex %q", r)
+		return l.err(SyntaxUnexpectedRune, "don't know how to lex %q", r)
 	}
 }
 
-func (l *lexer) lexNumber() lexFn {
-	l.accept("+-")
-	if l.last() == '+' && !digit(l.peek()) {
+func lexNumber(l *lexer) lexFn {
+	if l.accept("+-") && !digit(l.peek()) {
 		// Woops, this is an identifier, not a number.
-		return l.lexIdentifier
+		return lexIdentifier
 	}
-	if l.accept("0") {
+	zero := l.accept("0")
+	if zero {
 		// Could be a radix prefix, with simpler parsing rules.
+		digits := ""
 		switch l.next() {
 		case eof:
-			l.emit(token{typ: tokInt, str: string(l.rs)})
+			l.emit(Token{Type: TokenInt, Value: l.text(l.rs)})
 			return nil
 		case 'x':
-			l.acceptRun("0123456789abcdefABCDEF_")
-			l.emit(token{typ: tokInt, str: string(l.rs)})
-			return l.lexSpace
+			digits = "0123456789abcdefABCDEF"
 		case 'b':
-			l.acceptRun("01_")
-			l.emit(token{typ: tokInt, str: string(l.rs)})
-			return l.lexSpace
+			digits = "01"
 		case 'o':
-			l.acceptRun("01234567_")
-			l.emit(token{typ: tokInt, str: string(l.rs)})
-			return l.lexSpace
+			digits = "01234567"
 		default:
 			l.backup()
 		}
+		if digits != "" {
+			if any, err := l.acceptDigits(digits, false); err != nil {
+				return l.err(SyntaxBadNumber, "%v", err)
+			} else if !any {
+				return l.err(SyntaxBadNumber, "no digits after radix prefix in %q", string(l.rs))
+			}
+			l.emit(Token{Type: TokenInt, Value: l.text(l.rs)})
+			return lexSpace
+		}
 	}
 	// Full decimal/float.
 	fl := false
-	const digits = "0123456789_"
-	l.acceptRun(digits)
+	const digits = "0123456789"
+	if _, err := l.acceptDigits(digits, zero); err != nil {
+		return l.err(SyntaxBadNumber, "%v", err)
+	}
 	if l.accept(".") {
 		fl = true
-		l.acceptRun(digits)
+		if any, err := l.acceptDigits(digits, false); err != nil {
+			return l.err(SyntaxBadNumber, "%v", err)
+		} else if !any {
+			return l.err(SyntaxBadNumber, "no digits after decimal point in %q", string(l.rs))
+		}
 	}
 	if l.accept("eE") {
+		fl = true
 		l.accept("+-")
-		l.acceptRun(digits)
+		if any, err := l.acceptDigits(digits, false); err != nil {
+			return l.err(SyntaxBadNumber, "%v", err)
+		} else if !any {
+			return l.err(SyntaxBadNumber, "no digits in exponent of %q", string(l.rs))
+		}
 	}
 	if fl {
-		l.emit(token{typ: tokFloat, str: string(l.rs)})
+		l.emit(Token{Type: TokenFloat, Value: l.text(l.rs)})
 	} else {
-		l.emit(token{typ: tokInt, str: string(l.rs)})
+		l.emit(Token{Type: TokenInt, Value: l.text(l.rs)})
 	}
-	return l.lexSpace
+	return lexSpace
 }
 
-func (l *lexer) lexComment() lexFn {
+// acceptDigits consumes a run of digits, which may contain
+// underscores anywhere except before the first digit. started
+// indicates that the run continues from a digit that was already
+// consumed. Returns whether any digits were consumed.
+func (l *lexer) acceptDigits(digits string, started bool) (any bool, err error) {
+	for {
+		r := l.next()
+		switch {
+		case r == '_':
+			if !started {
+				return false, fmt.Errorf("underscore before first digit in %q", string(l.rs))
+			}
+		case r != eof && strings.IndexRune(digits, r) >= 0:
+			started, any = true, true
+		default:
+			l.backup()
+			return any, nil
+		}
+	}
+}
+
+func lexComment(l *lexer) lexFn {
+	// lexSpace may have read whitespace before the comment, which
+	// doesn't belong in errors about it.
+	open, before := l.cur.Pos, len(l.rs)
 	if l.next() != '/' {
 		panic("how did we end up in lexComment without a slash?!")
 	}
@@ -363,15 +1117,20 @@ func (l *lexer) lexComment() lexFn {
 	r := l.next()
 	switch r {
 	case '/':
-		if !l.until(newlineChars) {
+		found := l.until(newlineChars)
+		l.comment(false)
+		if !found {
 			return nil
 		}
-		l.ignore()
-		return l.lexNewline
+		return lexNewline
 	case '*':
+		if l.opts.DisallowBlockComments {
+			return l.err(SyntaxBadComment, "block comments are not allowed")
+		}
 		for depth := 1; depth > 0; {
 			if !l.until("*/") {
-				return l.err("EOF during multiline comment")
+				l.rs = l.rs[before:]
+				return l.err(SyntaxUnterminatedComment, "unexpected EOF, unclosed /* opened at line %d col %d (nesting depth %d)", open.Line, open.Column, depth)
 			}
 			switch l.next() {
 			case '*':
@@ -388,108 +1147,256 @@ func (l *lexer) lexComment() lexFn {
 				depth++
 			}
 		}
-		l.ignore()
-		return l.lexSpace
+		if !l.opts.Comments {
+			// Part of the whitespace around it, see lexSpace.
+			return lexSpace
+		}
+		l.comment(true)
+		return lexSpace
 	case '-':
-		l.emit(token{typ: tokIgnoreNode})
-		return l.lexSpace
+		l.emit(Token{Type: TokenIgnoreNode})
+		return lexSpace
 	default:
-		return l.err("unknown kind of comment \"/%s\"", string(r))
+		return l.err(SyntaxBadComment, "unknown kind of comment \"/%s\"", string(r))
 	}
 }
 
-func (l *lexer) lexIdentifier() lexFn {
-	if l.accept("r") {
-		if r := l.peek(); r == '#' || r == '"' {
+// comment emits the comment in rs if the lexer is keeping comments,
+// and otherwise discards it.
+func (l *lexer) comment(block bool) {
+	if !l.opts.Comments {
+		l.ignore()
+		return
+	}
+	l.emit(Token{Type: TokenComment, Value: l.text(l.rs), block: block})
+}
+
+func lexIdentifier(l *lexer) lexFn {
+	switch {
+	case len(l.rs) > 0:
+		// lexNumber already accepted a leading + or -, which can be
+		// followed by any identifier character but a digit.
+	case l.accept("r"):
+		if l.rawStringAhead() {
 			// Woops, this is a raw string.
-			return l.lexRawString
+			return lexRawString
+		}
+	default:
+		if r := l.next(); !l.identifierCharacter(r) || digit(r) {
+			return l.err(SyntaxUnexpectedRune, "unexpected rune %q at start of identifier", r)
 		}
-	} else if r := l.next(); !identifierStart(r) {
-		return l.err("unexpected rune %q at start of identifier", r)
 	}
-	for identifierCharacter(l.next()) {
+	for l.identifierCharacter(l.next()) {
 	}
 	l.backup()
-	l.emit(token{typ: tokIdentifier, str: string(l.rs)})
-	return l.lexAny
+	s := l.text(l.rs)
+	if l.opts.Version == V2 && v2BareKeyword(s) {
+		return l.err(SyntaxWrongVersion, "bare %s is not allowed in KDL v2, write #%s for the keyword or %q for a string", s, s, s)
+	}
+	switch s {
+	case "true", "false":
+		l.emit(Token{Type: TokenBool, Value: s})
+	case "null":
+		l.emit(Token{Type: TokenNull})
+	default:
+		l.emit(Token{Type: TokenIdentifier, Value: s})
+	}
+	return lexAny
+}
+
+// v2BareKeyword reports whether s is one of the words that KDL v2
+// reserves for #-prefixed keywords, and so doesn't allow as a bare
+// identifier.
+func v2BareKeyword(s string) bool {
+	switch s {
+	case "true", "false", "null", "inf", "-inf", "nan":
+		return true
+	}
+	return false
 }
 
-func (l *lexer) lexString() lexFn {
+// lexKeyword lexes KDL v2's #-prefixed keywords. Under V1, a leading
+// # starts an identifier instead.
+func lexKeyword(l *lexer) lexFn {
+	l.accept("#")
+	for l.identifierCharacter(l.next()) {
+	}
+	l.backup()
+	s := string(l.rs)
+	switch s {
+	case "#true", "#false":
+		l.emit(Token{Type: TokenBool, Value: s[1:]})
+	case "#null":
+		l.emit(Token{Type: TokenNull})
+	case "#inf", "#-inf", "#nan":
+		l.emit(Token{Type: TokenFloat, Value: s})
+	default:
+		return l.err(SyntaxBadKeyword, "unknown keyword %q", s)
+	}
+	return lexAny
+}
+
+func lexString(l *lexer) lexFn {
 	l.accept(`"`)
+	if l.accept(`"`) {
+		if l.accept(`"`) {
+			if l.opts.Version == V1 {
+				return l.err(SyntaxWrongVersion, "multi-line strings are not allowed in KDL v1")
+			}
+			return lexMultilineString
+		}
+		l.emit(Token{Type: TokenString})
+		return lexAny
+	}
 	for {
 		if !l.until(`"\\`) {
-			return l.err("EOF during string")
+			return l.err(SyntaxUnterminatedString, "EOF during string")
 		}
 		switch l.next() {
 		case '"':
-			l.emit(token{typ: tokString, str: string(l.rs[1 : len(l.rs)-1])})
-			return l.lexAny
+			l.emit(Token{Type: TokenString, Value: l.text(l.rs[1 : len(l.rs)-1])})
+			return lexAny
 		case '\\':
-			replacePoint := len(l.rs) - 1 // position of the \
-			replace := rune(eof)
-			r := l.next()
-			switch r {
-			case 'n':
-				replace = '\n'
-			case 'r':
-				replace = '\r'
-			case 't':
-				replace = '\t'
-			case '\\':
-				replace = '\\'
-			case '/':
-				replace = '/'
-			case '"':
-				replace = '"'
-			case 'b':
-				replace = '\b'
-			case 'f':
-				replace = '\f'
-			case 'u':
-				if l.next() != '{' {
-					return l.err("expected open bracket after \\u, got %q", string(r))
-				}
-				replace = 0
-			parseHex:
-				for i := 0; i < 6; i++ {
-					r = l.next()
-					switch {
-					case r >= '0' && r <= '9':
-						replace = (replace << 4) + (r - '0')
-					case r >= 'a' && r <= 'f':
-						replace = (replace << 4) + (r - 'a' + 10)
-					case r >= 'A' && r <= 'F':
-						replace = (replace << 4) + (r - 'A' + 10)
-					case r == '}':
-						if i == 0 {
-							return l.err("no hex in \\u escape sequence")
-						}
-						break parseHex
-					default:
-						return l.err("unexpected hex in \\u escape sequence, got %q", string(r))
-					}
-				}
-			default:
-				return l.err("unknown escape sequence \\%s", string(r))
+			if !l.escape() {
+				return nil
 			}
-			l.rs = append(l.rs[:replacePoint], replace)
 		}
 	}
 }
 
-func (l *lexer) lexRawString() lexFn {
-	// Leading 'r' was accepted prior to entering this lex state.
+// lexMultilineString lexes a KDL v2 multi-line string, whose opening
+// """ has already been consumed. The closing """ must be on its own
+// line, and its indentation is removed from every line of content.
+func lexMultilineString(l *lexer) lexFn {
+	if ok, err := l.acceptNewline(); err != nil {
+		return l.err(SyntaxBadNewline, "%w", err)
+	} else if !ok {
+		return l.err(SyntaxBadMultilineString, `expected newline after opening """ of multi-line string`)
+	}
+
+	// Each line is a span of rs, plus the number of literal
+	// whitespace runes it starts with. Escapes are decoded as we go,
+	// so an escaped space never counts as indentation.
+	type line struct {
+		start, end int
+		indent     int
+	}
+	var lines []line
+	cur := line{start: len(l.rs)}
+	leading := true // cur has only literal whitespace so far
+	for done := false; !done; {
+		r := l.next()
+		switch {
+		case r == eof:
+			return l.err(SyntaxUnterminatedString, "EOF during multi-line string")
+		case r == '"' && l.accept(`"`) && l.accept(`"`):
+			if !leading {
+				return l.err(SyntaxBadMultilineString, `closing """ of multi-line string must be on its own line`)
+			}
+			done = true
+		case newline(r):
+			l.backup()
+			cur.end = len(l.rs)
+			if _, err := l.acceptNewline(); err != nil {
+				return l.err(SyntaxBadNewline, "%w", err)
+			}
+			lines = append(lines, cur)
+			cur = line{start: len(l.rs)}
+			leading = true
+		case r == '\\':
+			if !l.escape() {
+				return nil
+			}
+			leading = false
+		case space(r) && leading:
+			cur.indent++
+		default:
+			leading = false
+		}
+	}
+
+	prefix := l.rs[cur.start : cur.start+cur.indent]
+	var b strings.Builder
+	for i, ln := range lines {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		if ln.indent == ln.end-ln.start {
+			continue // whitespace-only lines are always empty
+		}
+		if ln.indent < len(prefix) || string(l.rs[ln.start:ln.start+len(prefix)]) != string(prefix) {
+			return l.err(SyntaxBadMultilineString, `line %d of multi-line string is indented less than its closing """`, l.start.Line+1+i)
+		}
+		b.WriteString(string(l.rs[ln.start+len(prefix) : ln.end]))
+	}
+	l.emit(Token{Type: TokenString, Value: b.String()})
+	return lexAny
+}
+
+// escape decodes the escape sequence following a backslash in a
+// string, replacing both in rs with the escaped rune. It returns
+// false after emitting an error if the escape is invalid.
+//
+// In V2, a backslash followed by whitespace and newlines is removed
+// along with all of them, so long strings can continue on the next
+// line.
+func (l *lexer) escape() bool {
+	replacePoint := len(l.rs) - 1 // position of the \
+	if r := l.peek(); l.opts.Version != V1 && (space(r) || newline(r)) {
+		for r := l.peek(); space(r) || newline(r); r = l.peek() {
+			if space(r) {
+				l.next()
+			} else if _, err := l.acceptNewline(); err != nil {
+				l.err(SyntaxBadNewline, "%w", err)
+				return false
+			}
+		}
+		l.rs = l.rs[:replacePoint]
+		return true
+	}
+	r, err := unescapeRune(l.next)
+	if err != nil && l.opts.LenientEscapes {
+		// Keep the escape sequence as written, except for a quote or
+		// backslash that it swallowed while looking for more, which
+		// end the string or start the next escape.
+		if n := len(l.rs) - 1; n > replacePoint+1 && (l.rs[n] == '"' || l.rs[n] == '\\') {
+			l.backup()
+		}
+		l.diags = append(l.diags, &SyntaxError{
+			Pos:      l.hist[replacePoint].Pos,
+			Category: SyntaxBadEscape,
+			Rune:     l.last(),
+			Text:     string(l.rs[replacePoint:]),
+			Err:      err,
+		})
+		return true
+	} else if err != nil {
+		l.err(SyntaxBadEscape, "%w", err)
+		return false
+	}
+	l.rs = append(l.rs[:replacePoint], r)
+	return true
+}
+
+// lexRawString lexes a raw string, either KDL v1's r#"..."#, whose
+// leading 'r' was accepted prior to entering this lex state, or KDL
+// v2's #"..."#.
+func lexRawString(l *lexer) lexFn {
+	if len(l.rs) > 0 && l.opts.Version == V2 {
+		return l.err(SyntaxWrongVersion, `raw strings are written #"..."# in KDL v2, not r"..."`)
+	}
 	hashes := 0
 	for l.next() == '#' {
 		hashes++
 	}
 	if l.last() != '"' {
-		return l.err("expected dquote, got %q", l.last())
+		return l.err(SyntaxUnexpectedRune, "expected dquote, got %q", l.last())
 	}
+	open := len(l.rs)
 findEnd:
 	for {
 		if !l.until(`"`) {
-			return l.err("EOF in raw string")
+			return l.err(SyntaxUnterminatedString, "EOF in raw string")
 		}
 		l.accept(`"`)
 		for i := 0; i < hashes; i++ {
@@ -498,46 +1405,69 @@ findEnd:
 				continue findEnd
 			}
 		}
-		l.emit(token{typ: tokString, str: string(l.rs[hashes+2 : len(l.rs)-hashes-1])})
-		return l.lexAny
+		l.emit(Token{Type: TokenString, Value: l.text(l.rs[open : len(l.rs)-hashes-1]), raw: true, hashes: hashes})
+		return lexAny
 	}
 }
 
-func (l *lexer) lexSpace() lexFn {
-	if !l.accept(spaceChars) {
-		return l.lexAny
-	}
-	l.acceptRun(spaceChars)
-	switch l.peek() {
-	case eof:
-		l.emit(token{typ: tokSpace})
-		return nil
-	case '\\':
-		l.next() // TODO: check if there _must_ be at least one space, currently accept zero.
-		l.acceptRun(spaceChars)
-		if l.peek() == '/' {
+// lexSpace lexes a run of whitespace and line continuations,
+// emitting a single TokenSpace for the lot. Block comments that
+// aren't kept are part of the run too: lexComment lexes them, and
+// comes back here to continue it.
+func lexSpace(l *lexer) lexFn {
+	any := len(l.rs) > 0 // a block comment already read
+	for {
+		r := l.peek()
+		switch {
+		case l.space(r):
+			l.next()
+		case r == '/' && !l.opts.Comments && !l.opts.DisallowBlockComments && l.blockCommentAhead():
+			return lexComment
+		case r == '\\':
+			// Line continuation: a backslash, optional whitespace and an
+			// optional single-line comment, then a mandatory newline.
 			l.next()
-			if r := l.peek(); r != '/' {
-				return l.err("unexpected rune %q in newline continuation", r)
+			for l.space(l.next()) {
 			}
-			if !l.until(newlineChars) {
+			l.backup()
+			if l.peek() == '/' {
+				l.next()
+				if r := l.peek(); r != '/' {
+					return l.err(SyntaxBadLineContinuation, "unexpected rune %q in line continuation, expected single-line comment", r)
+				}
+				if !l.until(newlineChars) {
+					// The comment ends the document, no newline needed.
+					break
+				}
+			}
+			r := l.peek()
+			if r == eof {
+				return l.err(SyntaxBadLineContinuation, "EOF in line continuation, expected newline")
+			}
+			if ok, err := l.acceptNewline(); err != nil {
+				return l.err(SyntaxBadNewline, "%w", err)
+			} else if !ok {
+				return l.err(SyntaxBadLineContinuation, "unexpected rune %q in line continuation, expected newline", r)
+			}
+		default:
+			if any {
+				l.emit(Token{Type: TokenSpace})
+			}
+			if r == eof {
 				return nil
 			}
+			return lexAny
 		}
-		if !l.acceptNewline() {
-			return l.err("unexpected rune %q in newline continuation", l.peek())
-		}
-		return l.lexSpace
-	default:
-		l.emit(token{typ: tokSpace})
-		return l.lexAny
+		any = true
 	}
 }
 
-func (l *lexer) lexNewline() lexFn {
-	if !l.acceptNewline() {
-		l.err("tried to lex newline when not at newline")
+func lexNewline(l *lexer) lexFn {
+	if ok, err := l.acceptNewline(); err != nil {
+		return l.err(SyntaxBadNewline, "%w", err)
+	} else if !ok {
+		return l.err(SyntaxOther, "tried to lex newline when not at newline")
 	}
-	l.emit(token{typ: tokNewline})
-	return l.lexAny
+	l.emit(Token{Type: TokenNewline})
+	return lexAny
 }
@@ -2,14 +2,20 @@ package kdl
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestConformance(t *testing.T) {
@@ -29,16 +35,12 @@ func TestConformance(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			bin := bytes.NewBuffer(bs)
-			l := NewLexer(bin)
-			for {
-				tok := l.Next()
+			toks, err := Tokenize(bytes.NewReader(bs))
+			for _, tok := range toks {
 				fmt.Fprintln(&b, tok)
-				if tok.typ == tokErr {
-					t.Fatalf("got error:\n%s\n%s", b.String(), string(bs))
-				} else if tok.typ == tokEOF {
-					break
-				}
+			}
+			if err != nil {
+				t.Fatalf("got error %v after:\n%s\n%s", err, b.String(), string(bs))
 			}
 			wantName := strings.Replace(n, "/valid/", "/lex/", 1)
 			wantbs, err := os.ReadFile(wantName)
@@ -68,3 +70,1524 @@ func TestConformance(t *testing.T) {
 		})
 	}
 }
+
+func TestPositions(t *testing.T) {
+	type tokPos struct {
+		Typ    string
+		Offset int
+		Line   int
+		Column int
+	}
+	tests := []struct {
+		in   string
+		want []tokPos
+	}{
+		{
+			in: "node \"arg\"\r\nnœud 1\n",
+			want: []tokPos{
+				{"Identifier", 0, 1, 1},
+				{"Space", 4, 1, 5},
+				{"String", 5, 1, 6},
+				{"Newline", 10, 1, 11},
+				{"Identifier", 12, 2, 1},
+				{"Space", 17, 2, 5},
+				{"Int", 18, 2, 6},
+				{"Newline", 19, 2, 7},
+				{"EOF", 20, 3, 1},
+			},
+		},
+		{
+			in: "a /* multi\nline */ b",
+			want: []tokPos{
+				{"Identifier", 0, 1, 1},
+				{"Space", 1, 1, 2},
+				{"Identifier", 19, 2, 9},
+				{"EOF", 20, 2, 10},
+			},
+		},
+		{
+			// Every newline character starts a new line, and the
+			// exotic spaces take one column each.
+			in: "a\vb\fc\u0085d\u2028e\u2029f\u00a0\u3000g",
+			want: []tokPos{
+				{"Identifier", 0, 1, 1},
+				{"Newline", 1, 1, 2},
+				{"Identifier", 2, 2, 1},
+				{"Newline", 3, 2, 2},
+				{"Identifier", 4, 3, 1},
+				{"Newline", 5, 3, 2},
+				{"Identifier", 7, 4, 1},
+				{"Newline", 8, 4, 2},
+				{"Identifier", 11, 5, 1},
+				{"Newline", 12, 5, 2},
+				{"Identifier", 15, 6, 1},
+				{"Space", 16, 6, 2},
+				{"Identifier", 21, 6, 4},
+				{"EOF", 22, 6, 5},
+			},
+		},
+		{
+			in: "a \\\n  b",
+			want: []tokPos{
+				{"Identifier", 0, 1, 1},
+				{"Space", 1, 1, 2},
+				{"Identifier", 6, 2, 3},
+				{"EOF", 7, 2, 4},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		l := NewLexer(strings.NewReader(test.in))
+		var got []tokPos
+		for {
+			tok := l.Next()
+			got = append(got, tokPos{tok.Type.String(), tok.Offset, tok.Line, tok.Column})
+			if tok.Type == TokenErr || tok.Type == TokenEOF {
+				break
+			}
+		}
+		if diff := cmp.Diff(got, test.want); diff != "" {
+			t.Errorf("wrong positions for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+// lexTokens lexes in and returns the String of each token, up to and
+// including the first error or EOF.
+func lexTokens(in string) []string {
+	return lexTokensOpts(LexerOptions{}, in)
+}
+
+func lexTokensOpts(opts LexerOptions, in string) []string {
+	var ret []string
+	for tok := range opts.NewLexer(strings.NewReader(in)).All() {
+		ret = append(ret, tok.String())
+	}
+	return ret
+}
+
+func TestKeywords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"true", []string{`Bool ("true")`, "EOF"}},
+		{"false", []string{`Bool ("false")`, "EOF"}},
+		{"null", []string{"Null", "EOF"}},
+		{`"true"`, []string{`String ("true")`, "EOF"}},
+		{`r"null"`, []string{`String ("null")`, "EOF"}},
+		{"truething", []string{`Identifier ("truething")`, "EOF"}},
+		{"null_node", []string{`Identifier ("null_node")`, "EOF"}},
+		{"nul", []string{`Identifier ("nul")`, "EOF"}},
+		{"a=false", []string{`Identifier ("a")`, "Equal", `Bool ("false")`, "EOF"}},
+		{"#true", []string{`Bool ("true")`, "EOF"}},
+		{"#false", []string{`Bool ("false")`, "EOF"}},
+		{"#null", []string{"Null", "EOF"}},
+		{"#inf", []string{`Float ("#inf")`, "EOF"}},
+		{"#-inf", []string{`Float ("#-inf")`, "EOF"}},
+		{"#nan", []string{`Float ("#nan")`, "EOF"}},
+		{"node #true #null", []string{`Identifier ("node")`, "Space", `Bool ("true")`, "Space", "Null", "EOF"}},
+		{"a=#nan;", []string{`Identifier ("a")`, "Equal", `Float ("#nan")`, "Semicolon", "EOF"}},
+		{"#foo", []string{`Err (unknown keyword "#foo")`}},
+		{"#truer", []string{`Err (unknown keyword "#truer")`}},
+		{"#", []string{`Err (unknown keyword "#")`}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestRawStringPrefix(t *testing.T) {
+	// Only an r directly followed by # or " starts a raw string, other
+	// identifiers starting with r are just identifiers.
+	tests := []struct {
+		in       string
+		zero, v2 []string
+	}{
+		{
+			in:   "r",
+			zero: []string{`Identifier ("r")`, "EOF"},
+			v2:   []string{`Identifier ("r")`, "EOF"},
+		},
+		{
+			in:   "r2",
+			zero: []string{`Identifier ("r2")`, "EOF"},
+			v2:   []string{`Identifier ("r2")`, "EOF"},
+		},
+		{
+			in:   "r2d2 rrr regex",
+			zero: []string{`Identifier ("r2d2")`, "Space", `Identifier ("rrr")`, "Space", `Identifier ("regex")`, "EOF"},
+			v2:   []string{`Identifier ("r2d2")`, "Space", `Identifier ("rrr")`, "Space", `Identifier ("regex")`, "EOF"},
+		},
+		{
+			// Two tokens, which the parser rejects for lacking a space
+			// between them.
+			in:   `rr"x"`,
+			zero: []string{`Identifier ("rr")`, `String ("x")`, "EOF"},
+			v2:   []string{`Identifier ("rr")`, `String ("x")`, "EOF"},
+		},
+		{
+			in:   `r#"x"#`,
+			zero: []string{`String ("x")`, "EOF"},
+			v2:   []string{`Err (raw strings are written #"..."# in KDL v2, not r"...")`},
+		},
+		{
+			in:   `r"x"`,
+			zero: []string{`String ("x")`, "EOF"},
+			v2:   []string{`Err (raw strings are written #"..."# in KDL v2, not r"...")`},
+		},
+		{
+			in:   "r#",
+			zero: []string{`Identifier ("r#")`, "EOF"},
+			v2:   []string{`Identifier ("r")`, `Err (unknown keyword "#")`},
+		},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokensOpts(LexerOptions{}, test.in), test.zero); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+		if diff := cmp.Diff(lexTokensOpts(LexerOptions{Version: V2}, test.in), test.v2); diff != "" {
+			t.Errorf("wrong V2 tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	if _, err := ParseString(`rr"x"`); err == nil || !strings.Contains(err.Error(), "expected whitespace first") {
+		t.Errorf(`Parse(rr"x") = %v, want missing whitespace error`, err)
+	}
+}
+
+func TestV2BareKeywords(t *testing.T) {
+	v1 := LexerOptions{Version: V1}
+	v2 := LexerOptions{Version: V2}
+	tests := []struct {
+		in   string
+		opts LexerOptions
+		want []string
+	}{
+		{"a true", v1, []string{`Identifier ("a")`, "Space", `Bool ("true")`, "EOF"}},
+		{"a null", v1, []string{`Identifier ("a")`, "Space", "Null", "EOF"}},
+		{"inf nan", v1, []string{`Identifier ("inf")`, "Space", `Identifier ("nan")`, "EOF"}},
+		{"a true", LexerOptions{}, []string{`Identifier ("a")`, "Space", `Bool ("true")`, "EOF"}},
+
+		{"a true", v2, []string{`Identifier ("a")`, "Space", `Err (bare true is not allowed in KDL v2, write #true for the keyword or "true" for a string)`}},
+		{"a=false", v2, []string{`Identifier ("a")`, "Equal", `Err (bare false is not allowed in KDL v2, write #false for the keyword or "false" for a string)`}},
+		{"null", v2, []string{`Err (bare null is not allowed in KDL v2, write #null for the keyword or "null" for a string)`}},
+		{"a inf", v2, []string{`Identifier ("a")`, "Space", `Err (bare inf is not allowed in KDL v2, write #inf for the keyword or "inf" for a string)`}},
+		{"a -inf", v2, []string{`Identifier ("a")`, "Space", `Err (bare -inf is not allowed in KDL v2, write #-inf for the keyword or "-inf" for a string)`}},
+		{"a #true #nan", v2, []string{`Identifier ("a")`, "Space", `Bool ("true")`, "Space", `Float ("#nan")`, "EOF"}},
+		{`a "true"`, v2, []string{`Identifier ("a")`, "Space", `String ("true")`, "EOF"}},
+		{"truthy infinite", v2, []string{`Identifier ("truthy")`, "Space", `Identifier ("infinite")`, "EOF"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokensOpts(test.opts, test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q with %+v (-got+want):\n%s", test.in, test.opts, diff)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	// Each input lexes differently under V1 and V2. The zero Version
+	// accepts both versions' keywords and raw strings.
+	tests := []struct {
+		in           string
+		v1, v2, zero []string
+	}{
+		{
+			in:   "true",
+			v1:   []string{`Bool ("true")`, "EOF"},
+			v2:   []string{`Err (bare true is not allowed in KDL v2, write #true for the keyword or "true" for a string)`},
+			zero: []string{`Bool ("true")`, "EOF"},
+		},
+		{
+			in:   "#null",
+			v1:   []string{`Identifier ("#null")`, "EOF"},
+			v2:   []string{"Null", "EOF"},
+			zero: []string{"Null", "EOF"},
+		},
+		{
+			in:   "#nan",
+			v1:   []string{`Identifier ("#nan")`, "EOF"},
+			v2:   []string{`Float ("#nan")`, "EOF"},
+			zero: []string{`Float ("#nan")`, "EOF"},
+		},
+		{
+			in:   "#foo 1",
+			v1:   []string{`Identifier ("#foo")`, "Space", `Int ("1")`, "EOF"},
+			v2:   []string{`Err (unknown keyword "#foo")`},
+			zero: []string{`Err (unknown keyword "#foo")`},
+		},
+		{
+			in:   "nan",
+			v1:   []string{`Identifier ("nan")`, "EOF"},
+			v2:   []string{`Err (bare nan is not allowed in KDL v2, write #nan for the keyword or "nan" for a string)`},
+			zero: []string{`Identifier ("nan")`, "EOF"},
+		},
+		{
+			in:   `r#"a"b"#`,
+			v1:   []string{`String ("a\"b")`, "EOF"},
+			v2:   []string{`Err (raw strings are written #"..."# in KDL v2, not r"...")`},
+			zero: []string{`String ("a\"b")`, "EOF"},
+		},
+		{
+			in:   `#"a"b"#`,
+			v1:   []string{`Identifier ("#")`, `String ("a")`, `Identifier ("b")`, "Err (EOF during string)"},
+			v2:   []string{`String ("a\"b")`, "EOF"},
+			zero: []string{`String ("a\"b")`, "EOF"},
+		},
+		{
+			in:   "\"\"\"\n  a\n  \"\"\"",
+			v1:   []string{`Err (multi-line strings are not allowed in KDL v1)`},
+			v2:   []string{`String ("a")`, "EOF"},
+			zero: []string{`String ("a")`, "EOF"},
+		},
+		{
+			in:   "\"a\\\n  b\"",
+			v1:   []string{"Err (unknown escape sequence \\\n)"},
+			v2:   []string{`String ("ab")`, "EOF"},
+			zero: []string{`String ("ab")`, "EOF"},
+		},
+	}
+
+	for _, test := range tests {
+		for _, v := range []struct {
+			version Version
+			want    []string
+		}{{V1, test.v1}, {V2, test.v2}, {0, test.zero}} {
+			opts := LexerOptions{Version: v.version}
+			if diff := cmp.Diff(lexTokensOpts(opts, test.in), v.want); diff != "" {
+				t.Errorf("wrong tokens for %q with Version %d (-got+want):\n%s", test.in, v.version, diff)
+			}
+		}
+	}
+
+	// #true is a bare identifier in KDL v1, which can't be a value.
+	if _, err := (ParseOptions{LexerOptions: LexerOptions{Version: V1}}).ParseString("node #true"); err == nil {
+		t.Errorf("Parse with V1 succeeded, want an error")
+	}
+}
+
+func TestIdentifierCharacters(t *testing.T) {
+	// The zero Version lexes identifiers like V1, unless zero is set.
+	tests := []struct {
+		in           string
+		v1, v2, zero []string
+	}{
+		{
+			in: "a(b",
+			v1: []string{`Identifier ("a")`, "OpenParen", `Identifier ("b")`, "EOF"},
+			v2: []string{`Identifier ("a")`, "OpenParen", `Identifier ("b")`, "EOF"},
+		},
+		{
+			in: "a)b",
+			v1: []string{`Identifier ("a")`, "CloseParen", `Identifier ("b")`, "EOF"},
+			v2: []string{`Identifier ("a")`, "CloseParen", `Identifier ("b")`, "EOF"},
+		},
+		{
+			in: "a[b",
+			v1: []string{`Identifier ("a")`, `Err (don't know how to lex '[')`},
+			v2: []string{`Identifier ("a")`, `Err (don't know how to lex '[')`},
+		},
+		{
+			in: "a]b",
+			v1: []string{`Identifier ("a")`, `Err (don't know how to lex ']')`},
+			v2: []string{`Identifier ("a")`, `Err (don't know how to lex ']')`},
+		},
+		{
+			in: "a#b",
+			v1: []string{`Identifier ("a#b")`, "EOF"},
+			v2: []string{`Identifier ("a")`, `Err (unknown keyword "#b")`},
+		},
+		{
+			in:   "#a b#",
+			v1:   []string{`Identifier ("#a")`, "Space", `Identifier ("b#")`, "EOF"},
+			v2:   []string{`Err (unknown keyword "#a")`},
+			zero: []string{`Err (unknown keyword "#a")`},
+		},
+		{
+			in: "a<b>",
+			v1: []string{`Identifier ("a")`, `Err (don't know how to lex '<')`},
+			v2: []string{`Identifier ("a<b>")`, "EOF"},
+		},
+		{
+			in: "a,b",
+			v1: []string{`Identifier ("a")`, `Err (don't know how to lex ',')`},
+			v2: []string{`Identifier ("a,b")`, "EOF"},
+		},
+	}
+
+	for _, test := range tests {
+		for _, v := range []struct {
+			version Version
+			want    []string
+		}{{V1, test.v1}, {V2, test.v2}, {0, test.zero}} {
+			if v.version == 0 && v.want == nil {
+				v.want = test.v1
+			}
+			opts := LexerOptions{Version: v.version}
+			if diff := cmp.Diff(lexTokensOpts(opts, test.in), v.want); diff != "" {
+				t.Errorf("wrong tokens for %q with Version %d (-got+want):\n%s", test.in, v.version, diff)
+			}
+		}
+	}
+}
+
+func TestExtraSpaces(t *testing.T) {
+	comma := LexerOptions{ExtraSpaces: ","}
+	tests := []struct {
+		in   string
+		opts LexerOptions
+		want []string
+	}{
+		{"a,1,b=2", comma, []string{`Identifier ("a")`, "Space", `Int ("1")`, "Space", `Identifier ("b")`, "Equal", `Int ("2")`, "EOF"}},
+		{"a , 1", comma, []string{`Identifier ("a")`, "Space", `Int ("1")`, "EOF"}},
+		{`a "x,y",#true`, LexerOptions{ExtraSpaces: ",", Version: V2}, []string{`Identifier ("a")`, "Space", `String ("x,y")`, "Space", `Bool ("true")`, "EOF"}},
+		{"a \\,\nb", comma, []string{`Identifier ("a")`, "Space", `Identifier ("b")`, "EOF"}},
+		{"a,1", LexerOptions{Version: V2}, []string{`Identifier ("a,1")`, "EOF"}},
+		{"a,1", LexerOptions{Version: V1}, []string{`Identifier ("a")`, `Err (don't know how to lex ',')`}},
+
+		{"a", LexerOptions{ExtraSpaces: ",="}, []string{`Err (LexerOptions.ExtraSpaces can't include '=')`}},
+		{"a", LexerOptions{ExtraSpaces: "x"}, []string{`Err (LexerOptions.ExtraSpaces can't include 'x')`}},
+		{"a", LexerOptions{ExtraSpaces: "\n"}, []string{`Err (LexerOptions.ExtraSpaces can't include '\n')`}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokensOpts(test.opts, test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q with %+v (-got+want):\n%s", test.in, test.opts, diff)
+		}
+	}
+
+	doc, err := ParseOptions{LexerOptions: comma}.ParseString("a 1,2,key=\"v,w\"")
+	if err != nil {
+		t.Fatalf("parsing with comma spaces: %v", err)
+	}
+	want := NewDocument(NewNode("a", IntValue(1), IntValue(2)))
+	want.Nodes[0].SetProp("key", StringValue("v,w"))
+	if !doc.Equal(want) {
+		t.Errorf("wrong document with comma spaces, got %v, want %v", doc, want)
+	}
+}
+
+func TestSignedIdentifiers(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"-foo", []string{`Identifier ("-foo")`, "EOF"}},
+		{"+foo", []string{`Identifier ("+foo")`, "EOF"}},
+		{"-1", []string{`Int ("-1")`, "EOF"}},
+		{"+1", []string{`Int ("+1")`, "EOF"}},
+		{"-", []string{`Identifier ("-")`, "EOF"}},
+		{"+", []string{`Identifier ("+")`, "EOF"}},
+		{"- 1", []string{`Identifier ("-")`, "Space", `Int ("1")`, "EOF"}},
+		{"--x", []string{`Identifier ("--x")`, "EOF"}},
+		{"-1.5", []string{`Float ("-1.5")`, "EOF"}},
+		{"node -foo=-1", []string{`Identifier ("node")`, "Space", `Identifier ("-foo")`, "Equal", `Int ("-1")`, "EOF"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestTypeAnnotations(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"(i32)10", []string{"OpenParen", `Identifier ("i32")`, "CloseParen", `Int ("10")`, "EOF"}},
+		{`(date)"2021-01-01"`, []string{"OpenParen", `Identifier ("date")`, "CloseParen", `String ("2021-01-01")`, "EOF"}},
+		{"(author)node", []string{"OpenParen", `Identifier ("author")`, "CloseParen", `Identifier ("node")`, "EOF"}},
+		{`("quoted type")1.5`, []string{"OpenParen", `String ("quoted type")`, "CloseParen", `Float ("1.5")`, "EOF"}},
+		{`(r#"raw)"#)#true`, []string{"OpenParen", `String ("raw)")`, "CloseParen", `Bool ("true")`, "EOF"}},
+		{"node prop=(u8)255", []string{`Identifier ("node")`, "Space", `Identifier ("prop")`, "Equal", "OpenParen", `Identifier ("u8")`, "CloseParen", `Int ("255")`, "EOF"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestUnicodeEscapes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`"\u{41}"`, []string{`String ("A")`, "EOF"}},
+		{`"\u{1F600}"`, []string{`String ("😀")`, "EOF"}},
+		{`"\u{10FFFF}"`, []string{`String ("\U0010ffff")`, "EOF"}},
+		{`"\u{D7FF}\u{E000}"`, []string{`String ("\ud7ff\ue000")`, "EOF"}},
+		{`"\u{110000}"`, []string{`Err (invalid code point U+110000 in \u escape sequence)`}},
+		{`"\u{D800}"`, []string{`Err (invalid code point U+D800 in \u escape sequence)`}},
+		{`"\u{DFFF}"`, []string{`Err (invalid code point U+DFFF in \u escape sequence)`}},
+		{`"\u{FFFFFF}"`, []string{`Err (invalid code point U+FFFFFF in \u escape sequence)`}},
+		{`"\u{0010FFFF}"`, []string{`Err (too many hex digits in \u escape sequence)`}},
+		{`"\u{}"`, []string{`Err (no hex in \u escape sequence)`}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %s (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestWhitespaceEscapes(t *testing.T) {
+	v1 := LexerOptions{Version: V1}
+	tests := []struct {
+		in   string
+		opts LexerOptions
+		want []string
+	}{
+		{"\"a\\\n   b\"", LexerOptions{}, []string{`String ("ab")`, "EOF"}},
+		{"\"a \\\n\t\tb\"", LexerOptions{}, []string{`String ("a b")`, "EOF"}},
+		{"\"a\\\r\n  b\"", LexerOptions{}, []string{`String ("ab")`, "EOF"}},
+		{"\"a\\   b\"", LexerOptions{}, []string{`String ("ab")`, "EOF"}},
+		{"\"a\\\n\n  \n b\"", LexerOptions{}, []string{`String ("ab")`, "EOF"}},
+		{"\"a\\\n\"", LexerOptions{}, []string{`String ("a")`, "EOF"}},
+		{"\"a\\\r\n  b\"", LexerOptions{Newlines: LFNewlines}, []string{`Err (newline "\r\n" not allowed, expected "\n")`}},
+		{"\"\"\"\n  a \\\n  b\n  \"\"\"", LexerOptions{}, []string{`String ("a b")`, "EOF"}},
+
+		{"\"a\\\n   b\"", v1, []string{"Err (unknown escape sequence \\\n)"}},
+		{"\"a\\\r\n  b\"", v1, []string{"Err (unknown escape sequence \\\r)"}},
+		{"\"a\\   b\"", v1, []string{"Err (unknown escape sequence \\ )"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokensOpts(test.opts, test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q with %+v (-got+want):\n%s", test.in, test.opts, diff)
+		}
+	}
+}
+
+func TestNumberUnderscores(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"1_000", []string{`Int ("1_000")`, "EOF"}},
+		{"1__0", []string{`Int ("1__0")`, "EOF"}},
+		{"0_1", []string{`Int ("0_1")`, "EOF"}},
+		{"-1_0", []string{`Int ("-1_0")`, "EOF"}},
+		{"0xff_ff", []string{`Int ("0xff_ff")`, "EOF"}},
+		{"0o7_7", []string{`Int ("0o7_7")`, "EOF"}},
+		{"0b1_0", []string{`Int ("0b1_0")`, "EOF"}},
+		{"1_1.0_1e1_0", []string{`Float ("1_1.0_1e1_0")`, "EOF"}},
+		{"10_", []string{`Int ("10_")`, "EOF"}},
+		{"0_", []string{`Int ("0_")`, "EOF"}},
+		{"0x_ff", []string{`Err (underscore before first digit in "0x_")`}},
+		{"0xff_", []string{`Int ("0xff_")`, "EOF"}},
+		{"0o_7", []string{`Err (underscore before first digit in "0o_")`}},
+		{"0b_1", []string{`Err (underscore before first digit in "0b_")`}},
+		{"-_1", []string{`Identifier ("-_1")`, "EOF"}},
+		{"1._5", []string{`Err (underscore before first digit in "1._")`}},
+		{"1.0e_5", []string{`Err (underscore before first digit in "1.0e_")`}},
+		{"0x", []string{`Err (no digits after radix prefix in "0x")`}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestFloats(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"1.0", []string{`Float ("1.0")`, "EOF"}},
+		{"1.0e-3", []string{`Float ("1.0e-3")`, "EOF"}},
+		{"1E+10", []string{`Float ("1E+10")`, "EOF"}},
+		{"1e10", []string{`Float ("1e10")`, "EOF"}},
+		{"1e", []string{`Err (no digits in exponent of "1e")`}},
+		{"1e+", []string{`Err (no digits in exponent of "1e+")`}},
+		{"1.0E-", []string{`Err (no digits in exponent of "1.0E-")`}},
+		{"1.", []string{`Err (no digits after decimal point in "1.")`}},
+		{"1.e7", []string{`Err (no digits after decimal point in "1.")`}},
+		{"node 1. ", []string{`Identifier ("node")`, "Space", `Err (no digits after decimal point in "1.")`}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"\uFEFFnode", []string{`Identifier ("node")`, "EOF"}},
+		{"\uFEFF", []string{"EOF"}},
+		{"node \"\uFEFF\"", []string{`Identifier ("node")`, "Space", `String ("\ufeff")`, "EOF"}},
+		{"node \uFEFF", []string{`Identifier ("node")`, "Space", "Err (byte order mark is only allowed at the start of the document)"}},
+		{"node\uFEFF", []string{`Identifier ("node")`, "Err (byte order mark is only allowed at the start of the document)"}},
+		{"\uFEFF\uFEFFnode", []string{"Err (byte order mark is only allowed at the start of the document)"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	l := NewLexer(strings.NewReader("\uFEFFnode"))
+	defer l.Close()
+	if tok := l.Next(); tok.Pos != (Pos{Offset: 3, Line: 1, Column: 1}) {
+		t.Errorf("Token after BOM at %#v, want offset 3, 1:1", tok.Pos)
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"foo \\\nbar", []string{`Identifier ("foo")`, "Space", `Identifier ("bar")`, "EOF"}},
+		{"foo\\\n  bar", []string{`Identifier ("foo")`, "Space", `Identifier ("bar")`, "EOF"}},
+		{"foo \\ \t\r\nbar", []string{`Identifier ("foo")`, "Space", `Identifier ("bar")`, "EOF"}},
+		{"foo \\ // c\nbar", []string{`Identifier ("foo")`, "Space", `Identifier ("bar")`, "EOF"}},
+		{"foo \\ // c", []string{`Identifier ("foo")`, "Space", "EOF"}},
+		{"foo \\\n \\\n bar", []string{`Identifier ("foo")`, "Space", `Identifier ("bar")`, "EOF"}},
+		{"foo \\x", []string{`Identifier ("foo")`, `Err (unexpected rune 'x' in line continuation, expected newline)`}},
+		{"foo \\ /* c */\nbar", []string{`Identifier ("foo")`, `Err (unexpected rune '*' in line continuation, expected single-line comment)`}},
+		{"foo \\", []string{`Identifier ("foo")`, "Err (EOF in line continuation, expected newline)"}},
+		{"foo \\  ", []string{`Identifier ("foo")`, "Err (EOF in line continuation, expected newline)"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	l := NewLexer(strings.NewReader("foo \\ x"))
+	defer l.Close()
+	l.Next()
+	if tok := l.Next(); tok.Type != TokenErr || tok.Pos != (Pos{Offset: 6, Line: 1, Column: 7}) {
+		t.Errorf("got %s at %#v, want error at offset 6, 1:7", tok, tok.Pos)
+	}
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"// c\nfoo", []string{`Comment ("// c")`, "Newline", `Identifier ("foo")`, "EOF"}},
+		{"foo // c", []string{`Identifier ("foo")`, "Space", `Comment ("// c")`, "EOF"}},
+		{"foo /* a /* b */ */ 1", []string{`Identifier ("foo")`, "Space", `Comment ("/* a /* b */ */")`, `Int ("1")`, "EOF"}},
+		{"foo/*\n*/1", []string{`Identifier ("foo")`, `Comment ("/*\n*/")`, `Int ("1")`, "EOF"}},
+		{"foo /- 1", []string{`Identifier ("foo")`, "Space", "IgnoreNode", "Space", `Int ("1")`, "EOF"}},
+		{"foo \\ // c\nbar", []string{`Identifier ("foo")`, "Space", `Identifier ("bar")`, "EOF"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokensOpts(LexerOptions{Comments: true}, test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	l := LexerOptions{Comments: true}.NewLexer(strings.NewReader("foo /* c */"))
+	defer l.Close()
+	l.Next()
+	l.Next()
+	if tok := l.Next(); tok.Type != TokenComment || !tok.block || tok.Pos != (Pos{Offset: 4, Line: 1, Column: 5}) {
+		t.Errorf("got %s (block=%v) at %#v, want block comment at offset 4, 1:5", tok, tok.block, tok.Pos)
+	}
+}
+
+func TestBlockCommentSpace(t *testing.T) {
+	// A block comment is whitespace, so it and the whitespace around
+	// it are a single separator.
+	tests := []struct {
+		in           string
+		want         []string
+		wantComments []string
+	}{
+		{
+			"a /* x */ b",
+			[]string{`Identifier ("a")`, "Space", `Identifier ("b")`, "EOF"},
+			[]string{`Identifier ("a")`, "Space", `Comment ("/* x */")`, `Identifier ("b")`, "EOF"},
+		},
+		{
+			"a/* x */b",
+			[]string{`Identifier ("a")`, "Space", `Identifier ("b")`, "EOF"},
+			[]string{`Identifier ("a")`, `Comment ("/* x */")`, `Identifier ("b")`, "EOF"},
+		},
+		{
+			"a /* x */ /* y */\t1",
+			[]string{`Identifier ("a")`, "Space", `Int ("1")`, "EOF"},
+			[]string{`Identifier ("a")`, "Space", `Comment ("/* x */")`, `Comment ("/* y */")`, `Int ("1")`, "EOF"},
+		},
+		{
+			"a /* x */\nb",
+			[]string{`Identifier ("a")`, "Space", "Newline", `Identifier ("b")`, "EOF"},
+			[]string{`Identifier ("a")`, "Space", `Comment ("/* x */")`, "Newline", `Identifier ("b")`, "EOF"},
+		},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+		if diff := cmp.Diff(lexTokensOpts(LexerOptions{Comments: true}, test.in), test.wantComments); diff != "" {
+			t.Errorf("wrong tokens for %q with comments (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	// Without whitespace on either side, the comment alone separates
+	// a node's name from its argument.
+	doc, err := ParseString("a/* x */1")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(doc.Nodes) != 1 || len(doc.Nodes[0].Args) != 1 {
+		t.Errorf("got %s, want node a with one argument", doc.DebugString())
+	}
+}
+
+func TestAll(t *testing.T) {
+	// An endless document, which only stops lexing if iteration
+	// closes the lexer.
+	r, w := io.Pipe()
+	go func() {
+		for {
+			if _, err := w.Write([]byte("a ")); err != nil {
+				return
+			}
+		}
+	}()
+	defer r.Close()
+
+	l := NewLexer(r)
+	var got []string
+	for tok := range l.All() {
+		got = append(got, tok.String())
+		if len(got) == 3 {
+			break
+		}
+	}
+	want := []string{`Identifier ("a")`, "Space", `Identifier ("a")`}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong tokens (-got+want):\n%s", diff)
+	}
+	// Breaking out of the loop closed the lexer, so the token stream
+	// ends, possibly after a token that was already on its way.
+	for i := 0; ; i++ {
+		if tok := l.Next(); tok.Type == TokenEOF {
+			break
+		} else if i > 100 {
+			t.Fatalf("lexer still running after early break, got %s", tok)
+		}
+	}
+}
+
+func TestMultilineStrings(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"\"\"\"\n  foo\n    bar\n  \"\"\"", []string{`String ("foo\n  bar")`, "EOF"}},
+		{"\"\"\"\nfoo\n\"\"\"", []string{`String ("foo")`, "EOF"}},
+		{"\"\"\"\n\"\"\"", []string{`String ("")`, "EOF"}},
+		{"\"\"\"\r\n\tfoo\r\n\r\n\tbar\r\n\t\"\"\"", []string{`String ("foo\n\nbar")`, "EOF"}},
+		{"\"\"\"\n  foo\n \n  \"\"\"", []string{`String ("foo\n")`, "EOF"}},
+		{"\"\"\"\n  \\tfoo \\\"\"\" \"\"\n  \"\"\"", []string{`String ("\tfoo \"\"\" \"\"")`, "EOF"}},
+		{"\"\"\"\n  \\u{20}foo\n  \"\"\"", []string{`String (" foo")`, "EOF"}},
+		{`"" ""`, []string{`String ("")`, "Space", `String ("")`, "EOF"}},
+		{"\"\"\"foo\n\"\"\"", []string{`Err (expected newline after opening """ of multi-line string)`}},
+		{"\"\"\"\n  foo\n bar\n  \"\"\"", []string{`Err (line 3 of multi-line string is indented less than its closing """)`}},
+		{"\"\"\"\n  foo\n\tbar\n  \"\"\"", []string{`Err (line 3 of multi-line string is indented less than its closing """)`}},
+		{"\"\"\"\n  foo \"\"\"", []string{`Err (closing """ of multi-line string must be on its own line)`}},
+		{"\"\"\"\n  foo\n", []string{"Err (EOF during multi-line string)"}},
+		{"\"\"\"\n  \\q\n\"\"\"", []string{`Err (unknown escape sequence \q)`}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestIsValidIdentifier(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"foo", true},
+		{"foo-bar_baz.qux", true},
+		{"nœud", true},
+		{"a1", true},
+		{"r", true},
+		{"rfoo", true},
+		{"", false},
+		{"1a", false},
+		{"-foo", true},
+		{"+foo", true},
+		{"-", true},
+		{"--", true},
+		{"-1", false},
+		{"+1", false},
+		{"-1a", false},
+		{".5", false},
+		{"-.5", false},
+		{"+.5", false},
+		{".5a", false},
+		{".", true},
+		{".a", true},
+		{"-.", true},
+		{"-.a", true},
+		{"a.5", true},
+		{"true", false},
+		{"false", false},
+		{"null", false},
+		{"inf", false},
+		{"-inf", false},
+		{"nan", false},
+		{"#true", false},
+		{"r#foo", false},
+		{"a#b", false},
+		{"a<b", false},
+		{"a,b", false},
+		{"a[b]", false},
+		{"foo bar", false},
+		{"foo\nbar", false},
+		{`foo"bar`, false},
+		{"foo=bar", false},
+		{"a{b}", false},
+		{"a(b)", false},
+		{"a;b", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"\ufefffoo", false},
+	}
+
+	for _, test := range tests {
+		if got := IsValidIdentifier(test.in); got != test.want {
+			t.Errorf("IsValidIdentifier(%q) = %v, want %v", test.in, got, test.want)
+		}
+		if !test.want {
+			continue
+		}
+		// Valid identifiers must lex back as themselves.
+		want := []string{fmt.Sprintf("Identifier (%q)", test.in), "EOF"}
+		if diff := cmp.Diff(lexTokens(test.in), want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+// benchmarkDoc is a representative 1MB document.
+var benchmarkDoc = func() []byte {
+	const chunk = `// A server.
+server "web-01" addr="10.0.0.1" port=8080 enabled=true {
+    /* Limits, in requests per second. */
+    limits burst=1_000 sustained=250.5
+    tags "prod" "eu-west" r#"raw "tag""#
+    owner null
+    ratio 1.5e-3 0xdead_beef
+}
+`
+	return bytes.Repeat([]byte(chunk), 1<<20/len(chunk))
+}()
+
+func benchmarkLex(b *testing.B, docs ...[]byte) {
+	b.ReportAllocs()
+	var n int64
+	for _, doc := range docs {
+		n += int64(len(doc))
+	}
+	b.SetBytes(n)
+	for i := 0; i < b.N; i++ {
+		for _, doc := range docs {
+			for tok := range NewLexer(bytes.NewReader(doc)).All() {
+				if tok.Type == TokenErr {
+					b.Fatal(tok)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkLex(b *testing.B) {
+	benchmarkLex(b, benchmarkDoc)
+}
+
+// BenchmarkLexLongRuns lexes comments and strings long enough that
+// lexing them is dominated by until's loop over their runes.
+func BenchmarkLexLongRuns(b *testing.B) {
+	long := strings.Repeat("lorem ipsum dolor sit amet ", 400)
+	doc := fmt.Sprintf("// %s\n/* %s */\nnode \"%s\" r#\"%s\"#\n", long, long, long, long)
+	benchmarkLex(b, []byte(doc))
+}
+
+func BenchmarkLexConformance(b *testing.B) {
+	ms, err := filepath.Glob("testdata/valid/*.kdl")
+	if err != nil {
+		b.Fatalf("glob failed: %v", err)
+	}
+	var docs [][]byte
+	for _, n := range ms {
+		bs, err := os.ReadFile(n)
+		if err != nil {
+			b.Fatal(err)
+		}
+		docs = append(docs, bs)
+	}
+	benchmarkLex(b, docs...)
+}
+
+func TestLexBytes(t *testing.T) {
+	// NewLexerBytes must lex exactly like the buffered reader path,
+	// including on invalid documents.
+	dump := func(l *lexer) string {
+		var b strings.Builder
+		for tok := range l.All() {
+			fmt.Fprintf(&b, "%s %s\n", tok.Pos, tok)
+		}
+		return b.String()
+	}
+
+	for _, dir := range []string{"valid", "invalid"} {
+		ms, err := filepath.Glob(filepath.Join("testdata", dir, "*.kdl"))
+		if err != nil {
+			t.Fatalf("glob failed: %v", err)
+		}
+		for _, n := range ms {
+			bs, err := os.ReadFile(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := dump(NewLexer(iotest.OneByteReader(bytes.NewReader(bs))))
+			got := dump(NewLexerBytes(bs))
+			if diff := cmp.Diff(strings.Split(got, "\n"), strings.Split(want, "\n")); diff != "" {
+				t.Errorf("NewLexerBytes(%s) lexed differently from NewLexer (-got+want):\n%s", n, diff)
+			}
+		}
+	}
+}
+
+func BenchmarkLexReader(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkDoc)))
+	for i := 0; i < b.N; i++ {
+		r := iotest.OneByteReader(bytes.NewReader(benchmarkDoc))
+		for tok := range NewLexer(r).All() {
+			if tok.Type == TokenErr {
+				b.Fatal(tok)
+			}
+		}
+	}
+}
+
+func FuzzLex(f *testing.F) {
+	for _, dir := range []string{"valid", "invalid"} {
+		ms, err := filepath.Glob(filepath.Join("testdata", dir, "*.kdl"))
+		if err != nil {
+			f.Fatalf("glob failed: %v", err)
+		}
+		for _, n := range ms {
+			bs, err := os.ReadFile(n)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(bs)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		for _, opts := range []LexerOptions{{}, {Comments: true}} {
+			var last Token
+			prev := -1
+			for tok := range opts.NewLexerBytes(in).All() {
+				if tok.Offset < prev || tok.Offset > len(in) {
+					t.Fatalf("token %s at offset %d, after offset %d in %d bytes", tok, tok.Offset, prev, len(in))
+				}
+				prev = tok.Offset
+				last = tok
+			}
+			if last.Type != TokenEOF && last.Type != TokenErr {
+				t.Fatalf("lexing ended with %s, want EOF or Err", last)
+			}
+			var se *SyntaxError
+			if errors.As(last.Err, &se) && se.Category == SyntaxInternal {
+				t.Fatalf("lexer crashed on %q: %v", in, se)
+			}
+		}
+	})
+}
+
+func TestTokenize(t *testing.T) {
+	toks, err := Tokenize(strings.NewReader("a 1\n"))
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	want := []Token{
+		{Pos: Pos{Offset: 0, Line: 1, Column: 1}, Type: TokenIdentifier, Value: "a", End: Pos{Offset: 1, Line: 1, Column: 2}},
+		{Pos: Pos{Offset: 1, Line: 1, Column: 2}, Type: TokenSpace, End: Pos{Offset: 2, Line: 1, Column: 3}},
+		{Pos: Pos{Offset: 2, Line: 1, Column: 3}, Type: TokenInt, Value: "1", End: Pos{Offset: 3, Line: 1, Column: 4}},
+		{Pos: Pos{Offset: 3, Line: 1, Column: 4}, Type: TokenNewline, End: Pos{Offset: 4, Line: 2, Column: 1}},
+		{Pos: Pos{Offset: 4, Line: 2, Column: 1}, Type: TokenEOF, End: Pos{Offset: 4, Line: 2, Column: 1}},
+	}
+	if diff := cmp.Diff(toks, want, cmp.AllowUnexported(Token{})); diff != "" {
+		t.Errorf("wrong tokens (-got+want):\n%s", diff)
+	}
+
+	toks, err = LexerOptions{Comments: true}.Tokenize(strings.NewReader("a // c\n\"b"))
+	var got []string
+	for _, tok := range toks {
+		got = append(got, tok.String())
+	}
+	if diff := cmp.Diff(got, []string{`Identifier ("a")`, "Space", `Comment ("// c")`, "Newline"}); diff != "" {
+		t.Errorf("wrong tokens before error (-got+want):\n%s", diff)
+	}
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Pos != (Pos{Offset: 9, Line: 2, Column: 3}) || perr.Err.Error() != "EOF during string" {
+		t.Errorf("Tokenize error = %#v, want EOF during string at 2:3", err)
+	}
+}
+
+func TestLexerReset(t *testing.T) {
+	tokens := func(l *lexer) []string {
+		var ret []string
+		for tok := range l.All() {
+			ret = append(ret, tok.String())
+		}
+		return ret
+	}
+
+	l := NewLexer(iotest.OneByteReader(strings.NewReader("a 1\n")))
+	want := []string{`Identifier ("a")`, "Space", `Int ("1")`, "Newline", "EOF"}
+	if diff := cmp.Diff(tokens(l), want); diff != "" {
+		t.Errorf("wrong tokens for first document (-got+want):\n%s", diff)
+	}
+	br := l.br
+
+	// Second document, through the same buffered reader.
+	l.Reset(iotest.OneByteReader(strings.NewReader("b\n  c=\"x\"")))
+	want = []string{`Identifier ("b")`, "Newline", "Space", `Identifier ("c")`, "Equal", `String ("x")`, "EOF"}
+	if diff := cmp.Diff(tokens(l), want); diff != "" {
+		t.Errorf("wrong tokens for second document (-got+want):\n%s", diff)
+	}
+	if l.br != br {
+		t.Errorf("Reset allocated a new buffered reader, want reuse")
+	}
+
+	// Reset in the middle of a document, with positions starting
+	// over.
+	l.Reset(strings.NewReader("x y z"))
+	if tok := l.Next(); tok.String() != `Identifier ("x")` {
+		t.Fatalf("got %s, want x", tok)
+	}
+	l.Reset(strings.NewReader("\"s\""))
+	if tok := l.Next(); tok.String() != `String ("s")` || tok.Pos != (Pos{Offset: 0, Line: 1, Column: 1}) {
+		t.Errorf("got %s at %#v after Reset, want string at start", tok, tok.Pos)
+	}
+	if tok := l.Next(); tok.Type != TokenEOF {
+		t.Errorf("got %s, want EOF", tok)
+	}
+}
+
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error)     { panic("boom") }
+func (panicReader) ReadRune() (rune, int, error) { panic("boom") }
+
+func TestLexPanic(t *testing.T) {
+	// A panic in the reader must reach the caller of Next, rather
+	// than crash the program from the lexer goroutine, or pass for a
+	// lexer bug.
+	l := NewLexer(panicReader{})
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("Next panicked with %v, want boom", r)
+			}
+		}()
+		tok := l.Next()
+		t.Errorf("Next returned %s, want panic", tok)
+	}()
+	if tok := l.Next(); tok.Type != TokenEOF {
+		t.Errorf("got %s after reader panic, want EOF", tok)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"foo \x80", []string{`Identifier ("foo")`, "Space", "Err (invalid UTF-8 at offset 4)"}},
+		{"foo\x80bar", []string{`Identifier ("foo")`, "Err (invalid UTF-8 at offset 3)"}},
+		{"\"foo\x80\"", []string{"Err (invalid UTF-8 at offset 4)"}},
+		{"// \x80\nfoo", []string{"Err (invalid UTF-8 at offset 3)"}},
+		{"foo \xe2\x82", []string{`Identifier ("foo")`, "Space", "Err (invalid UTF-8 at offset 4)"}},
+		// A correctly encoded replacement character is fine.
+		{"foo �", []string{`Identifier ("foo")`, "Space", `Identifier ("�")`, "EOF"}},
+		// As are the non-ASCII Latin-1 space and newline.
+		{"foo\u00a0bar\u0085", []string{`Identifier ("foo")`, "Space", `Identifier ("bar")`, "Newline", "EOF"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	l := NewLexer(bytes.NewReader([]byte{'a', ' ', 0x80}))
+	defer l.Close()
+	l.Next()
+	l.Next()
+	if tok := l.Next(); tok.Type != TokenErr || tok.Pos != (Pos{Offset: 2, Line: 1, Column: 3}) {
+		t.Errorf("got %s at %#v, want error at offset 2, 1:3", tok, tok.Pos)
+	}
+}
+
+func TestDisallowBlockComments(t *testing.T) {
+	strict := LexerOptions{DisallowBlockComments: true}
+	tests := []struct {
+		in   string
+		opts LexerOptions
+		want []string
+	}{
+		{"a /* x */ b", LexerOptions{}, []string{`Identifier ("a")`, "Space", `Identifier ("b")`, "EOF"}},
+		{"a /* x */ b", strict, []string{`Identifier ("a")`, "Space", "Err (block comments are not allowed)"}},
+		{"/* x */", strict, []string{"Err (block comments are not allowed)"}},
+		{"a // x\nb", strict, []string{`Identifier ("a")`, "Space", "Newline", `Identifier ("b")`, "EOF"}},
+		{"a /-b", strict, []string{`Identifier ("a")`, "Space", "IgnoreNode", `Identifier ("b")`, "EOF"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokensOpts(test.opts, test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q with %+v (-got+want):\n%s", test.in, test.opts, diff)
+		}
+	}
+
+	opts := ParseOptions{LexerOptions: strict}
+	if _, err := opts.Parse(strings.NewReader("node /* x */ 1")); err == nil {
+		t.Errorf("Parse with block comment succeeded, want error")
+	}
+}
+
+func TestNewlines(t *testing.T) {
+	ab := []string{`Identifier ("a")`, "Newline", `Identifier ("b")`, "EOF"}
+	lfErr := func(nl string) []string {
+		return []string{`Identifier ("a")`, `Err (newline "` + nl + `" not allowed, expected "\n")`}
+	}
+	crlfErr := func(nl string) []string {
+		return []string{`Identifier ("a")`, `Err (newline "` + nl + `" not allowed, expected "\r\n")`}
+	}
+	tests := []struct {
+		in   string
+		opts LexerOptions
+		want []string
+	}{
+		{"a\nb", LexerOptions{}, ab},
+		{"a\r\nb", LexerOptions{}, ab},
+		{"a\rb", LexerOptions{}, ab},
+
+		{"a\nb", LexerOptions{Newlines: LFNewlines}, ab},
+		{"a\r\nb", LexerOptions{Newlines: LFNewlines}, lfErr(`\r\n`)},
+		{"a\rb", LexerOptions{Newlines: LFNewlines}, lfErr(`\r`)},
+		{"a\u2028b", LexerOptions{Newlines: LFNewlines}, lfErr(`\u2028`)},
+
+		{"a\nb", LexerOptions{Newlines: CRLFNewlines}, crlfErr(`\n`)},
+		{"a\r\nb", LexerOptions{Newlines: CRLFNewlines}, ab},
+		{"a\rb", LexerOptions{Newlines: CRLFNewlines}, crlfErr(`\r`)},
+		{"a\r\rb", LexerOptions{Newlines: CRLFNewlines}, crlfErr(`\r`)},
+
+		{"a \\\r\nb", LexerOptions{Newlines: CRLFNewlines}, []string{`Identifier ("a")`, "Space", `Identifier ("b")`, "EOF"}},
+		{"a \\\nb", LexerOptions{Newlines: CRLFNewlines}, []string{`Identifier ("a")`, `Err (newline "\n" not allowed, expected "\r\n")`}},
+		{"a // c\rb", LexerOptions{Newlines: LFNewlines}, []string{`Identifier ("a")`, "Space", `Err (newline "\r" not allowed, expected "\n")`}},
+		{"\"\"\"\r\n  x\r\n  \"\"\"", LexerOptions{Newlines: CRLFNewlines}, []string{`String ("x")`, "EOF"}},
+		{"\"\"\"\r\n  x\n  \"\"\"", LexerOptions{Newlines: CRLFNewlines}, []string{`Err (newline "\n" not allowed, expected "\r\n")`}},
+		{"\"\"\"\r\n  x\r\n  \"\"\"", LexerOptions{Newlines: LFNewlines}, []string{`Err (newline "\r\n" not allowed, expected "\n")`}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokensOpts(test.opts, test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q with %+v (-got+want):\n%s", test.in, test.opts, diff)
+		}
+	}
+}
+
+func TestUnclosedBlockComment(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"/* /* */", []string{"Err (unexpected EOF, unclosed /* opened at line 1 col 1 (nesting depth 1))"}},
+		{"a\n  /* /* /*", []string{`Identifier ("a")`, "Newline", "Err (unexpected EOF, unclosed /* opened at line 2 col 3 (nesting depth 3))"}},
+		{"/* x", []string{"Err (unexpected EOF, unclosed /* opened at line 1 col 1 (nesting depth 1))"}},
+		{"/* /* */ */", []string{"Space", "EOF"}},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(lexTokens(test.in), test.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	tests := []struct {
+		in   string
+		opts LexerOptions
+		want SyntaxError
+	}{
+		{
+			in:   `a "b\q"`,
+			want: SyntaxError{Pos: Pos{Offset: 6, Line: 1, Column: 7}, Category: SyntaxBadEscape, Rune: 'q', Text: `"b\q`},
+		},
+		{
+			in:   `a "bc`,
+			want: SyntaxError{Pos: Pos{Offset: 5, Line: 1, Column: 6}, Category: SyntaxUnterminatedString, Rune: eof, Text: `"bc`},
+		},
+		{
+			in:   `a /* b`,
+			want: SyntaxError{Pos: Pos{Offset: 6, Line: 1, Column: 7}, Category: SyntaxUnterminatedComment, Rune: eof, Text: `/* b`},
+		},
+		{
+			in:   "a 0x",
+			want: SyntaxError{Pos: Pos{Offset: 4, Line: 1, Column: 5}, Category: SyntaxBadNumber, Rune: eof, Text: "0x"},
+		},
+		{
+			in:   "a #maybe",
+			want: SyntaxError{Pos: Pos{Offset: 8, Line: 1, Column: 9}, Category: SyntaxBadKeyword, Rune: eof, Text: "#maybe"},
+		},
+		{
+			in:   "a \\ b\n",
+			want: SyntaxError{Pos: Pos{Offset: 4, Line: 1, Column: 5}, Category: SyntaxBadLineContinuation, Rune: 'b', Text: " \\ "},
+		},
+		{
+			in:   "a\r\n",
+			opts: LexerOptions{Newlines: LFNewlines},
+			want: SyntaxError{Pos: Pos{Offset: 3, Line: 2, Column: 1}, Category: SyntaxBadNewline, Rune: '\n', Text: "\r\n"},
+		},
+		{
+			in:   "a \xff",
+			want: SyntaxError{Pos: Pos{Offset: 2, Line: 1, Column: 3}, Category: SyntaxBadUTF8, Rune: utf8.RuneError, Text: " "},
+		},
+	}
+	for _, test := range tests {
+		_, err := test.opts.Tokenize(strings.NewReader(test.in))
+		var got *SyntaxError
+		if !errors.As(err, &got) {
+			t.Errorf("Tokenize(%q) = %v, want a *SyntaxError", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(*got, test.want, cmpopts.IgnoreFields(SyntaxError{}, "Err")); diff != "" {
+			t.Errorf("Tokenize(%q) wrong error %q (-got+want):\n%s", test.in, got, diff)
+		}
+	}
+
+	_, err := ParseString(`a "b`)
+	var serr *SyntaxError
+	if !errors.As(err, &serr) || serr.Category != SyntaxUnterminatedString {
+		t.Errorf("Parse error = %v, want a SyntaxUnterminatedString *SyntaxError", err)
+	}
+	if got, want := err.Error(), "1:5: EOF during string"; got != want {
+		t.Errorf("Parse error = %q, want %q", got, want)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	sentinels := []error{ErrUnexpectedEOF, ErrInvalidEscape, ErrInvalidNumber}
+	tests := []struct {
+		in   string
+		want []error
+	}{
+		{`a "bc`, []error{ErrUnexpectedEOF}},
+		{`a #"bc`, []error{ErrUnexpectedEOF}},
+		{"a /* b", []error{ErrUnexpectedEOF}},
+		{"a \\", []error{ErrUnexpectedEOF}},
+		{"a {\nb", []error{ErrUnexpectedEOF}},
+		{"a b=", []error{ErrUnexpectedEOF}},
+		{"(t)", []error{ErrUnexpectedEOF}},
+		{`a "b\q"`, []error{ErrInvalidEscape}},
+		{`a "b\u{zz}"`, []error{ErrInvalidEscape}},
+		{`a "b\`, []error{ErrUnexpectedEOF, ErrInvalidEscape}},
+		{"a 0x", []error{ErrInvalidNumber}},
+		{"a 1.", []error{ErrInvalidNumber}},
+		{"a 1e+", []error{ErrInvalidNumber}},
+
+		{"a #maybe", nil},
+		{"a \\ b\n", nil},
+		{"}", nil},
+	}
+	for _, test := range tests {
+		_, err := ParseString(test.in)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", test.in)
+			continue
+		}
+		for _, sentinel := range sentinels {
+			want := false
+			for _, w := range test.want {
+				want = want || w == sentinel
+			}
+			if got := errors.Is(err, sentinel); got != want {
+				t.Errorf("errors.Is(Parse(%q) = %q, %q) = %v, want %v", test.in, err, sentinel, got, want)
+			}
+		}
+	}
+}
+
+func TestLenientEscapes(t *testing.T) {
+	const in = `node "a\qb" "c\u{zz}d" "e\u{12"`
+
+	_, err := Tokenize(strings.NewReader(in))
+	var serr *SyntaxError
+	if !errors.As(err, &serr) || serr.Category != SyntaxBadEscape {
+		t.Fatalf("strict Tokenize error = %v, want a bad escape", err)
+	}
+	if got, want := err.Error(), `1:10: unknown escape sequence \q`; got != want {
+		t.Errorf("strict Tokenize error = %q, want %q", got, want)
+	}
+
+	toks, err := LexerOptions{LenientEscapes: true}.Tokenize(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("lenient Tokenize failed: %v", err)
+	}
+	type diag struct {
+		Pos  Pos
+		Text string
+	}
+	var strs []string
+	var diags []diag
+	for _, tok := range toks {
+		if tok.Type != TokenString {
+			continue
+		}
+		strs = append(strs, tok.Value)
+		for _, d := range tok.Diagnostics {
+			diags = append(diags, diag{d.Pos, d.Text})
+		}
+	}
+	if diff := cmp.Diff(strs, []string{`a\qb`, `c\u{zz}d`, `e\u{12`}); diff != "" {
+		t.Errorf("wrong strings (-got+want):\n%s", diff)
+	}
+	wantDiags := []diag{
+		{Pos{7, 1, 8}, `\q`},
+		{Pos{14, 1, 15}, `\u{z`},
+		{Pos{25, 1, 26}, `\u{12`},
+	}
+	if diff := cmp.Diff(diags, wantDiags); diff != "" {
+		t.Errorf("wrong diagnostics (-got+want):\n%s", diff)
+	}
+
+	doc, errs := ParseOptions{LexerOptions: LexerOptions{LenientEscapes: true}}.ParseAll(strings.NewReader(`a "x\qy"` + "\nb 1\n"))
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	if diff := cmp.Diff(got, []string{`1:5: unknown escape sequence \q`}); diff != "" {
+		t.Errorf("wrong ParseAll errors (-got+want):\n%s", diff)
+	}
+	if len(doc.Nodes) != 2 {
+		t.Errorf("ParseAll returned %d nodes, want 2", len(doc.Nodes))
+	}
+}
+
+func TestPeekN(t *testing.T) {
+	// Drive the lexer's rune buffer directly, without its goroutine.
+	l := &lexer{
+		r:   &byteRuneReader{r: iotest.OneByteReader(strings.NewReader("ab€d"))},
+		cur: cursor{Pos: Pos{Line: 1, Column: 1}},
+	}
+	peek := func(n int, want string) {
+		t.Helper()
+		if got := string(l.peekN(n)); got != want {
+			t.Errorf("peekN(%d) = %q, want %q", n, got, want)
+		}
+	}
+	next := func(want rune) {
+		t.Helper()
+		if got := l.next(); got != want {
+			t.Errorf("next() = %q, want %q", got, want)
+		}
+	}
+
+	// Nothing buffered yet.
+	peek(2, "ab")
+	next('a')
+	// Partly from the buffer, partly from the reader.
+	peek(3, "b€d")
+	// Entirely from the buffer.
+	peek(1, "b")
+	next('b')
+	next('€')
+	l.backup()
+	// Past the end of the input.
+	peek(5, "€d")
+	next('€')
+	next('d')
+	next(eof)
+	peek(2, "")
+	next(eof)
+	// Backing up over EOF does nothing, backing up again un-reads the
+	// last rune.
+	l.backup()
+	l.backup()
+	peek(3, "d")
+	if got, want := string(l.rs), "ab€"; got != want {
+		t.Errorf("consumed %q, want %q", got, want)
+	}
+	if want := (Pos{Offset: 5, Line: 1, Column: 4}); l.cur.Pos != want {
+		t.Errorf("position %#v, want %#v", l.cur.Pos, want)
+	}
+}
+
+func TestRawStringLookahead(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`r"a"`, []string{`String ("a")`, "EOF"}},
+		{`r##"a"#"##`, []string{`String ("a\"#")`, "EOF"}},
+		// Not followed by a dquote after the hashes, so not a raw
+		// string.
+		{`r#a`, []string{`Identifier ("r#a")`, "EOF"}},
+		{`r##`, []string{`Identifier ("r##")`, "EOF"}},
+		{`raw`, []string{`Identifier ("raw")`, "EOF"}},
+	}
+	for _, tc := range tests {
+		var got []string
+		for tok := range NewLexer(strings.NewReader(tc.in)).All() {
+			got = append(got, tok.String())
+		}
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("wrong tokens for %q (-got+want):\n%s", tc.in, diff)
+		}
+	}
+}
+
+func TestRawText(t *testing.T) {
+	type tok struct {
+		Type       TokenType
+		Value, Raw string
+	}
+	lexRaw := func(opts LexerOptions, in string) []tok {
+		opts.RawText = true
+		var ret []tok
+		for t := range opts.NewLexer(strings.NewReader(in)).All() {
+			ret = append(ret, tok{t.Type, t.Value, t.Raw})
+		}
+		return ret
+	}
+
+	got := lexRaw(LexerOptions{}, `a "a\nb" #"c\d"# 0x1_f #true`)
+	want := []tok{
+		{TokenIdentifier, "a", "a"},
+		{TokenSpace, "", " "},
+		{TokenString, "a\nb", `"a\nb"`},
+		{TokenSpace, "", " "},
+		{TokenString, `c\d`, `#"c\d"#`},
+		{TokenSpace, "", " "},
+		{TokenInt, "0x1_f", "0x1_f"},
+		{TokenSpace, "", " "},
+		{TokenBool, "true", "#true"},
+		{TokenEOF, "", ""},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong tokens (-got+want):\n%s", diff)
+	}
+
+	// Block comments that aren't kept are part of the whitespace
+	// around them, in a single TokenSpace.
+	got = lexRaw(LexerOptions{}, "a /* x */ b \\\n  c  ")
+	want = []tok{
+		{TokenIdentifier, "a", "a"},
+		{TokenSpace, "", " /* x */ "},
+		{TokenIdentifier, "b", "b"},
+		{TokenSpace, "", " \\\n  "},
+		{TokenIdentifier, "c", "c"},
+		{TokenSpace, "", "  "},
+		{TokenEOF, "", ""},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong tokens with merged whitespace (-got+want):\n%s", diff)
+	}
+
+	// Comments that aren't kept, and whitespace merged into an
+	// earlier TokenSpace, aren't part of the next token.
+	got = lexRaw(LexerOptions{}, "a // x\nb")
+	want = []tok{
+		{TokenIdentifier, "a", "a"},
+		{TokenSpace, "", " "},
+		{TokenNewline, "", "\n"},
+		{TokenIdentifier, "b", "b"},
+		{TokenEOF, "", ""},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong tokens with a line comment (-got+want):\n%s", diff)
+	}
+	got = lexRaw(LexerOptions{Comments: true}, "a /* x */ b")
+	want = []tok{
+		{TokenIdentifier, "a", "a"},
+		{TokenSpace, "", " "},
+		{TokenComment, "/* x */", "/* x */"},
+		{TokenIdentifier, "b", "b"},
+		{TokenEOF, "", ""},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong tokens with a kept block comment (-got+want):\n%s", diff)
+	}
+
+	// Without RawText, tokens carry no raw text.
+	for tok := range NewLexer(strings.NewReader(`a "a\nb"`)).All() {
+		if tok.Raw != "" {
+			t.Errorf("token %v has Raw %q without RawText", tok, tok.Raw)
+		}
+	}
+
+	// Each token's raw text is its source text, and RawText doesn't
+	// change the tokens otherwise, with or without comments.
+	ms, err := filepath.Glob("testdata/valid/*.kdl")
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	for _, n := range append(ms, "testdata/format/messy.kdl") {
+		bs, err := os.ReadFile(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, opts := range []LexerOptions{{}, {Comments: true}} {
+			var plain []Token
+			for tok := range opts.NewLexerBytes(bs).All() {
+				plain = append(plain, tok)
+			}
+			opts.RawText = true
+			var i int
+			for tok := range opts.NewLexerBytes(bs).All() {
+				if tok.Type != TokenErr {
+					if want := string(bs[tok.Pos.Offset:tok.End.Offset]); tok.Raw != want {
+						t.Errorf("%s with %+v: token %v has Raw %q, want %q", n, opts, tok, tok.Raw, want)
+					}
+				}
+				tok.Raw = ""
+				if i < len(plain) && !reflect.DeepEqual(tok, plain[i]) {
+					t.Errorf("%s with %+v: token %d is %v with RawText, want %v", n, opts, i, tok, plain[i])
+				}
+				i++
+			}
+			if i != len(plain) {
+				t.Errorf("%s with %+v: got %d tokens with RawText, want %d", n, opts, i, len(plain))
+			}
+		}
+	}
+}
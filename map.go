@@ -0,0 +1,107 @@
+package kdl
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ToMap converts doc to a tree of Go maps, slices and values, for
+// callers that want a dynamic view of a document rather than a
+// struct to unmarshal into. Unmarshal into an interface{} produces
+// the same tree.
+//
+// The result maps each node name to a []interface{} of the nodes with
+// that name, in document order, so that repeated names such as
+// several "server" nodes keep all their nodes. Each node is a
+// map[string]interface{} with the following keys, each present only
+// if the node has that part:
+//
+//	"type"      string                  the node's type annotation
+//	"args"      []interface{}           the node's arguments
+//	"props"     map[string]interface{}  the node's properties, the last value winning
+//	"children"  map[string]interface{}  the node's children, in the same form as the result
+//
+// A node with both arguments and children has both "args" and
+// "children", and a node with nothing but a name is an empty map.
+//
+// Values are represented like Unmarshal decodes them into an
+// interface{}: nil, string, bool, int64 or float64, *big.Int and
+// *big.Float for numbers too large or precise for those, and the
+// matching Go type for numbers with a numeric type annotation, such
+// as uint8 for (u8)5. A value that doesn't fit its annotation, such
+// as (u8)300, is represented as if it had none, where Unmarshal would
+// fail. Comments are dropped. A nil doc is an empty map.
+func ToMap(doc *Document) map[string]interface{} {
+	if doc == nil {
+		return map[string]interface{}{}
+	}
+	ret, _ := UnmarshalOptions{}.nodesToMap(doc.Nodes, true)
+	return ret
+}
+
+// nodesToMap returns nodes in the form documented by ToMap, decoding
+// values with o. If lenient, values that fail to decode are
+// represented as if they had no type annotation, rather than failing.
+func (o UnmarshalOptions) nodesToMap(nodes []*Node, lenient bool) (map[string]interface{}, error) {
+	ret := map[string]interface{}{}
+	for _, n := range nodes {
+		m, err := o.nodeToMap(n, lenient)
+		if err != nil {
+			return nil, err
+		}
+		l, _ := ret[n.Name].([]interface{})
+		ret[n.Name] = append(l, m)
+	}
+	return ret, nil
+}
+
+func (o UnmarshalOptions) nodeToMap(n *Node, lenient bool) (map[string]interface{}, error) {
+	ret := map[string]interface{}{}
+	if n.TypeAnnotation != "" {
+		ret["type"] = n.TypeAnnotation
+	}
+	if len(n.Args) > 0 {
+		args := make([]interface{}, len(n.Args))
+		for i, v := range n.Args {
+			x, err := o.dynamicValue(v, lenient)
+			if err != nil {
+				return nil, fmt.Errorf("node %q: %w", n.Name, err)
+			}
+			args[i] = x
+		}
+		ret["args"] = args
+	}
+	if len(n.Props) > 0 {
+		props := map[string]interface{}{}
+		for _, p := range n.Props {
+			x, err := o.dynamicValue(p.Value, lenient)
+			if err != nil {
+				return nil, fmt.Errorf("node %q: property %q: %w", n.Name, p.Key, err)
+			}
+			props[p.Key] = x
+		}
+		ret["props"] = props
+	}
+	if len(n.Children) > 0 {
+		children, err := o.nodesToMap(n.Children, lenient)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", n.Name, err)
+		}
+		ret["children"] = children
+	}
+	return ret, nil
+}
+
+// dynamicValue returns v as Unmarshal decodes it into an interface{}.
+// If lenient and that fails, it returns v as if it had no type
+// annotation.
+func (o UnmarshalOptions) dynamicValue(v Value, lenient bool) (interface{}, error) {
+	var x interface{}
+	if err := o.unmarshalValue(v, reflect.ValueOf(&x).Elem()); err != nil {
+		if lenient {
+			return v.native(), nil
+		}
+		return nil, err
+	}
+	return x, nil
+}
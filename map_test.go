@@ -0,0 +1,70 @@
+package kdl
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestToMap(t *testing.T) {
+	type m = map[string]interface{}
+	type l = []interface{}
+	tests := []struct {
+		in   string
+		want m
+	}{
+		{"", m{}},
+		{"empty", m{"empty": l{m{}}}},
+		{
+			`title "KDL" 1.5 true null 0x10`,
+			m{"title": l{m{"args": l{"KDL", 1.5, true, nil, int64(16)}}}},
+		},
+		{
+			`server "web" port=80 port=8080 tls=true; server "db"`,
+			m{"server": l{
+				m{"args": l{"web"}, "props": m{"port": int64(8080), "tls": true}},
+				m{"args": l{"db"}},
+			}},
+		},
+		{
+			`(pkg)package "app" {
+				dep "json" version="1.2"
+				dep "http"
+				(u8)answer (u8)42
+			}`,
+			m{"package": l{m{
+				"type": "pkg",
+				"args": l{"app"},
+				"children": m{
+					"dep": l{
+						m{"args": l{"json"}, "props": m{"version": "1.2"}},
+						m{"args": l{"http"}},
+					},
+					"answer": l{m{"type": "u8", "args": l{uint8(42)}}},
+				},
+			}}},
+		},
+		{
+			// Too big for its annotation, so kept as if it had none.
+			"n (u8)300 (f32)1.5 x=(i8)-1",
+			m{"n": l{m{"args": l{int64(300), float32(1.5)}, "props": m{"x": int8(-1)}}}},
+		},
+		{
+			"big 123456789012345678901234567890",
+			m{"big": l{m{"args": l{mustBigInt("123456789012345678901234567890")}}}},
+		},
+	}
+	for _, test := range tests {
+		doc, err := ParseString(test.in)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", test.in, err)
+		}
+		if diff := cmp.Diff(ToMap(doc), test.want, cmpValues); diff != "" {
+			t.Errorf("wrong map for %q (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	if got := ToMap(nil); got == nil || len(got) != 0 {
+		t.Errorf("ToMap(nil) = %#v, want an empty map", got)
+	}
+}
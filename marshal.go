@@ -0,0 +1,309 @@
+package kdl
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Marshaler is the interface implemented by types that can marshal
+// themselves into a KDL value. A nil Value encodes as null.
+type Marshaler interface {
+	MarshalKDL() (*Value, error)
+}
+
+// Unmarshaler is the interface implemented by types that can
+// unmarshal a KDL value of themselves.
+type Unmarshaler interface {
+	UnmarshalKDL(*Value) error
+}
+
+// Marshal returns the KDL encoding of v, which must be a struct or a
+// pointer to a struct.
+//
+// Each exported struct field becomes a child node, a property or an
+// argument, according to its "kdl" struct tag:
+//
+//	Field int `kdl:"name"`        // child node "name"
+//	Field int `kdl:"name,prop"`   // property name=...
+//	Field int `kdl:",arg"`        // the next positional argument
+//	Field []int `kdl:",args"`     // all remaining arguments
+//	Field int `kdl:"-"`           // ignored
+//
+// Fields with no tag become child nodes named after the field. The
+// option "omitempty" skips fields that have their type's zero value.
+//
+// A child node field that is a struct encodes as a node with the
+// struct's fields as its contents. A slice of structs encodes as one
+// node per element. Any other type encodes as a node with a single
+// argument. Types that implement Marshaler always encode as a single
+// argument, using their MarshalKDL method. A time.Time encodes as a
+// (date-time) annotated RFC 3339 string.
+func Marshal(v interface{}) ([]byte, error) {
+	return marshal(v, EncoderOptions{})
+}
+
+// MarshalIndent is like Marshal, but writes indent once per level of
+// nesting before each node in a children block, as
+// EncoderOptions.Indent does. An empty indent means four spaces.
+func MarshalIndent(v interface{}, indent string) ([]byte, error) {
+	return marshal(v, EncoderOptions{Indent: indent})
+}
+
+func marshal(v interface{}, opts EncoderOptions) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot marshal %T, want a struct or pointer to struct", v)
+	}
+
+	var n Node
+	if err := marshalStruct(rv, &n); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := opts.NewEncoder(&b).Encode(&Document{Nodes: n.Children}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// marshalStruct encodes the fields of struct rv into n's arguments,
+// properties and children.
+func marshalStruct(rv reflect.Value, n *Node) error {
+	for _, f := range structFields(rv.Type()) {
+		fv := rv.Field(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		switch f.kind {
+		case fieldArg:
+			v, err := marshalValue(fv)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", f.goName, err)
+			}
+			n.Args = append(n.Args, v)
+		case fieldArgs:
+			if fv.Kind() != reflect.Slice && fv.Kind() != reflect.Array {
+				return fmt.Errorf("field %s: args field must be a slice, not %s", f.goName, fv.Type())
+			}
+			for i := 0; i < fv.Len(); i++ {
+				v, err := marshalValue(fv.Index(i))
+				if err != nil {
+					return fmt.Errorf("field %s: %w", f.goName, err)
+				}
+				n.Args = append(n.Args, v)
+			}
+		case fieldProp:
+			v, err := marshalValue(fv)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", f.goName, err)
+			}
+			n.Props = append(n.Props, Prop{Key: f.name, Value: v})
+		case fieldChild:
+			if err := marshalChild(f.name, fv, n); err != nil {
+				return fmt.Errorf("field %s: %w", f.goName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// marshalChild encodes rv as zero or more child nodes of parent.
+func marshalChild(name string, rv reflect.Value, parent *Node) error {
+	for !isMarshaler(rv) && (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if isMarshaler(rv) {
+		v, err := marshalValue(rv)
+		if err != nil {
+			return err
+		}
+		parent.Children = append(parent.Children, &Node{Name: name, Args: []Value{v}})
+		return nil
+	}
+	if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+		for i := 0; i < rv.Len(); i++ {
+			if err := marshalChild(name, rv.Index(i), parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	n := &Node{Name: name}
+	if rv.Kind() == reflect.Struct && !isScalarStruct(rv.Type()) {
+		if err := marshalStruct(rv, n); err != nil {
+			return err
+		}
+	} else {
+		v, err := marshalValue(rv)
+		if err != nil {
+			return err
+		}
+		n.Args = []Value{v}
+	}
+	parent.Children = append(parent.Children, n)
+	return nil
+}
+
+// marshalValue encodes rv as a single KDL value.
+func marshalValue(rv reflect.Value) (Value, error) {
+	for !isMarshaler(rv) && (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return NullValue(), nil
+		}
+		rv = rv.Elem()
+	}
+	if isMarshaler(rv) {
+		if rv.Kind() != reflect.Ptr && rv.CanAddr() {
+			rv = rv.Addr()
+		}
+		v, err := rv.Interface().(Marshaler).MarshalKDL()
+		if err != nil {
+			return Value{}, err
+		}
+		if v == nil {
+			return NullValue(), nil
+		}
+		return *v, nil
+	}
+	switch rv.Type() {
+	case valueType:
+		return rv.Interface().(Value), nil
+	case bigIntType:
+		bi := rv.Interface().(big.Int)
+		return BigIntValue(&bi), nil
+	case bigFloatType:
+		bf := rv.Interface().(big.Float)
+		return BigFloatValue(&bf), nil
+	case timeType:
+		v := StringValue(rv.Interface().(time.Time).Format(time.RFC3339Nano))
+		v.TypeAnnotation = "date-time"
+		return v, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		return StringValue(rv.String()), nil
+	case reflect.Bool:
+		return BoolValue(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return IntValue(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return BigIntValue(new(big.Int).SetUint64(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return FloatValue(rv.Float()), nil
+	default:
+		return Value{}, fmt.Errorf("cannot marshal %s as a KDL value", rv.Type())
+	}
+}
+
+var (
+	valueType       = reflect.TypeOf(Value{})
+	bigIntType      = reflect.TypeOf(big.Int{})
+	bigFloatType    = reflect.TypeOf(big.Float{})
+	timeType        = reflect.TypeOf(time.Time{})
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+	emptyInterfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// isScalarStruct reports whether t is a struct type that encodes as
+// a single value, rather than as a node.
+func isScalarStruct(t reflect.Type) bool {
+	return t == valueType || t == bigIntType || t == bigFloatType || t == timeType
+}
+
+// isMarshaler reports whether rv, or a pointer to it, implements
+// Marshaler. Nil pointers don't count, so that they encode as null.
+func isMarshaler(rv reflect.Value) bool {
+	switch {
+	case (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) && rv.IsNil():
+		return false
+	case rv.Type().Implements(marshalerType):
+		return true
+	default:
+		return rv.CanAddr() && reflect.PtrTo(rv.Type()).Implements(marshalerType)
+	}
+}
+
+// isUnmarshaler reports whether a pointer to rv implements
+// Unmarshaler.
+func isUnmarshaler(rv reflect.Value) bool {
+	return rv.CanAddr() && reflect.PtrTo(rv.Type()).Implements(unmarshalerType)
+}
+
+type fieldKind int
+
+const (
+	fieldChild fieldKind = iota
+	fieldProp
+	fieldArg
+	fieldArgs
+)
+
+// field describes how a struct field maps to KDL.
+type field struct {
+	name      string // KDL node or property name
+	goName    string // Go field name, for errors
+	index     int
+	kind      fieldKind
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// structFields returns the KDL mapping of struct type t's fields.
+func structFields(t reflect.Type) []field {
+	if fs, ok := fieldCache.Load(t); ok {
+		return fs.([]field)
+	}
+
+	var ret []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		tag := sf.Tag.Get("kdl")
+		if tag == "-" {
+			continue
+		}
+		f := field{
+			goName: sf.Name,
+			index:  i,
+		}
+		opts := strings.Split(tag, ",")
+		f.name = opts[0]
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "prop":
+				f.kind = fieldProp
+			case "arg":
+				f.kind = fieldArg
+			case "args":
+				f.kind = fieldArgs
+			case "omitempty":
+				f.omitEmpty = true
+			}
+		}
+		ret = append(ret, f)
+	}
+
+	fs, _ := fieldCache.LoadOrStore(t, ret)
+	return fs.([]field)
+}
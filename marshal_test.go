@@ -0,0 +1,663 @@
+package kdl
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type testServer struct {
+	Name    string   `kdl:",arg"`
+	Aliases []string `kdl:",args"`
+	Port    int      `kdl:"port,prop"`
+	TLS     bool     `kdl:"tls,prop,omitempty"`
+	Weight  float64  `kdl:"weight"`
+	Tags    []testTag
+}
+
+type testTag struct {
+	Key   string `kdl:",arg"`
+	Value string `kdl:",arg"`
+}
+
+type testConfig struct {
+	Title   string        `kdl:"title"`
+	Debug   *bool         `kdl:"debug"`
+	Servers []*testServer `kdl:"server"`
+	Owner   struct {
+		Name string `kdl:"name,prop"`
+	} `kdl:"owner"`
+	Ignored string `kdl:"-"`
+	Extra   Value  `kdl:"extra"`
+}
+
+const testConfigKDL = `title "example"
+debug #true
+server "alpha" "a" "first" port=80 tls=#true {
+    weight 1.5
+    Tags "env" "prod"
+    Tags "team" "web"
+}
+server "beta" port=8080 {
+    weight 0.5
+}
+owner name="ann"
+extra #null
+`
+
+func TestUnmarshal(t *testing.T) {
+	var got testConfig
+	if err := Unmarshal([]byte(testConfigKDL), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	debug := true
+	want := testConfig{
+		Title: "example",
+		Debug: &debug,
+		Servers: []*testServer{
+			{
+				Name:    "alpha",
+				Aliases: []string{"a", "first"},
+				Port:    80,
+				TLS:     true,
+				Weight:  1.5,
+				Tags: []testTag{
+					{"env", "prod"},
+					{"team", "web"},
+				},
+			},
+			{
+				Name:   "beta",
+				Port:   8080,
+				Weight: 0.5,
+			},
+		},
+	}
+	want.Owner.Name = "ann"
+	if diff := cmp.Diff(got, want, cmpValues); diff != "" {
+		t.Errorf("wrong Unmarshal result (-got+want):\n%s", diff)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	var cfg testConfig
+	if err := Unmarshal([]byte(testConfigKDL), &cfg); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	cfg.Ignored = "not in output"
+	got, err := Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if diff := cmp.Diff(strings.Split(string(got), "\n"), strings.Split(testConfigKDL, "\n")); diff != "" {
+		t.Errorf("wrong Marshal result (-got+want):\n%s", diff)
+	}
+}
+
+func TestMarshalIndent(t *testing.T) {
+	var cfg testConfig
+	if err := Unmarshal([]byte(testConfigKDL), &cfg); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	got, err := MarshalIndent(cfg, "\t")
+	if err != nil {
+		t.Fatalf("MarshalIndent failed: %v", err)
+	}
+	want := strings.ReplaceAll(testConfigKDL, "    ", "\t")
+	if diff := cmp.Diff(strings.Split(string(got), "\n"), strings.Split(want, "\n")); diff != "" {
+		t.Errorf("wrong MarshalIndent result (-got+want):\n%s", diff)
+	}
+
+	// Empty means the default indent, as for Marshal.
+	got, err = MarshalIndent(cfg, "")
+	if err != nil {
+		t.Fatalf("MarshalIndent failed: %v", err)
+	}
+	if diff := cmp.Diff(strings.Split(string(got), "\n"), strings.Split(testConfigKDL, "\n")); diff != "" {
+		t.Errorf("wrong MarshalIndent result with empty indent (-got+want):\n%s", diff)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	type small struct {
+		Port uint8  `kdl:"port"`
+		Name string `kdl:"name"`
+	}
+	tests := []struct {
+		in   string
+		opts UnmarshalOptions
+		want string
+	}{
+		{"port 256", UnmarshalOptions{}, "overflows uint8"},
+		{"port -1", UnmarshalOptions{}, "overflows uint8"},
+		{`port "80"`, UnmarshalOptions{}, "cannot decode String value into uint8"},
+		{"name", UnmarshalOptions{}, "need exactly one argument"},
+		{`name "a" "b"`, UnmarshalOptions{}, "need exactly one argument"},
+		{"other 1", UnmarshalOptions{DisallowUnknownNodes: true}, `unknown node "other"`},
+		{"port {", UnmarshalOptions{}, "unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		var v small
+		err := test.opts.Unmarshal([]byte(test.in), &v)
+		if err == nil {
+			t.Errorf("Unmarshal(%q) succeeded, want error", test.in)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Unmarshal(%q) = %q, want error containing %q", test.in, err, test.want)
+		}
+	}
+
+	var v small
+	if err := Unmarshal([]byte("other 1\nport 1"), &v); err != nil {
+		t.Errorf("Unmarshal with unknown node failed: %v", err)
+	} else if v.Port != 1 {
+		t.Errorf("Unmarshal with unknown node got port %d, want 1", v.Port)
+	}
+
+	if err := Unmarshal([]byte("port 1"), v); err == nil {
+		t.Errorf("Unmarshal into non-pointer succeeded, want error")
+	}
+}
+
+// testLevel is a custom enum that encodes as a string.
+type testLevel int
+
+func (l testLevel) MarshalKDL() (*Value, error) {
+	switch l {
+	case 0:
+		return nil, nil
+	case 1:
+		v := StringValue("low")
+		return &v, nil
+	case 2:
+		v := StringValue("high")
+		return &v, nil
+	default:
+		return nil, fmt.Errorf("bad level %d", int(l))
+	}
+}
+
+func (l *testLevel) UnmarshalKDL(v *Value) error {
+	switch s, _ := v.AsString(); s {
+	case "low":
+		*l = 1
+	case "high":
+		*l = 2
+	default:
+		return fmt.Errorf("bad level %s", v.Kind())
+	}
+	return nil
+}
+
+// testPoint is a struct that encodes as a single "x,y" string,
+// rather than as a node with fields.
+type testPoint struct{ X, Y int }
+
+func (p testPoint) MarshalKDL() (*Value, error) {
+	v := StringValue(fmt.Sprintf("%d,%d", p.X, p.Y))
+	return &v, nil
+}
+
+func (p *testPoint) UnmarshalKDL(v *Value) error {
+	s, _ := v.AsString()
+	_, err := fmt.Sscanf(s, "%d,%d", &p.X, &p.Y)
+	return err
+}
+
+func TestMarshaler(t *testing.T) {
+	type server struct {
+		Levels []testLevel `kdl:",args"`
+		Prop   *testLevel  `kdl:"prop,prop"`
+	}
+	type config struct {
+		Level  testLevel   `kdl:"level"`
+		Unset  testLevel   `kdl:"unset"`
+		Server server      `kdl:"server"`
+		Origin testPoint   `kdl:"origin"`
+		Path   []testPoint `kdl:"path"`
+	}
+
+	high := testLevel(2)
+	in := config{
+		Level:  1,
+		Server: server{Levels: []testLevel{2, 1}, Prop: &high},
+		Origin: testPoint{1, 2},
+		Path:   []testPoint{{3, 4}, {5, 6}},
+	}
+	const want = `level "low"
+unset #null
+server "high" "low" prop="high"
+origin "1,2"
+path "3,4"
+path "5,6"
+`
+	got, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if diff := cmp.Diff(string(got), want); diff != "" {
+		t.Errorf("wrong Marshal result (-got+want):\n%s", diff)
+	}
+
+	var back config
+	if err := Unmarshal([]byte(`level "low"
+server "high" "low" prop="high"
+origin "1,2"
+path "3,4"
+path "5,6"
+`), &back); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if diff := cmp.Diff(back, in); diff != "" {
+		t.Errorf("wrong Unmarshal result (-got+want):\n%s", diff)
+	}
+
+	if _, err := Marshal(config{Level: 3}); err == nil || !strings.Contains(err.Error(), "bad level 3") {
+		t.Errorf("Marshal with bad level = %v, want error from MarshalKDL", err)
+	}
+	if err := Unmarshal([]byte("level 1"), &back); err == nil || !strings.Contains(err.Error(), "bad level Int") {
+		t.Errorf("Unmarshal with bad level = %v, want error from UnmarshalKDL", err)
+	}
+}
+
+func TestUnmarshalAnnotations(t *testing.T) {
+	type target struct {
+		I   int         `kdl:"i"`
+		I32 int32       `kdl:"i32"`
+		U8  uint8       `kdl:"u8"`
+		F   float64     `kdl:"f"`
+		Any interface{} `kdl:"any"`
+	}
+
+	tests := []struct {
+		in      string
+		want    target
+		wantErr string
+	}{
+		{in: "i (u8)255", want: target{I: 255}},
+		{in: "i (i8)-128", want: target{I: -128}},
+		{in: "i32 (i32)2147483647", want: target{I32: 2147483647}},
+		{in: "u8 (u8)0", want: target{U8: 0}},
+		{in: "f (f32)1.5", want: target{F: 1.5}},
+		{in: "f (f64)2", want: target{F: 2}},
+		{in: "any (u8)7", want: target{Any: uint8(7)}},
+		{in: "any (f32)0.5", want: target{Any: float32(0.5)}},
+		{in: `any (date)"2021-01-01"`, want: target{Any: "2021-01-01"}},
+		{in: "i (custom)300", want: target{I: 300}},
+
+		{in: "u8 (u8)300", wantErr: "integer 300 overflows (u8)"},
+		{in: "i (u8)300", wantErr: "integer 300 overflows (u8)"},
+		{in: "i (u16)-1", wantErr: "integer -1 overflows (u16)"},
+		{in: "i32 (i32)2147483648", wantErr: "integer 2147483648 overflows (i32)"},
+		{in: "i32 (i64)2147483648", wantErr: "integer 2147483648 overflows int32"},
+		{in: "f (f32)1e39", wantErr: "overflows (f32)"},
+		{in: "any (i8)200", wantErr: "integer 200 overflows (i8)"},
+		{in: "i (f32)1.5", wantErr: "cannot decode (f32) value into int"},
+		{in: "i (f64)1", wantErr: "cannot decode (f64) value into int"},
+		{in: "i (i32)1.5", wantErr: "(i32) annotation on Float value"},
+		{in: `i (u8)"1"`, wantErr: "(u8) annotation on String value"},
+	}
+
+	for _, test := range tests {
+		var got target
+		err := Unmarshal([]byte(test.in), &got)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Unmarshal(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unmarshal(%q) failed: %v", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(got, test.want); diff != "" {
+			t.Errorf("Unmarshal(%q) wrong result (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestUnmarshalScalarSlices(t *testing.T) {
+	type target struct {
+		Colors []string      `kdl:"colors"`
+		Ports  []int         `kdl:"ports"`
+		Mixed  []interface{} `kdl:"mixed"`
+		Levels []*testLevel  `kdl:"levels"`
+	}
+	low, high := testLevel(1), testLevel(2)
+
+	tests := []struct {
+		in      string
+		want    target
+		wantErr string
+	}{
+		{in: `colors "red" "green" "blue"`, want: target{Colors: []string{"red", "green", "blue"}}},
+		{in: "ports 80 443", want: target{Ports: []int{80, 443}}},
+		{in: `mixed "a" 1 2.5 true null`, want: target{Mixed: []interface{}{"a", int64(1), 2.5, true, nil}}},
+		{in: `levels "low" "high"`, want: target{Levels: []*testLevel{&low, &high}}},
+		// Repeated nodes append to the same slice.
+		{in: "ports 1 2\nports 3", want: target{Ports: []int{1, 2, 3}}},
+		{in: "ports", want: target{}},
+
+		{in: `ports 1 "2"`, wantErr: `node "ports": cannot decode String value into int`},
+	}
+
+	for _, test := range tests {
+		var got target
+		err := Unmarshal([]byte(test.in), &got)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Unmarshal(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unmarshal(%q) failed: %v", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(got, test.want); diff != "" {
+			t.Errorf("Unmarshal(%q) wrong result (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestUnmarshalInterface(t *testing.T) {
+	const in = `
+server "web" port=8080 {
+    (u8)weight 3
+    tls #true
+    tags "a" "b"
+}
+server "db" primary=#null
+`
+	var got interface{}
+	if err := Unmarshal([]byte(in), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	type m = map[string]interface{}
+	type l = []interface{}
+	want := m{"server": l{
+		m{
+			"args":  l{"web"},
+			"props": m{"port": int64(8080)},
+			"children": m{
+				"weight": l{m{"type": "u8", "args": l{int64(3)}}},
+				"tls":    l{m{"args": l{true}}},
+				"tags":   l{m{"args": l{"a", "b"}}},
+			},
+		},
+		m{"args": l{"db"}, "props": m{"primary": nil}},
+	}}
+	if diff := cmp.Diff(got, interface{}(want)); diff != "" {
+		t.Errorf("wrong result (-got+want):\n%s", diff)
+	}
+
+	// The tree is the one ToMap builds.
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if diff := cmp.Diff(got, interface{}(ToMap(doc))); diff != "" {
+		t.Errorf("Unmarshal and ToMap differ (-unmarshal+tomap):\n%s", diff)
+	}
+
+	// Values use the same rules as interface{} fields.
+	if err := Unmarshal([]byte("n (u8)1 (f32)1.5"), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	args := got.(m)["n"].(l)[0].(m)["args"]
+	if diff := cmp.Diff(args, l{uint8(1), float32(1.5)}); diff != "" {
+		t.Errorf("wrong annotated args (-got+want):\n%s", diff)
+	}
+	if err := Unmarshal([]byte("n (u8)256"), &got); err == nil {
+		t.Errorf("Unmarshal of out of range (u8) succeeded, want error")
+	}
+
+	var empty interface{}
+	if err := Unmarshal([]byte(""), &empty); err != nil {
+		t.Fatalf("Unmarshal of empty document failed: %v", err)
+	}
+	if diff := cmp.Diff(empty, interface{}(m{})); diff != "" {
+		t.Errorf("wrong result for empty document (-got+want):\n%s", diff)
+	}
+
+	var notEmpty fmt.Stringer
+	if err := Unmarshal([]byte(in), &notEmpty); err == nil {
+		t.Errorf("Unmarshal into *fmt.Stringer succeeded, want error")
+	}
+}
+
+func TestDecodeFile(t *testing.T) {
+	var got testConfig
+	if err := DecodeFile("testdata/unmarshal/config.kdl", &got); err != nil {
+		t.Fatalf("DecodeFile failed: %v", err)
+	}
+	debug := true
+	want := testConfig{
+		Title: "from a file",
+		Debug: &debug,
+		Servers: []*testServer{
+			{Name: "alpha", Port: 80, Weight: 1.5, Tags: []testTag{{"env", "prod"}}},
+		},
+	}
+	want.Owner.Name = "ann"
+	if diff := cmp.Diff(got, want, cmpValues); diff != "" {
+		t.Errorf("wrong result (-got+want):\n%s", diff)
+	}
+
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.kdl")
+	if err := os.WriteFile(bad, []byte("title \"x\"\nserver {\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := DecodeFile(bad, &got)
+	var perr *ParseError
+	if !errors.As(err, &perr) || !strings.HasPrefix(err.Error(), bad+": 3:1: ") {
+		t.Errorf("DecodeFile of invalid file = %v, want a ParseError prefixed with %s", err, bad)
+	}
+
+	missing := filepath.Join(dir, "missing.kdl")
+	if err := DecodeFile(missing, &got); !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), missing) {
+		t.Errorf("DecodeFile of missing file = %v, want fs.ErrNotExist mentioning %s", err, missing)
+	}
+}
+
+func TestMarshalBigNumbers(t *testing.T) {
+	type target struct {
+		U64 uint64      `kdl:"u64"`
+		I64 int64       `kdl:"i64"`
+		F   float64     `kdl:"f"`
+		BI  *big.Int    `kdl:"bi"`
+		BF  big.Float   `kdl:"bf"`
+		Any interface{} `kdl:"any"`
+	}
+
+	const in = `u64 18446744073709551615
+i64 -9223372036854775808
+f 18446744073709551616
+bi 123456789012345678901234567890
+bf 1.5e400
+any 18446744073709551616
+`
+	var got target
+	if err := Unmarshal([]byte(in), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if got.U64 != math.MaxUint64 {
+		t.Errorf("U64 = %d, want %d", got.U64, uint64(math.MaxUint64))
+	}
+	if got.I64 != math.MinInt64 {
+		t.Errorf("I64 = %d, want %d", got.I64, int64(math.MinInt64))
+	}
+	if got.F != 18446744073709551616 {
+		t.Errorf("F = %v, want 18446744073709551616", got.F)
+	}
+	if got.BI == nil || got.BI.String() != "123456789012345678901234567890" {
+		t.Errorf("BI = %s, want 123456789012345678901234567890", got.BI)
+	}
+	if s := got.BF.Text('g', -1); s != "1.5e+400" {
+		t.Errorf("BF = %s, want 1.5e+400", s)
+	}
+	if bi, ok := got.Any.(*big.Int); !ok || bi.String() != "18446744073709551616" {
+		t.Errorf("Any = %#v, want *big.Int 18446744073709551616", got.Any)
+	}
+
+	out, err := Marshal(got)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	want := strings.Replace(in, "f 18446744073709551616", "f 1.8446744073709552e+19", 1)
+	want = strings.Replace(want, "1.5e400", "1.5e+400", 1)
+	if diff := cmp.Diff(string(out), want); diff != "" {
+		t.Errorf("wrong Marshal result (-got+want):\n%s", diff)
+	}
+
+	errs := []struct {
+		in   string
+		want string
+	}{
+		{"i64 9223372036854775808", "integer 9223372036854775808 overflows int64"},
+		{"i64 -9223372036854775809", "integer -9223372036854775809 overflows int64"},
+		{"u64 18446744073709551616", "integer 18446744073709551616 overflows uint64"},
+		{"u64 (u64)18446744073709551616", "integer 18446744073709551616 overflows (u64)"},
+		{"f 1.5e400", "overflows float64"},
+		{"bi 1.5", "cannot decode Float value into big.Int"},
+	}
+	for _, test := range errs {
+		var v target
+		if err := Unmarshal([]byte(test.in), &v); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Unmarshal(%q) = %v, want error containing %q", test.in, err, test.want)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	type target struct {
+		T time.Time  `kdl:"t"`
+		P *time.Time `kdl:"p"`
+	}
+
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr string
+	}{
+		{in: `t (date-time)"2021-01-01T00:00:00Z"`, want: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{in: `t "2021-06-15T12:30:45.5+02:00"`, want: time.Date(2021, 6, 15, 12, 30, 45, 5e8, time.FixedZone("", 2*60*60))},
+		{in: `t (date)"2021-06-15"`, want: time.Date(2021, 6, 15, 0, 0, 0, 0, time.UTC)},
+		{in: `t (time)"12:30:45"`, want: time.Date(0, 1, 1, 12, 30, 45, 0, time.UTC)},
+		{in: `t (time)"12:30:45.25"`, want: time.Date(0, 1, 1, 12, 30, 45, 25e7, time.UTC)},
+
+		{in: `t (date-time)"2021-13-01T00:00:00Z"`, wantErr: `invalid (date-time) value "2021-13-01T00:00:00Z": parsing time`},
+		{in: `t (date)"2021-06-15T00:00:00Z"`, wantErr: `invalid (date) value "2021-06-15T00:00:00Z"`},
+		{in: `t (time)"25:00:00"`, wantErr: `invalid (time) value "25:00:00"`},
+		{in: `t "yesterday"`, wantErr: `invalid time "yesterday"`},
+		{in: `t 1`, wantErr: "cannot decode Int value into time.Time"},
+	}
+	for _, test := range tests {
+		var got target
+		err := Unmarshal([]byte(test.in), &got)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Unmarshal(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unmarshal(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !got.T.Equal(test.want) {
+			t.Errorf("Unmarshal(%q) = %v, want %v", test.in, got.T, test.want)
+		}
+	}
+
+	p := time.Date(2022, 2, 3, 4, 5, 6, 7, time.UTC)
+	v := target{T: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), P: &p}
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	want := `t (date-time)"2021-01-01T00:00:00Z"
+p (date-time)"2022-02-03T04:05:06.000000007Z"
+`
+	if diff := cmp.Diff(string(out), want); diff != "" {
+		t.Errorf("wrong Marshal result (-got+want):\n%s", diff)
+	}
+	var got target
+	if err := Unmarshal(out, &got); err != nil {
+		t.Fatalf("Unmarshal of marshaled times failed: %v", err)
+	}
+	if !got.T.Equal(v.T) || got.P == nil || !got.P.Equal(p) {
+		t.Errorf("round trip = %v, %v, want %v, %v", got.T, got.P, v.T, p)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	type target struct {
+		Data  []byte      `kdl:"data"`
+		Ptr   *[]byte     `kdl:"ptr"`
+		Any   interface{} `kdl:"any"`
+		Plain string      `kdl:"plain"`
+		Other int         `kdl:"other"`
+	}
+	var opts UnmarshalOptions
+	opts.RegisterType("base64", func(v *Value) (interface{}, error) {
+		s, ok := v.AsString()
+		if !ok {
+			return nil, fmt.Errorf("want a string, got %s", v.Kind())
+		}
+		return base64.StdEncoding.DecodeString(s)
+	})
+
+	const in = `data (base64)"aGVsbG8="
+ptr (base64)"d29ybGQ="
+any (base64)"IQ=="
+plain "aGVsbG8="
+`
+	var got target
+	if err := opts.Unmarshal([]byte(in), &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	want := target{
+		Data:  []byte("hello"),
+		Ptr:   func() *[]byte { b := []byte("world"); return &b }(),
+		Any:   []byte("!"),
+		Plain: "aGVsbG8=",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong result (-got+want):\n%s", diff)
+	}
+
+	errs := []struct {
+		in   string
+		want string
+	}{
+		{`data (base64)"!!"`, "decoding (base64) value: illegal base64 data"},
+		{`data (base64)1`, "decoding (base64) value: want a string, got Int"},
+		{`other (base64)"IQ=="`, "cannot decode (base64) value as []uint8 into int"},
+	}
+	for _, test := range errs {
+		var v target
+		if err := opts.Unmarshal([]byte(test.in), &v); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Unmarshal(%q) = %v, want error containing %q", test.in, err, test.want)
+		}
+	}
+
+	// Without the registration, the annotation is ignored.
+	var plain target
+	if err := Unmarshal([]byte(`plain (base64)"IQ=="`), &plain); err != nil || plain.Plain != "IQ==" {
+		t.Errorf("Unmarshal without RegisterType = %q, %v, want %q", plain.Plain, err, "IQ==")
+	}
+}
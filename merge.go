@@ -0,0 +1,89 @@
+package kdl
+
+// MergeStrategy configures how Document.Merge combines two
+// documents. The zero MergeStrategy merges nodes by name.
+type MergeStrategy struct {
+	// Append adds copies of all of the other document's top-level
+	// nodes after the document's own, without merging any of them.
+	// It takes precedence over Replace.
+	Append bool
+	// Replace replaces each of the document's nodes that the other
+	// document has a node with the same name and key for with a copy
+	// of that node, children and all, rather than merging the two.
+	Replace bool
+	// Key, if set, is a property that identifies nodes along with
+	// their name when merging by name, so that server name="web" and
+	// server name="db" are different nodes. Nodes without the property
+	// merge with other nodes of the same name that don't have it
+	// either.
+	Key string
+}
+
+// Merge merges copies of other's nodes into d, such as to layer a
+// document of overrides on top of a base configuration.
+//
+// Unless strategy.Append is set, each of other's nodes is merged
+// into d's first node with the same name and key, or appended if d
+// has no such node. With strategy.Replace, a copy of other's node
+// takes the place of d's node instead. Merging a node replaces the type annotation and
+// arguments of d's node with its own, if it has any, sets each of its
+// properties on d's node, replacing any values d's node had for them,
+// and merges its children into d's node's children the same way.
+// d's comments and trivia are kept.
+func (d *Document) Merge(other *Document, strategy MergeStrategy) {
+	if other == nil {
+		return
+	}
+	if strategy.Append {
+		d.Nodes = append(d.Nodes, cloneNodes(other.Nodes)...)
+		return
+	}
+	d.Nodes = mergeNodes(d.Nodes, other.Nodes, strategy)
+}
+
+// mergeNodes merges copies of src into dst by name and key, or
+// replaces dst's nodes with them, and returns the updated dst.
+func mergeNodes(dst, src []*Node, strategy MergeStrategy) []*Node {
+	for _, s := range src {
+		i := findMergeNode(dst, s, strategy.Key)
+		switch {
+		case i < 0:
+			dst = append(dst, s.Clone())
+			continue
+		case strategy.Replace:
+			dst[i] = s.Clone()
+			continue
+		}
+		d := dst[i]
+		if s.TypeAnnotation != "" {
+			d.TypeAnnotation = s.TypeAnnotation
+		}
+		if len(s.Args) > 0 {
+			d.Args = cloneValues(s.Args)
+		}
+		for _, p := range s.Props {
+			d.SetProp(p.Key, p.Value.clone())
+		}
+		d.Children = mergeNodes(d.Children, s.Children, strategy)
+	}
+	return dst
+}
+
+// findMergeNode returns the index of the first node in nodes with
+// the same name as n, and the same value for property key if key is
+// set, or -1 if there is none.
+func findMergeNode(nodes []*Node, n *Node, key string) int {
+	want, wantOK := n.Prop(key)
+	for i, c := range nodes {
+		if c.Name != n.Name {
+			continue
+		}
+		if key == "" {
+			return i
+		}
+		if v, ok := c.Prop(key); ok == wantOK && (!ok || v.Equal(want)) {
+			return i
+		}
+	}
+	return -1
+}
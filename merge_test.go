@@ -0,0 +1,142 @@
+package kdl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const mergeBase = `title "base"
+server name="web" port=80 {
+    host "a.example"
+    tls #false
+}
+server name="db" port=5432
+log level="info"
+`
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides string
+		strategy  MergeStrategy
+		want      string
+	}{
+		{
+			name: "by name",
+			overrides: `title "prod"
+server port=8080 {
+    tls #true
+    cert "web.pem"
+}
+db "extra"
+`,
+			want: `title "prod"
+server name="web" port=8080 {
+    host "a.example"
+    tls #true
+    cert "web.pem"
+}
+server name="db" port=5432
+log level="info"
+db "extra"
+`,
+		},
+		{
+			name: "by key",
+			overrides: `server name="db" port=6543
+server name="cache" port=6379
+server port=1
+`,
+			strategy: MergeStrategy{Key: "name"},
+			want: `title "base"
+server name="web" port=80 {
+    host "a.example"
+    tls #false
+}
+server name="db" port=6543
+log level="info"
+server name="cache" port=6379
+server port=1
+`,
+		},
+		{
+			name: "append",
+			overrides: `title "prod"
+server name="web" port=8080
+`,
+			strategy: MergeStrategy{Append: true},
+			want: mergeBase + `title "prod"
+server name="web" port=8080
+`,
+		},
+		{
+			name: "replace",
+			overrides: `title "prod"
+server name="db" port=6543 {
+    replica "b.example"
+}
+server name="web" port=8080
+cache
+`,
+			strategy: MergeStrategy{Replace: true, Key: "name"},
+			want: `title "prod"
+server name="web" port=8080
+server name="db" port=6543 {
+    replica "b.example"
+}
+log level="info"
+cache
+`,
+		},
+		{
+			name:      "annotations and args",
+			overrides: "(prod)title\nlog \"stderr\" level=\"debug\"\n",
+			want: `(prod)title "base"
+server name="web" port=80 {
+    host "a.example"
+    tls #false
+}
+server name="db" port=5432
+log "stderr" level="debug"
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := ParseString(mergeBase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			overrides, err := ParseString(test.overrides)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc.Merge(overrides, test.strategy)
+
+			var b bytes.Buffer
+			if err := NewEncoder(&b).Encode(doc); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(test.want, "\n")); diff != "" {
+				t.Errorf("wrong merged document (-got+want):\n%s", diff)
+			}
+
+			// The merged document doesn't share nodes with overrides.
+			for _, n := range overrides.Nodes {
+				n.Name = "changed"
+				n.Children = nil
+			}
+			b.Reset()
+			if err := NewEncoder(&b).Encode(doc); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(strings.Split(b.String(), "\n"), strings.Split(test.want, "\n")); diff != "" {
+				t.Errorf("changing overrides changed the merged document (-got+want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,835 @@
+package kdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseOptions configures the behavior of Parse and Decoder.
+type ParseOptions struct {
+	LexerOptions
+
+	// MaxDepth is the maximum nesting depth of children blocks. Zero
+	// means 1000.
+	MaxDepth int
+	// ErrorOnDuplicateProps makes it an error for a node to have the
+	// same property key more than once. By default, all the
+	// properties are kept, and the last value wins.
+	ErrorOnDuplicateProps bool
+	// ErrorOnEmptyName makes it an error for a node name or property
+	// key to be the empty string, written "". By default, they are
+	// allowed, as the spec allows.
+	ErrorOnEmptyName bool
+	// DisallowTypeAnnotations makes it an error for a node or value
+	// to have a (type) annotation, for profiles of KDL without them.
+	DisallowTypeAnnotations bool
+	// KeepTrivia makes the parser record the exact source text of
+	// each node, including the whitespace and comments around it, in
+	// Node.Trivia and Document.Trivia. Encoding the result reproduces
+	// the input byte for byte, except for nodes that have changed.
+	// It keeps the whole input in memory.
+	KeepTrivia bool
+	// KeepBlankLines makes the parser record which nodes follow a
+	// blank line, in Node.BlankLineBefore, so that the encoder can
+	// keep the input's grouping of nodes. A line with only whitespace
+	// and comments that aren't kept, because LexerOptions.Comments is
+	// unset, counts as blank.
+	KeepBlankLines bool
+	// MaxBytes is the maximum size of the input, in bytes. Reading
+	// more than that is an error. Zero means no limit.
+	MaxBytes int64
+	// MaxNodes is the maximum number of nodes, counting children and
+	// slashdashed nodes, since those are parsed too. Zero means no
+	// limit. Unlike syntax errors, exceeding it ends ParseAll.
+	MaxNodes int
+	// StopAfterNodes, if positive, makes parsing stop after that many
+	// top-level nodes, as if the document ended there. The parser
+	// then reads no further than the terminator of the last node, so
+	// that the input can carry other data after the document. It
+	// reads the input one byte at a time, unless it is an
+	// io.RuneReader, such as a bufio.Reader, which then keeps
+	// whatever follows the document. A node ending with a lone \r
+	// reads one rune past it, to check for a \r\n.
+	StopAfterNodes int
+}
+
+const defaultMaxDepth = 1000
+
+// Parse parses the KDL document read from r.
+func Parse(r io.Reader) (*Document, error) {
+	return ParseOptions{}.Parse(r)
+}
+
+// Parse is like the top-level Parse, using the options in o.
+func (o ParseOptions) Parse(r io.Reader) (*Document, error) {
+	p := o.newParser(r)
+	defer p.l.Close()
+
+	nodes, err := p.nodes(nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.document(nodes), nil
+}
+
+// ParseAll parses the KDL document read from r like Parse, but
+// doesn't stop at the first error. After a syntax error, it skips to
+// the end of the offending node and carries on with the next one,
+// returning the nodes it could parse along with every error found,
+// in document order. Errors from the lexer, such as an unterminated
+// string, still end parsing, since there is no reliable way to find
+// the next node after them.
+func ParseAll(r io.Reader) (*Document, []error) {
+	return ParseOptions{}.ParseAll(r)
+}
+
+// ParseAll is like the top-level ParseAll, using the options in o.
+func (o ParseOptions) ParseAll(r io.Reader) (*Document, []error) {
+	p := o.newParser(r)
+	defer p.l.Close()
+	p.recover = true
+
+	nodes, _ := p.nodes(nil)
+	return p.document(nodes), p.errs
+}
+
+// document returns a Document with the top-level nodes, once the
+// whole input has been parsed.
+func (p *parser) document(nodes []*Node) *Document {
+	ret := &Document{Nodes: nodes, Comments: p.takeComments()}
+	if p.src != nil {
+		ret.Trivia = &Trivia{Tail: p.source(p.mark, p.src.Len())}
+	}
+	return ret
+}
+
+// ParseBytes parses the KDL document in bs.
+func ParseBytes(bs []byte) (*Document, error) {
+	return ParseOptions{}.ParseBytes(bs)
+}
+
+// ParseBytes is like the top-level ParseBytes, using the options in
+// o.
+func (o ParseOptions) ParseBytes(bs []byte) (*Document, error) {
+	return o.Parse(bytes.NewReader(bs))
+}
+
+// ParseString parses the KDL document in s.
+func ParseString(s string) (*Document, error) {
+	return ParseOptions{}.ParseString(s)
+}
+
+// ParseString is like the top-level ParseString, using the options
+// in o.
+func (o ParseOptions) ParseString(s string) (*Document, error) {
+	return o.Parse(strings.NewReader(s))
+}
+
+// ParseValue parses s as a single KDL value, such as "x", 0xff, #true
+// or (i8)5: a string, number, boolean or null, with an optional type
+// annotation. Anything else in s, including whitespace, is an error.
+func ParseValue(s string) (Value, error) {
+	return ParseOptions{}.ParseValue(s)
+}
+
+// ParseValue is like the top-level ParseValue, using the options in
+// o.
+func (o ParseOptions) ParseValue(s string) (Value, error) {
+	p := o.newParser(strings.NewReader(s))
+	defer p.l.Close()
+	v, err := p.annotatedValue(p.next())
+	if err != nil {
+		return Value{}, err
+	}
+	if tok := p.next(); tok.Type != TokenEOF {
+		return Value{}, p.unexpected(tok, "after value")
+	}
+	return v, nil
+}
+
+// Validate reports whether r contains a valid KDL document, returning
+// the first error found, or nil. It is cheaper than Parse, since it
+// doesn't build a Document.
+func Validate(r io.Reader) error {
+	return ParseOptions{}.Validate(r)
+}
+
+// Validate is like the top-level Validate, using the options in o.
+func (o ParseOptions) Validate(r io.Reader) error {
+	p := o.newParser(r)
+	defer p.l.Close()
+	p.discard = true
+
+	_, err := p.nodes(nil)
+	return err
+}
+
+// A ParseError describes a syntax error in a KDL document.
+type ParseError struct {
+	Pos Pos   // position of the offending token
+	Err error // what went wrong
+
+	tok Token // the offending token
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Pos, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (o ParseOptions) newParser(r io.Reader) *parser {
+	if o.MaxDepth == 0 {
+		o.MaxDepth = defaultMaxDepth
+	}
+	if o.MaxBytes > 0 {
+		r = &maxBytesReader{r: r, max: o.MaxBytes, n: o.MaxBytes}
+	}
+	var src *bytes.Buffer
+	if o.KeepTrivia {
+		src = &bytes.Buffer{}
+		r = io.TeeReader(r, src)
+	}
+	return &parser{
+		l:    o.LexerOptions.newLexer(r, o.StopAfterNodes > 0),
+		opts: o,
+		src:  src,
+	}
+}
+
+// maxBytesReader is an io.Reader that fails once more than max bytes
+// have been read from r.
+type maxBytesReader struct {
+	r   io.Reader
+	max int64
+	n   int64 // bytes left before the limit, or -1 once it's exceeded
+}
+
+func (m *maxBytesReader) Read(bs []byte) (int, error) {
+	if m.n < 0 {
+		return 0, m.err()
+	}
+	// Read one byte past the limit, to tell whether the input ends
+	// right at it.
+	if int64(len(bs)) > m.n+1 {
+		bs = bs[:m.n+1]
+	}
+	n, err := m.r.Read(bs)
+	if int64(n) <= m.n {
+		m.n -= int64(n)
+		return n, err
+	}
+	n, m.n = int(m.n), -1
+	return n, m.err()
+}
+
+func (m *maxBytesReader) err() error {
+	return fmt.Errorf("document is larger than %d bytes", m.max)
+}
+
+type parser struct {
+	l      *lexer
+	opts   ParseOptions
+	tok    Token // last token returned by next
+	backed bool  // next should return tok again
+	depth  int   // number of enclosing children blocks
+	count  int   // number of nodes started, for MaxNodes
+	// discard makes the parser check syntax without building a
+	// tree.
+	discard bool
+	// recover makes the parser skip nodes with errors, collecting the
+	// errors in errs, rather than stopping at the first one.
+	recover bool
+	errs    []error
+
+	comments []string // comments read but not yet attached to a node
+
+	// src is the input read so far, if keeping trivia, and mark the
+	// offset in it of the first byte that no node's trivia has
+	// claimed yet.
+	src  *bytes.Buffer
+	mark int
+
+	top int // top-level nodes read, for StopAfterNodes
+	end int // offset just past the last top-level node read
+
+	// lineStart is whether nothing but whitespace has been read since
+	// the last newline, and lineComment whether a comment has. blank
+	// is whether a blank line has been read since the last node.
+	lineStart   bool
+	lineComment bool
+	blank       bool
+}
+
+func (p *parser) next() Token {
+	if p.backed {
+		p.backed = false
+		return p.tok
+	}
+	for {
+		tok := p.l.Next()
+		if tok.Type == TokenComment {
+			p.comments = append(p.comments, tok.Value)
+			p.lineComment = true
+			if !tok.block {
+				// The newline that ends the comment follows.
+				continue
+			}
+			// Block comments separate things like whitespace does.
+			tok = Token{Pos: tok.Pos, End: tok.End, Type: TokenSpace}
+		}
+		if tok.Type == TokenSpace && p.tok.Type == TokenSpace {
+			continue
+		}
+		switch tok.Type {
+		case TokenNewline:
+			p.blank = p.blank || (p.lineStart && !p.lineComment)
+			p.lineStart, p.lineComment = true, false
+		case TokenSpace:
+		default:
+			p.lineStart = false
+		}
+		if p.recover {
+			for _, d := range tok.Diagnostics {
+				p.errs = append(p.errs, &ParseError{Pos: d.Pos, Err: d, tok: tok})
+			}
+		}
+		p.tok = tok
+		return tok
+	}
+}
+
+// takeComments returns the comments read since the last call.
+func (p *parser) takeComments() []string {
+	ret := p.comments
+	p.comments = nil
+	return ret
+}
+
+// takeEntryComments moves the block comments read since the last
+// call to n.EntryComments, as preceding argument arg or property
+// prop. // comments are left for the node's trailing comments.
+func (p *parser) takeEntryComments(n *Node, arg, prop int) {
+	rest := p.comments[:0]
+	for _, c := range p.comments {
+		if strings.HasPrefix(c, "/*") {
+			n.EntryComments = append(n.EntryComments, EntryComment{Text: c, Arg: arg, Prop: prop})
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	p.comments = rest
+}
+
+// backup un-reads the last token returned by next.
+func (p *parser) backup() {
+	p.backed = true
+}
+
+func (p *parser) peek() Token {
+	tok := p.next()
+	p.backup()
+	return tok
+}
+
+func (p *parser) errorf(tok Token, format string, args ...interface{}) error {
+	return &ParseError{
+		Pos: tok.Pos,
+		Err: fmt.Errorf(format, args...),
+		tok: tok,
+	}
+}
+
+// unexpected returns an error for an unexpected tok, or the lexer's
+// error if tok is a TokenErr.
+func (p *parser) unexpected(tok Token, context string) error {
+	if tok.Type == TokenErr {
+		return &ParseError{Pos: tok.Pos, Err: tok.Err, tok: tok}
+	}
+	switch tok.Type {
+	case TokenEqual:
+		// Only valid between a property's key and value.
+		return p.errorf(tok, "unexpected '=' %s", context)
+	case TokenEOF:
+		return p.errorf(tok, "%w %s", ErrUnexpectedEOF, context)
+	}
+	return p.errorf(tok, "unexpected %s %s", tok, context)
+}
+
+// nodes parses a sequence of nodes, up to EOF or the end of a
+// children block. open is the opening bracket of the enclosing
+// children block, or nil at the top level.
+func (p *parser) nodes(open *Token) ([]*Node, error) {
+	var ret []*Node
+	for {
+		if p.stopped(open) {
+			return ret, nil
+		}
+		n, err := p.nextNode(open)
+		if err != nil && p.recover {
+			if p.tooManyNodes() {
+				// Ends parsing at every level, rather than just
+				// this node.
+				if last := len(p.errs) - 1; last < 0 || p.errs[last] != err {
+					p.errs = append(p.errs, err)
+				}
+				return ret, err
+			}
+			if p.skipNode(err, open) {
+				continue
+			}
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			return ret, nil
+		}
+		if !p.discard {
+			ret = append(ret, n)
+		}
+	}
+}
+
+// skipNode records err, and skips the rest of the node in which it
+// happened. It reports whether parsing can continue at the current
+// level, which is false if the error ended the sequence of nodes, at
+// EOF or after a lexer error. open is as for nodes.
+func (p *parser) skipNode(err error, open *Token) bool {
+	var perr *ParseError
+	if last := len(p.errs) - 1; last < 0 || !errors.As(err, &perr) || !sameError(p.errs[last], perr) {
+		p.errs = append(p.errs, err)
+	}
+	// Usually, the offending token was the last one read.
+	tok := p.tok
+	depth := 0 // of children blocks opened in the skipped node
+	for first := true; ; first = false {
+		switch tok.Type {
+		case TokenEOF, TokenErr:
+			p.backup()
+			return false
+		case TokenNewline, TokenSemicolon:
+			if depth == 0 {
+				return true
+			}
+		case TokenOpenBracket:
+			depth++
+		case TokenCloseBracket:
+			switch {
+			case depth > 0:
+				depth--
+			case open == nil && first:
+				// An unmatched '}', which is the error we're
+				// skipping past.
+				return true
+			default:
+				// Ends the enclosing block, or is an unmatched '}'
+				// to report next.
+				p.backup()
+				return true
+			}
+		}
+		tok = p.next()
+	}
+}
+
+// sameError reports whether err is perr, reported again while
+// unwinding past an error that ended parsing.
+func sameError(err error, perr *ParseError) bool {
+	var last *ParseError
+	return errors.As(err, &last) && last.Pos == perr.Pos && last.Err.Error() == perr.Err.Error()
+}
+
+// nextNode parses the next node in a sequence of nodes. It returns a
+// nil Node at the end of the sequence, which is EOF at the top level
+// or the closing bracket of a children block. open is as for nodes.
+func (p *parser) nextNode(open *Token) (*Node, error) {
+	mark := p.mark
+	for {
+		tok := p.next()
+		switch tok.Type {
+		case TokenSpace, TokenNewline:
+		case TokenEOF:
+			if open != nil {
+				return nil, p.errorf(tok, "%w, unclosed '{' opened at line %d col %d", ErrUnexpectedEOF, open.Line, open.Column)
+			}
+			return nil, nil
+		case TokenCloseBracket:
+			if open == nil {
+				return nil, p.errorf(tok, "unexpected '}' with no matching '{'")
+			}
+			return nil, nil
+		case TokenIdentifier, TokenString, TokenOpenParen:
+			leading := p.takeComments()
+			blank := p.blank
+			p.backup()
+			n, err := p.node()
+			p.blank = false
+			if err != nil {
+				// Leave the source for the next node's trivia.
+				p.mark = mark
+				return nil, err
+			}
+			if n.Trivia != nil {
+				n.Trivia.Leading = p.source(mark, tok.Offset)
+			}
+			n.Comments = leading
+			n.BlankLineBefore = blank && p.opts.KeepBlankLines
+			// Whatever was read while parsing the node belongs to
+			// it, since its children took their own.
+			n.TrailingComments = p.takeComments()
+			if open == nil {
+				p.top++
+				p.end = p.endOffset()
+			}
+			return n, nil
+		case TokenIgnoreNode:
+			err := p.slashdashedNode()
+			// The slashdashed node is part of the next node's trivia.
+			p.mark = mark
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.unexpected(tok, "looking for node")
+		}
+	}
+}
+
+// slashdashedNode parses the node after a slashdash, which comments
+// it out.
+func (p *parser) slashdashedNode() error {
+	if tok := p.nextNonSpace(); tok.Type != TokenIdentifier && tok.Type != TokenString && tok.Type != TokenOpenParen {
+		return p.unexpected(tok, "after slashdash, expected node")
+	}
+	p.backup()
+	// Blank lines inside the node don't separate the nodes around it.
+	blank := p.blank
+	// Its comments go to the next node, as leading comments.
+	comments := p.comments
+	p.comments = nil
+	n, err := p.node()
+	p.blank = blank
+	if n != nil {
+		for _, c := range n.EntryComments {
+			comments = append(comments, c.Text)
+		}
+		comments = append(comments, n.EndComments...)
+	}
+	p.comments = append(comments, p.comments...)
+	return err
+}
+
+// node parses a single node, including its type annotation and
+// children if any.
+func (p *parser) node() (*Node, error) {
+	ret := &Node{}
+	tok := p.next()
+	open := tok
+	start := tok.Offset
+	if tok.Type == TokenOpenParen {
+		typ, err := p.typeAnnotation(tok)
+		if err != nil {
+			return nil, err
+		}
+		ret.TypeAnnotation = typ
+		if tok = p.next(); tok.Type != TokenIdentifier && tok.Type != TokenString {
+			return nil, p.unexpected(tok, "after type annotation, expected node name")
+		}
+	}
+	if tok.Value == "" && p.opts.ErrorOnEmptyName {
+		return nil, p.errorf(tok, "empty node name")
+	}
+	ret.Name = tok.Value
+	ret.Span = Span{Start: open.Pos, End: tok.End}
+	p.count++
+	if p.tooManyNodes() {
+		return nil, p.errorf(tok, "document has more than %d nodes", p.opts.MaxNodes)
+	}
+	var keys map[string]Pos // first position of each property key
+	if p.opts.ErrorOnDuplicateProps {
+		keys = map[string]Pos{}
+	}
+	for {
+		tok := p.next()
+		// Arguments and properties must be separated from what
+		// precedes them by whitespace.
+		spaced := tok.Type == TokenSpace
+		if spaced {
+			tok = p.next()
+		}
+		// Slashdash comments out the next argument, property or
+		// children block.
+		ignore := tok.Type == TokenIgnoreNode
+		if ignore {
+			tok = p.nextNonSpace()
+		}
+
+		switch tok.Type {
+		case TokenIdentifier, TokenString, TokenInt, TokenFloat, TokenBool, TokenNull, TokenOpenParen:
+			if !spaced {
+				return nil, p.unexpected(tok, "in node, expected whitespace first")
+			}
+			seen := keys
+			if ignore {
+				seen = nil // slashdashed properties don't count
+			}
+			args, props := len(ret.Args), len(ret.Props)
+			if err := p.entry(ret, tok, ignore || p.discard, seen); err != nil {
+				return nil, err
+			}
+			// Comments before the entry belong to it, and the ones
+			// before a slashdashed entry to the next.
+			switch {
+			case len(ret.Args) > args:
+				p.takeEntryComments(ret, args, -1)
+			case len(ret.Props) > props:
+				p.takeEntryComments(ret, -1, props)
+			}
+			ret.Span.End = p.tok.End
+		case TokenOpenBracket:
+			if !ignore {
+				p.takeEntryComments(ret, -1, -1)
+			}
+			headEnd := p.endOffset()
+			p.mark = headEnd
+			children, err := p.children(tok)
+			if err != nil {
+				return nil, err
+			}
+			ret.Span.End = p.tok.End
+			if ignore {
+				continue
+			}
+			ret.Children = children
+			ret.EndComments = p.takeComments()
+			if err := p.nodeEnd(); err != nil {
+				return nil, err
+			}
+			p.setTrivia(ret, start, headEnd, p.mark, p.endOffset())
+			return ret, nil
+		case TokenNewline, TokenSemicolon, TokenEOF, TokenCloseBracket:
+			if ignore {
+				return nil, p.unexpected(tok, "after slashdash, expected argument, property or children")
+			}
+			if tok.Type == TokenEOF || tok.Type == TokenCloseBracket {
+				// Ends this node, but the caller needs to see it too.
+				p.backup()
+			}
+			end := p.endOffset()
+			p.setTrivia(ret, start, end, end, end)
+			return ret, nil
+		default:
+			if !spaced {
+				return nil, p.unexpected(tok, "in node")
+			}
+			// Whitespace before the children block or terminator.
+			p.backup()
+		}
+	}
+}
+
+// source returns the input between byte offsets start and end, if
+// keeping trivia.
+func (p *parser) source(start, end int) string {
+	if p.src == nil {
+		return ""
+	}
+	return string(p.src.Bytes()[start:end])
+}
+
+// endOffset returns the offset just past the last token read, or
+// the offset of that token if it was backed up.
+func (p *parser) endOffset() int {
+	if p.backed {
+		return p.tok.Offset
+	}
+	return p.tok.End.Offset
+}
+
+// stopped reports whether the parser has read
+// ParseOptions.StopAfterNodes top-level nodes, and so must not read
+// any further when looking for the next node in the block opened by
+// open.
+func (p *parser) stopped(open *Token) bool {
+	return open == nil && p.opts.StopAfterNodes > 0 && p.top >= p.opts.StopAfterNodes
+}
+
+// setTrivia records n's source in n.Trivia, if keeping trivia, and
+// claims the source up to end. n's head spans offsets start to
+// headEnd, and the tail of its children block tailStart to end.
+func (p *parser) setTrivia(n *Node, start, headEnd, tailStart, end int) {
+	if p.src == nil || p.discard {
+		return
+	}
+	n.Trivia = &Trivia{
+		Head: p.source(start, headEnd),
+		Tail: p.source(tailStart, end),
+		parsed: &Node{
+			TypeAnnotation: n.TypeAnnotation,
+			Name:           n.Name,
+			Args:           cloneValues(n.Args),
+			Props:          cloneProps(n.Props),
+		},
+		block: headEnd != end,
+	}
+	p.mark = end
+}
+
+// tooManyNodes reports whether the document has more nodes than
+// MaxNodes allows.
+func (p *parser) tooManyNodes() bool {
+	return p.opts.MaxNodes > 0 && p.count > p.opts.MaxNodes
+}
+
+// children parses a children block, whose opening bracket is open.
+func (p *parser) children(open Token) ([]*Node, error) {
+	if p.depth >= p.opts.MaxDepth {
+		return nil, p.errorf(open, "children blocks nested more than %d deep", p.opts.MaxDepth)
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	return p.nodes(&open)
+}
+
+// entry parses the argument or property starting with tok, and adds
+// it to n unless ignore is set. If seen is non-nil, it records the
+// position of property keys, and a key that's already in seen is an
+// error.
+func (p *parser) entry(n *Node, tok Token, ignore bool, seen map[string]Pos) error {
+	if tok.Type == TokenIdentifier || tok.Type == TokenString {
+		if p.peek().Type == TokenEqual {
+			if tok.Value == "" && p.opts.ErrorOnEmptyName {
+				return p.errorf(tok, "empty property key")
+			}
+			if first, ok := seen[tok.Value]; ok {
+				return p.errorf(tok, "duplicate property %q, first set at line %d col %d", tok.Value, first.Line, first.Column)
+			} else if seen != nil {
+				seen[tok.Value] = tok.Pos
+			}
+			p.next()
+			v, err := p.annotatedValue(p.next())
+			if err != nil {
+				return err
+			}
+			if !ignore {
+				n.Props = append(n.Props, Prop{Key: tok.Value, Value: v})
+			}
+			return nil
+		}
+	}
+	v, err := p.annotatedValue(tok)
+	if err != nil {
+		return err
+	}
+	if !ignore {
+		n.Args = append(n.Args, v)
+	}
+	return nil
+}
+
+// annotatedValue interprets tok and the tokens following it as a
+// value, with an optional type annotation.
+func (p *parser) annotatedValue(tok Token) (Value, error) {
+	if tok.Type != TokenOpenParen {
+		v, err := p.value(tok)
+		v.span = Span{Start: tok.Pos, End: tok.End}
+		return v, err
+	}
+	typ, err := p.typeAnnotation(tok)
+	if err != nil {
+		return Value{}, err
+	}
+	v, err := p.value(p.next())
+	if err != nil {
+		return Value{}, err
+	}
+	v.TypeAnnotation = typ
+	v.span = Span{Start: tok.Pos, End: p.tok.End}
+	return v, nil
+}
+
+// typeAnnotation parses the rest of a (type) annotation, whose
+// opening parenthesis open has already been read.
+func (p *parser) typeAnnotation(open Token) (string, error) {
+	tok := p.next()
+	if tok.Type != TokenIdentifier && tok.Type != TokenString {
+		return "", p.unexpected(tok, "in type annotation, expected identifier or string")
+	}
+	if end := p.next(); end.Type != TokenCloseParen {
+		return "", p.unexpected(end, "after type annotation, expected ')'")
+	}
+	if p.opts.DisallowTypeAnnotations {
+		return "", p.errorf(open, "type annotation (%s) is not allowed", tok.Value)
+	}
+	return tok.Value, nil
+}
+
+// nextNonSpace returns the next token that isn't a TokenSpace.
+func (p *parser) nextNonSpace() Token {
+	tok := p.next()
+	if tok.Type == TokenSpace {
+		tok = p.next()
+	}
+	return tok
+}
+
+// nodeEnd consumes the terminator following a node's children
+// block.
+func (p *parser) nodeEnd() error {
+	for {
+		tok := p.next()
+		switch tok.Type {
+		case TokenSpace:
+		case TokenNewline, TokenSemicolon:
+			return nil
+		case TokenEOF, TokenCloseBracket:
+			p.backup()
+			return nil
+		default:
+			return p.unexpected(tok, "after children block")
+		}
+	}
+}
+
+// value interprets tok as an argument or property value.
+func (p *parser) value(tok Token) (Value, error) {
+	switch tok.Type {
+	case TokenString:
+		v := StringValue(tok.Value)
+		v.raw, v.hash = tok.raw, tok.hashes
+		return v, nil
+	case TokenInt:
+		if p.discard {
+			return Value{}, nil
+		}
+		v, err := parseInt(tok.Value)
+		if err != nil {
+			return Value{}, &ParseError{Pos: tok.Pos, Err: err, tok: tok}
+		}
+		return v, nil
+	case TokenFloat:
+		if p.discard {
+			return Value{}, nil
+		}
+		v, err := parseFloat(tok.Value)
+		if err != nil {
+			return Value{}, &ParseError{Pos: tok.Pos, Err: err, tok: tok}
+		}
+		return v, nil
+	case TokenBool:
+		return BoolValue(tok.Value == "true"), nil
+	case TokenNull:
+		return NullValue(), nil
+	case TokenIdentifier:
+		return Value{}, p.errorf(tok, "bare identifier %q cannot be used as a value", tok.Value)
+	default:
+		return Value{}, p.unexpected(tok, "looking for value")
+	}
+}
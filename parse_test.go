@@ -0,0 +1,857 @@
+package kdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []*Node
+	}{
+		{"", nil},
+		{"node", []*Node{{Name: "node"}}},
+		{
+			`node "arg" 1 2.5 true null prop="val" "quoted key"=0x10`,
+			[]*Node{{
+				Name: "node",
+				Args: []Value{
+					StringValue("arg"),
+					IntValue(1),
+					FloatValue(2.5),
+					BoolValue(true),
+					NullValue(),
+				},
+				Props: []Prop{
+					{Key: "prop", Value: StringValue("val")},
+					{Key: "quoted key", Value: IntValue(16)},
+				},
+			}},
+		},
+		{
+			"a; b\nc",
+			[]*Node{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+		},
+		{
+			`parent {
+    child 1
+    child 2 {
+        grandchild
+    }
+}
+sibling`,
+			[]*Node{
+				{
+					Name: "parent",
+					Children: []*Node{
+						{Name: "child", Args: []Value{IntValue(1)}},
+						{
+							Name:     "child",
+							Args:     []Value{IntValue(2)},
+							Children: []*Node{{Name: "grandchild"}},
+						},
+					},
+				},
+				{Name: "sibling"},
+			},
+		},
+		{
+			"a { b; c }; d{}",
+			[]*Node{
+				{Name: "a", Children: []*Node{{Name: "b"}, {Name: "c"}}},
+				{Name: "d"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		doc, err := Parse(strings.NewReader(test.in))
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(doc.Nodes, test.want, cmpValues); diff != "" {
+			t.Errorf("Parse(%q) wrong result (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos Pos
+	}{
+		{"node a", Pos{5, 1, 6}},
+		{"node\n  = 1", Pos{7, 2, 3}},
+		{`node"arg"`, Pos{4, 1, 5}},
+		{"node {", Pos{6, 1, 7}},
+		{"node }", Pos{5, 1, 6}},
+		{"node {} a", Pos{8, 1, 9}},
+		{`node "unterminated`, Pos{18, 1, 19}},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader(test.in))
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", test.in)
+			continue
+		}
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("Parse(%q) returned %T, want *ParseError", test.in, err)
+			continue
+		}
+		if perr.Pos != test.pos {
+			t.Errorf("Parse(%q) error at %#v, want %#v (%v)", test.in, perr.Pos, test.pos, err)
+		}
+	}
+}
+
+func TestStrayEqual(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"= 1", "1:1: unexpected '=' looking for node"},
+		{"a == 1", "1:3: unexpected '=' in node"},
+		{"node a==1", "1:8: unexpected '=' looking for value"},
+		{"node 1=2", "1:7: unexpected '=' in node"},
+		{"node a=1 =", "1:10: unexpected '=' in node"},
+	}
+	for _, test := range tests {
+		_, err := ParseString(test.in)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("Parse(%q) = %v, want %q", test.in, err, test.want)
+		}
+	}
+
+	doc, err := ParseString("node a=1")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if v, ok := doc.Nodes[0].Prop("a"); !ok || !v.Equal(IntValue(1)) {
+		t.Errorf("Prop(a) = %v, %v, want 1", v, ok)
+	}
+}
+
+func TestSlashdash(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []*Node
+	}{
+		{
+			`node /-"arg1" "arg2"`,
+			[]*Node{{Name: "node", Args: []Value{StringValue("arg2")}}},
+		},
+		{
+			`node /- "arg1" 2`,
+			[]*Node{{Name: "node", Args: []Value{IntValue(2)}}},
+		},
+		{
+			"node /-key=1 other=2",
+			[]*Node{{Name: "node", Props: []Prop{{Key: "other", Value: IntValue(2)}}}},
+		},
+		{
+			"node 1 /-{\n    child\n}",
+			[]*Node{{Name: "node", Args: []Value{IntValue(1)}}},
+		},
+		{
+			"node /-{ ignored } {\n    kept\n}",
+			[]*Node{{Name: "node", Children: []*Node{{Name: "kept"}}}},
+		},
+		{
+			"/- node {\n    child\n}\nother",
+			[]*Node{{Name: "other"}},
+		},
+		{
+			"parent {\n    /-child 1\n    kept\n}",
+			[]*Node{{Name: "parent", Children: []*Node{{Name: "kept"}}}},
+		},
+		{
+			"/-node",
+			nil,
+		},
+		{
+			"node /--1.0 2.0",
+			[]*Node{{Name: "node", Args: []Value{FloatValue(2)}}},
+		},
+	}
+
+	for _, test := range tests {
+		doc, err := Parse(strings.NewReader(test.in))
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(doc.Nodes, test.want, cmpValues); diff != "" {
+			t.Errorf("Parse(%q) wrong result (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	for _, in := range []string{
+		"node /-",
+		"node /-\n1",
+		"node /-;",
+		"/- 1",
+		"/-",
+		`node /-"x"=bare`,
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("a {\n", depth) + strings.Repeat("}\n", depth)
+	}
+
+	if _, err := Parse(strings.NewReader(nested(1000))); err != nil {
+		t.Errorf("Parse at default max depth failed: %v", err)
+	}
+
+	_, err := Parse(strings.NewReader(nested(100000)))
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Parse of very deep document returned %v, want ParseError", err)
+	}
+	if want := (Pos{Offset: 4002, Line: 1001, Column: 3}); perr.Pos != want {
+		t.Errorf("depth error at %#v, want %#v", perr.Pos, want)
+	}
+
+	opts := ParseOptions{MaxDepth: 2}
+	if _, err := opts.Parse(strings.NewReader(nested(2))); err != nil {
+		t.Errorf("Parse at max depth 2 failed: %v", err)
+	}
+	if _, err := opts.Parse(strings.NewReader(nested(3))); err == nil {
+		t.Errorf("Parse beyond max depth 2 succeeded, want error")
+	}
+	// Slashdashed children count too, since they still get parsed.
+	if _, err := opts.Parse(strings.NewReader("a { b { c /-{ d } } }")); err == nil {
+		t.Errorf("Parse beyond max depth 2 in slashdash succeeded, want error")
+	}
+
+	d := opts.NewDecoder(strings.NewReader("ok { ok }\n" + nested(3)))
+	defer d.Close()
+	if _, err := d.Next(); err != nil {
+		t.Errorf("first Decoder.Next failed: %v", err)
+	}
+	if _, err := d.Next(); err == nil {
+		t.Errorf("Decoder.Next beyond max depth succeeded, want error")
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	in := "a 1\nb 2\n" // 8 bytes
+	for _, max := range []int64{8, 9, 100} {
+		opts := ParseOptions{MaxBytes: max}
+		if _, err := opts.ParseString(in); err != nil {
+			t.Errorf("Parse with MaxBytes %d failed: %v", max, err)
+		}
+	}
+	for _, max := range []int64{1, 5, 7} {
+		opts := ParseOptions{MaxBytes: max}
+		_, err := opts.ParseString(in)
+		if want := fmt.Sprintf("document is larger than %d bytes", max); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse with MaxBytes %d returned %v, want error containing %q", max, err, want)
+		}
+	}
+
+	// The limit covers the whole stream, not each node.
+	d := ParseOptions{MaxBytes: 6}.NewDecoder(strings.NewReader(in))
+	defer d.Close()
+	if _, err := d.Next(); err != nil {
+		t.Errorf("first Decoder.Next failed: %v", err)
+	}
+	if _, err := d.Next(); err == nil || !strings.Contains(err.Error(), "larger than 6 bytes") {
+		t.Errorf("Decoder.Next past MaxBytes returned %v, want size error", err)
+	}
+}
+
+func TestMaxNodes(t *testing.T) {
+	opts := ParseOptions{MaxNodes: 3}
+	for _, in := range []string{"a; b; c", "a { b { c; }; }", "a; /-b; c"} {
+		if _, err := opts.ParseString(in); err != nil {
+			t.Errorf("Parse(%q) with MaxNodes 3 failed: %v", in, err)
+		}
+	}
+	for _, in := range []string{"a; b; c; d", "a { b; c { d; }; }", "a; /-b; c; /-d"} {
+		_, err := opts.ParseString(in)
+		if err == nil || !strings.Contains(err.Error(), "document has more than 3 nodes") {
+			t.Errorf("Parse(%q) with MaxNodes 3 returned %v, want node count error", in, err)
+		}
+		if err := opts.Validate(strings.NewReader(in)); err == nil {
+			t.Errorf("Validate(%q) with MaxNodes 3 succeeded, want error", in)
+		}
+	}
+
+	// ParseAll stops at the limit, rather than reporting every
+	// following node.
+	doc, errs := opts.ParseAll(strings.NewReader("a 1; b =; c { d; e; f; }; g; h"))
+	want := []string{"1:8: unexpected '=' in node", "1:15: document has more than 3 nodes"}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong ParseAll errors (-got+want):\n%s", diff)
+	}
+	var names []string
+	for _, n := range doc.Nodes {
+		names = append(names, n.Name)
+	}
+	if diff := cmp.Diff(names, []string{"a"}); diff != "" {
+		t.Errorf("wrong ParseAll nodes (-got+want):\n%s", diff)
+	}
+}
+
+func TestDuplicateProps(t *testing.T) {
+	doc, err := ParseString("node a=1 a=2")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	n := doc.Nodes[0]
+	if len(n.Props) != 2 {
+		t.Errorf("got %d props, want both kept", len(n.Props))
+	}
+	if v, _ := n.Prop("a"); !v.Equal(IntValue(2)) {
+		t.Errorf("Prop(a) = %v, want the last value 2", v)
+	}
+
+	strict := ParseOptions{ErrorOnDuplicateProps: true}
+	_, err = strict.ParseString("node a=1 a=2")
+	if want := `1:10: duplicate property "a", first set at line 1 col 6`; err == nil || err.Error() != want {
+		t.Errorf("strict Parse = %v, want %q", err, want)
+	}
+	if err := strict.Validate(strings.NewReader("node a=1 b=2 \\\n  a=3")); err == nil {
+		t.Errorf("strict Validate with duplicate props succeeded, want error")
+	}
+	for _, in := range []string{
+		"node a=1 b=2",
+		"node a=1 /-a=2",
+		"node a=1 { child a=2; }",
+		"node a=1; other a=2",
+		`node a=1 "a"`,
+	} {
+		if _, err := strict.ParseString(in); err != nil {
+			t.Errorf("strict Parse(%q) failed: %v", in, err)
+		}
+	}
+}
+
+func TestEmptyNames(t *testing.T) {
+	for _, in := range []string{`"" "arg"`, `node ""=1`, `node { "" }`} {
+		if _, err := ParseString(in); err != nil {
+			t.Errorf("Parse(%q) failed: %v", in, err)
+		}
+	}
+
+	strict := ParseOptions{ErrorOnEmptyName: true}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`"" "arg"`, "1:1: empty node name"},
+		{`node ""=1`, "1:6: empty property key"},
+		{"node {\n    \"\"\n}", "2:5: empty node name"},
+		{`(t)"" 1`, "1:4: empty node name"},
+		{`node /-""=1`, "1:8: empty property key"},
+	}
+	for _, test := range tests {
+		_, err := strict.ParseString(test.in)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("strict Parse(%q) = %v, want error %q", test.in, err, test.want)
+		}
+	}
+	for _, in := range []string{`node ""`, `node "" x=""`, `node key=""`} {
+		if _, err := strict.ParseString(in); err != nil {
+			t.Errorf("strict Parse(%q) failed: %v", in, err)
+		}
+	}
+}
+
+func TestDisallowTypeAnnotations(t *testing.T) {
+	const in = "(u8)node (i32)10 key=(date)\"2024-01-01\""
+	if _, err := ParseString(in); err != nil {
+		t.Fatalf("Parse(%q) failed: %v", in, err)
+	}
+
+	strict := ParseOptions{DisallowTypeAnnotations: true}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"node (i32)10", "1:6: type annotation (i32) is not allowed"},
+		{"(u8)node 1", "1:1: type annotation (u8) is not allowed"},
+		{"node key=(\"my type\")1", `1:10: type annotation (my type) is not allowed`},
+		{"node {\n    child (t)#true\n}", "2:11: type annotation (t) is not allowed"},
+	}
+	for _, test := range tests {
+		_, err := strict.ParseString(test.in)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("strict Parse(%q) = %v, want error %q", test.in, err, test.want)
+		}
+	}
+	if _, err := strict.ParseValue("(i32)10"); err == nil {
+		t.Errorf("strict ParseValue((i32)10) succeeded, want error")
+	}
+	if _, err := strict.ParseString("node 10 \"(i32)\" key=1"); err != nil {
+		t.Errorf("strict Parse without annotations failed: %v", err)
+	}
+}
+
+func TestParseComments(t *testing.T) {
+	in := `// leading
+/* also leading */ a 1 /* inner */ 2 // trailing
+b {
+    // child
+    c
+    // dangling
+} // after
+/-d // ignored
+e; f
+// end
+`
+	want := &Document{
+		Nodes: []*Node{
+			{
+				Name:             "a",
+				Args:             []Value{IntValue(1), IntValue(2)},
+				Comments:         []string{"// leading", "/* also leading */"},
+				EntryComments:    []EntryComment{{Text: "/* inner */", Arg: 1, Prop: -1}},
+				TrailingComments: []string{"// trailing"},
+			},
+			{
+				Name: "b",
+				Children: []*Node{
+					{Name: "c", Comments: []string{"// child"}},
+				},
+				EndComments:      []string{"// dangling"},
+				TrailingComments: []string{"// after"},
+			},
+			{Name: "e", Comments: []string{"// ignored"}},
+			{Name: "f"},
+		},
+		Comments: []string{"// end"},
+	}
+
+	opts := ParseOptions{LexerOptions: LexerOptions{Comments: true}}
+	got, err := opts.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if diff := cmp.Diff(got, want, cmpValues); diff != "" {
+		t.Errorf("wrong result (-got+want):\n%s", diff)
+	}
+
+	// By default, comments are discarded.
+	got, err = Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got.Comments != nil || got.Nodes[0].Comments != nil || got.Nodes[0].TrailingComments != nil {
+		t.Errorf("Parse without comments kept comments: %#v", got)
+	}
+}
+
+func TestUnbalancedBrackets(t *testing.T) {
+	tests := []struct {
+		file string
+		pos  Pos
+		want string
+	}{
+		{"unclosed_children_block.kdl", Pos{55, 6, 1}, "unexpected EOF, unclosed '{' opened at line 1 col 6"},
+		{"extra_close_brace.kdl", Pos{21, 4, 1}, "unexpected '}' with no matching '{'"},
+	}
+
+	for _, test := range tests {
+		bs, err := os.ReadFile(filepath.Join("testdata/invalid", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Parse(bytes.NewReader(bs))
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("Parse(%s) returned %v, want ParseError", test.file, err)
+			continue
+		}
+		if perr.Pos != test.pos || perr.Err.Error() != test.want {
+			t.Errorf("Parse(%s) = %q at %#v, want %q at %#v", test.file, perr.Err, perr.Pos, test.want, test.pos)
+		}
+	}
+}
+
+// knownBad are the documents in testdata/invalid that the lexer
+// accepts, because of known gaps in it.
+var knownBad = map[string]bool{
+	"testdata/invalid/underscore_in_fraction.kdl": true,
+}
+
+func TestParseConformance(t *testing.T) {
+	// Every valid document in the conformance suite must parse, and
+	// survive a round trip through Format unchanged. Every invalid
+	// one must fail to parse.
+	valid, err := filepath.Glob("testdata/valid/*.kdl")
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	for _, n := range valid {
+		t.Run(n, func(t *testing.T) {
+			bs, err := os.ReadFile(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := ParseBytes(bs)
+			if err != nil {
+				t.Fatalf("Parse failed: %v\n%s", err, bs)
+			}
+			var b bytes.Buffer
+			if err := Format(bytes.NewReader(bs), &b); err != nil {
+				t.Fatalf("Format failed: %v\n%s", err, bs)
+			}
+			doc2, err := ParseBytes(b.Bytes())
+			if err != nil {
+				t.Fatalf("parsing formatted document: %v\n%s", err, b.String())
+			}
+			if !doc2.Equal(doc) {
+				t.Errorf("round trip through Format changed document:\n%s\nwant:\n%s", doc2.DebugString(), doc.DebugString())
+			}
+		})
+	}
+
+	invalid, err := filepath.Glob("testdata/invalid/*.kdl")
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	for _, n := range invalid {
+		t.Run(n, func(t *testing.T) {
+			if knownBad[n] {
+				t.Skip("known gap in the lexer")
+			}
+			bs, err := os.ReadFile(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc, err := ParseBytes(bs); err == nil {
+				t.Errorf("Parse succeeded, want error. Got:\n%s\n%s", doc.DebugString(), bs)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, dir := range []string{"valid", "invalid"} {
+		ms, err := filepath.Glob(filepath.Join("testdata", dir, "*.kdl"))
+		if err != nil {
+			t.Fatalf("glob failed: %v", err)
+		}
+		for _, n := range ms {
+			bs, err := os.ReadFile(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Validate(bytes.NewReader(bs))
+			switch {
+			case dir == "valid" && err != nil:
+				t.Errorf("Validate(%s) = %v, want nil", n, err)
+			case dir == "invalid" && err == nil && !knownBad[n]:
+				t.Errorf("Validate(%s) succeeded, want error", n)
+			}
+		}
+	}
+
+	err := Validate(strings.NewReader("a {\n  b 1 2\n  c }\n}"))
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Validate returned %v, want ParseError", err)
+	}
+	if want := (Pos{Offset: 18, Line: 4, Column: 1}); perr.Pos != want {
+		t.Errorf("Validate error at %#v, want %#v", perr.Pos, want)
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	ms, err := filepath.Glob("testdata/valid/*.kdl")
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	for _, n := range ms {
+		bs, err := os.ReadFile(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := Parse(bytes.NewBuffer(bs))
+		if err != nil {
+			t.Fatalf("Parse(%s) failed: %v", n, err)
+		}
+		got, err := ParseBytes(bs)
+		if err != nil {
+			t.Fatalf("ParseBytes(%s) failed: %v", n, err)
+		}
+		if diff := cmp.Diff(got, want, cmpValues, cmpopts.EquateNaNs()); diff != "" {
+			t.Errorf("ParseBytes(%s) wrong result (-got+want):\n%s", n, diff)
+		}
+		got, err = ParseString(string(bs))
+		if err != nil {
+			t.Fatalf("ParseString(%s) failed: %v", n, err)
+		}
+		if diff := cmp.Diff(got, want, cmpValues, cmpopts.EquateNaNs()); diff != "" {
+			t.Errorf("ParseString(%s) wrong result (-got+want):\n%s", n, diff)
+		}
+	}
+
+	if _, err := ParseString("a {"); err == nil {
+		t.Errorf("ParseString of an invalid document succeeded")
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	i8 := IntValue(5)
+	i8.TypeAnnotation = "i8"
+	tests := []struct {
+		in   string
+		want Value
+	}{
+		{`"x"`, StringValue("x")},
+		{"3.14", FloatValue(3.14)},
+		{"#true", BoolValue(true)},
+		{"#null", NullValue()},
+		{"0x10", IntValue(16)},
+		{"(i8)5", i8},
+	}
+	for _, test := range tests {
+		got, err := ParseValue(test.in)
+		if err != nil {
+			t.Errorf("ParseValue(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("ParseValue(%q) = %#v, want %#v", test.in, got, test.want)
+		}
+	}
+
+	errs := []struct {
+		in   string
+		want string
+	}{
+		{"1 2", "1:2: unexpected Space after value"},
+		{"1;", "1:2: unexpected Semicolon after value"},
+		{"x", `1:1: bare identifier "x" cannot be used as a value`},
+		{"", "1:1: unexpected EOF looking for value"},
+		{"(i8)", "1:5: unexpected EOF looking for value"},
+	}
+	for _, test := range errs {
+		if _, err := ParseValue(test.in); err == nil || err.Error() != test.want {
+			t.Errorf("ParseValue(%q) = %v, want %q", test.in, err, test.want)
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	const in = `good1 1
+bad1 1 a c
+good2 {
+    bad2 x= { child; }
+    good3
+}
+bad3 (u8); good4 "end"
+`
+	doc, errs := ParseAll(strings.NewReader(in))
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		`2:8: bare identifier "a" cannot be used as a value`,
+		"4:12: unexpected Space looking for value",
+		"7:10: unexpected Semicolon looking for value",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong errors (-got+want):\n%s", diff)
+	}
+
+	var names []string
+	var walk func([]*Node)
+	walk = func(nodes []*Node) {
+		for _, n := range nodes {
+			names = append(names, n.Name)
+			walk(n.Children)
+		}
+	}
+	walk(doc.Nodes)
+	if diff := cmp.Diff(names, []string{"good1", "good2", "good3", "good4"}); diff != "" {
+		t.Errorf("wrong nodes (-got+want):\n%s", diff)
+	}
+
+	tests := []struct {
+		in    string
+		nodes int
+		errs  []string
+	}{
+		{"a\n}\nb\n}\nc", 3, []string{
+			"2:1: unexpected '}' with no matching '{'",
+			"4:1: unexpected '}' with no matching '{'",
+		}},
+		// Unclosed blocks keep what they have so far.
+		{"a {\n  b {\n", 1, []string{
+			"3:1: unexpected EOF, unclosed '{' opened at line 2 col 5",
+			"3:1: unexpected EOF, unclosed '{' opened at line 1 col 3",
+		}},
+		// Lexer errors end parsing.
+		{"a\nb \"unterminated\nc", 1, []string{"3:2: EOF during string"}},
+		{"a { b \"\\q\" }\nc", 0, []string{`1:10: unknown escape sequence \q`}},
+	}
+	for _, test := range tests {
+		doc, errs := ParseAll(strings.NewReader(test.in))
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if diff := cmp.Diff(got, test.errs); diff != "" {
+			t.Errorf("ParseAll(%q) wrong errors (-got+want):\n%s", test.in, diff)
+		}
+		if len(doc.Nodes) != test.nodes {
+			t.Errorf("ParseAll(%q) got %d nodes, want %d", test.in, len(doc.Nodes), test.nodes)
+		}
+	}
+
+	if doc, errs := ParseAll(strings.NewReader("a 1 { b; }")); len(errs) != 0 || len(doc.Nodes) != 1 {
+		t.Errorf("ParseAll of a valid document = %d nodes, %v, want 1 node and no errors", len(doc.Nodes), errs)
+	}
+}
+
+func TestValueTypeAnnotations(t *testing.T) {
+	doc, err := Parse(strings.NewReader(`node (u8)1 ("quoted type")"a" key=(str)"x" /-(i8)2`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	u8 := IntValue(1)
+	u8.TypeAnnotation = "u8"
+	quoted := StringValue("a")
+	quoted.TypeAnnotation = "quoted type"
+	str := StringValue("x")
+	str.TypeAnnotation = "str"
+	want := []*Node{{Name: "node", Args: []Value{u8, quoted}, Props: []Prop{{Key: "key", Value: str}}}}
+	if diff := cmp.Diff(doc.Nodes, want, cmpValues); diff != "" {
+		t.Errorf("wrong result (-got+want):\n%s", diff)
+	}
+
+	for _, in := range []string{
+		"node (u8) 1",
+		"node (1)2",
+		"node (u8",
+		"node (u8)bare",
+		"node(u8)1",
+		"node (a)(b)1",
+		"node key=(u8)",
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestNodeTypeAnnotations(t *testing.T) {
+	const in = "(author)person name=(str)\"ann\" {\n    (\"quoted type\")child\n    /-(skipped)child\n}\n"
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	str := StringValue("ann")
+	str.TypeAnnotation = "str"
+	want := []*Node{{
+		TypeAnnotation: "author",
+		Name:           "person",
+		Props:          []Prop{{Key: "name", Value: str}},
+		Children:       []*Node{{TypeAnnotation: "quoted type", Name: "child"}},
+	}}
+	if diff := cmp.Diff(doc.Nodes, want, cmpValues); diff != "" {
+		t.Errorf("wrong result (-got+want):\n%s", diff)
+	}
+
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	const wantKDL = "(author)person name=(str)\"ann\" {\n    (\"quoted type\")child\n}\n"
+	if diff := cmp.Diff(b.String(), wantKDL); diff != "" {
+		t.Errorf("wrong encoding (-got+want):\n%s", diff)
+	}
+
+	for _, in := range []string{
+		"(author) person",
+		"(author)",
+		"(author)1",
+		"(author)(again)person",
+		"(1)person",
+		"/-(author)",
+	} {
+		if _, err := ParseString(in); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	const in = `a 1 (u8)2 k="v" /-3
+b /* c */ {
+    c
+} // x
+(t)d; e
+`
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := func(s Span) string { return in[s.Start.Offset:s.End.Offset] }
+
+	var got []string
+	Walk(doc, func(n *Node, depth int) error {
+		got = append(got, text(n.Span))
+		for _, v := range n.Args {
+			got = append(got, "  "+text(v.Span()))
+		}
+		for _, p := range n.Props {
+			got = append(got, "  "+p.Key+"="+text(p.Value.Span()))
+		}
+		return nil
+	})
+	want := []string{
+		`a 1 (u8)2 k="v" /-3`,
+		"  1",
+		"  (u8)2",
+		`  k="v"`,
+		"b /* c */ {\n    c\n}",
+		"c",
+		"(t)d",
+		"e",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong span text (-got+want):\n%s", diff)
+	}
+
+	b := doc.Nodes[1]
+	wantSpan := Span{
+		Start: Pos{Offset: 20, Line: 2, Column: 1},
+		End:   Pos{Offset: 39, Line: 4, Column: 2},
+	}
+	if b.Span != wantSpan {
+		t.Errorf("b.Span = %#v, want %#v", b.Span, wantSpan)
+	}
+	if s := b.Children[0].Span; s.Start != (Pos{Offset: 36, Line: 3, Column: 5}) {
+		t.Errorf("c starts at %#v, want offset 36, line 3 col 5", s.Start)
+	}
+	if s := NewNode("x", IntValue(1)).Args[0].Span(); s != (Span{}) {
+		t.Errorf("constructed value has span %+v, want zero", s)
+	}
+}
@@ -0,0 +1,584 @@
+package kdl
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Query returns the nodes of doc that match the KQL query q, in
+// document order and without duplicates.
+//
+// Query implements a subset of KQL, the KDL query language:
+//
+//	a b          // any b that is a descendant of an a
+//	a > b        // any b that is a child of an a
+//	a || b       // any a, and any b
+//	top()        // the top-level nodes of doc
+//	top() > a    // any top-level a
+//	name         // nodes called name, which may also be a quoted string
+//	(type)       // nodes with type annotation type
+//	()           // nodes with any type annotation
+//	[]           // any node
+//	[key]        // nodes with property key, short for [prop(key)]
+//	[prop(key)]  // nodes with property key
+//	[val()]      // nodes with at least one argument
+//	[val(2)]     // nodes with at least three arguments
+//	[name()]     // any node
+//	[tag()]      // nodes with a type annotation
+//
+// A name, type annotation and any number of [] matchers can be
+// combined into a single selector, such as (type)name[a][b].
+//
+// The accessors in a matcher can be compared to a value, such as
+// [key = 1] or [val(0) != "x"]. The operators = and != compare
+// values with Value.Equal, ignoring type annotations. <, <=, > and >=
+// compare numbers, and ^=, $= and *= test whether a string starts
+// with, ends with or contains the given string. A node whose
+// accessor has no value, or a value of the wrong kind for the
+// operator, doesn't match.
+//
+// The sibling combinators + and ~, and the values() and props()
+// accessors, are not supported, and return an error.
+func Query(doc *Document, q string) ([]*Node, error) {
+	sels, err := parseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &Node{Children: doc.Nodes}
+	matched := map[*Node]bool{}
+	for _, s := range sels {
+		for _, n := range s.match(root) {
+			matched[n] = true
+		}
+	}
+	var ret []*Node
+	var walk func([]*Node)
+	walk = func(ns []*Node) {
+		for _, n := range ns {
+			if matched[n] {
+				ret = append(ret, n)
+			}
+			walk(n.Children)
+		}
+	}
+	walk(doc.Nodes)
+	return ret, nil
+}
+
+// selector is one of the ||-separated alternatives of a query.
+type selector struct {
+	top   bool // starts with top()
+	steps []step
+}
+
+// step is one filter in a selector, with its relationship to the
+// nodes matched by the previous step.
+type step struct {
+	child bool // a child of the previous match, rather than any descendant
+	f     filter
+}
+
+// filter is a combination of a name, a type annotation and matchers,
+// all of which a node must match.
+type filter struct {
+	name     *string
+	typ      *string
+	anyType  bool // () matches any type annotation
+	matchers []matcher
+}
+
+// matcher is a [] matcher of a filter.
+type matcher struct {
+	acc accessor
+	op  string // empty if the matcher has no comparison
+	val Value
+}
+
+type accessorKind int
+
+const (
+	accessAny accessorKind = iota // []
+	accessName
+	accessTag
+	accessVal
+	accessProp
+)
+
+// accessor is the part of a node that a matcher looks at.
+type accessor struct {
+	kind  accessorKind
+	index int    // for accessVal
+	key   string // for accessProp
+}
+
+// match returns the nodes under root that s matches.
+func (s selector) match(root *Node) []*Node {
+	if s.top && len(s.steps) == 0 {
+		return root.Children
+	}
+	cur := []*Node{root}
+	for _, st := range s.steps {
+		var next []*Node
+		seen := map[*Node]bool{}
+		add := func(n *Node) {
+			if !seen[n] && st.f.match(n) {
+				seen[n] = true
+				next = append(next, n)
+			}
+		}
+		var descend func(*Node)
+		descend = func(n *Node) {
+			for _, c := range n.Children {
+				add(c)
+				descend(c)
+			}
+		}
+		for _, n := range cur {
+			if st.child {
+				for _, c := range n.Children {
+					add(c)
+				}
+			} else {
+				descend(n)
+			}
+		}
+		cur = next
+	}
+	return cur
+}
+
+func (f filter) match(n *Node) bool {
+	switch {
+	case f.name != nil && n.Name != *f.name:
+		return false
+	case f.typ != nil && n.TypeAnnotation != *f.typ:
+		return false
+	case f.anyType && n.TypeAnnotation == "":
+		return false
+	}
+	for _, m := range f.matchers {
+		if !m.match(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m matcher) match(n *Node) bool {
+	var v Value
+	switch m.acc.kind {
+	case accessAny:
+		return true
+	case accessName:
+		v = StringValue(n.Name)
+	case accessTag:
+		if n.TypeAnnotation == "" {
+			return false
+		}
+		v = StringValue(n.TypeAnnotation)
+	case accessVal:
+		arg, ok := n.Arg(m.acc.index)
+		if !ok {
+			return false
+		}
+		v = arg
+	case accessProp:
+		prop, ok := n.Prop(m.acc.key)
+		if !ok {
+			return false
+		}
+		v = prop
+	}
+	if m.op == "" {
+		return true
+	}
+	return compareValues(v, m.op, m.val)
+}
+
+// compareValues reports whether v op want holds, for a KQL
+// comparison operator op.
+func compareValues(v Value, op string, want Value) bool {
+	v.TypeAnnotation, want.TypeAnnotation = "", ""
+	switch op {
+	case "=":
+		return v.Equal(want)
+	case "!=":
+		return !v.Equal(want)
+	case "<", "<=", ">", ">=":
+		a, aok := queryNumber(v)
+		b, bok := queryNumber(want)
+		if !aok || !bok {
+			return false
+		}
+		c := a.Cmp(b)
+		switch op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	default:
+		a, aok := v.AsString()
+		b, bok := want.AsString()
+		if !aok || !bok {
+			return false
+		}
+		switch op {
+		case "^=":
+			return strings.HasPrefix(a, b)
+		case "$=":
+			return strings.HasSuffix(a, b)
+		default:
+			return strings.Contains(a, b)
+		}
+	}
+}
+
+// queryNumber returns the number v for an ordered comparison, and
+// whether v is a number other than NaN.
+func queryNumber(v Value) (*big.Float, bool) {
+	if bi, ok := v.AsBigInt(); ok {
+		return new(big.Float).SetInt(bi), true
+	}
+	return v.AsBigFloat()
+}
+
+// queryOperators are KQL's comparison operators, longest first so
+// that >= isn't read as >.
+var queryOperators = []string{">=", "<=", "!=", "^=", "$=", "*=", "=", ">", "<"}
+
+// queryParser parses a KQL query.
+type queryParser struct {
+	q   string
+	pos int // byte offset in q of the next rune
+}
+
+func parseQuery(q string) ([]selector, error) {
+	p := &queryParser{q: q}
+	var ret []selector
+	for {
+		s, err := p.selector()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+		if p.done() {
+			return ret, nil
+		}
+		// selector only stops early at a ||.
+		p.accept("||")
+	}
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid query %q at offset %d: %s", p.q, p.pos, fmt.Sprintf(format, args...))
+}
+
+// unexpected returns an error for the rune at the current position.
+func (p *queryParser) unexpected(context string) error {
+	if p.done() {
+		return p.errorf("unexpected end of query %s", context)
+	}
+	r, _ := utf8.DecodeRuneInString(p.q[p.pos:])
+	return p.errorf("unexpected %q %s", r, context)
+}
+
+func (p *queryParser) done() bool {
+	return p.pos >= len(p.q)
+}
+
+func (p *queryParser) lookingAt(s string) bool {
+	return strings.HasPrefix(p.q[p.pos:], s)
+}
+
+// accept consumes s if the query continues with it, and reports
+// whether it did.
+func (p *queryParser) accept(s string) bool {
+	if p.lookingAt(s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// skipSpace consumes whitespace, and reports whether there was any.
+func (p *queryParser) skipSpace() bool {
+	start := p.pos
+	for !p.done() {
+		r, n := utf8.DecodeRuneInString(p.q[p.pos:])
+		if !space(r) && !newline(r) {
+			break
+		}
+		p.pos += n
+	}
+	return p.pos > start
+}
+
+// selector parses one alternative of the query, up to the end of the
+// query or the next ||.
+func (p *queryParser) selector() (selector, error) {
+	var s selector
+	p.skipSpace()
+	if p.accept("top()") {
+		s.top = true
+	}
+	child := false
+	for {
+		spaced := p.skipSpace()
+		empty := !s.top && len(s.steps) == 0
+		switch {
+		case p.done() || p.lookingAt("||"):
+			if empty || child {
+				return selector{}, p.unexpected("looking for a selector")
+			}
+			return s, nil
+		case p.lookingAt(">"):
+			if empty || child {
+				return selector{}, p.unexpected("looking for a selector")
+			}
+			p.pos++
+			child = true
+			continue
+		case p.lookingAt("+"), p.lookingAt("~"):
+			return selector{}, p.errorf("sibling combinator %q is not supported", p.q[p.pos])
+		case p.lookingAt("top()"):
+			return selector{}, p.errorf("top() is only allowed at the start of a selector")
+		case !empty && !spaced && !child:
+			return selector{}, p.unexpected("after selector, expected space, '>' or '||'")
+		}
+		f, err := p.filter()
+		if err != nil {
+			return selector{}, err
+		}
+		s.steps = append(s.steps, step{child: child, f: f})
+		child = false
+	}
+}
+
+// filter parses a node name, type annotation and [] matchers.
+func (p *queryParser) filter() (filter, error) {
+	var f filter
+	start := p.pos
+	if p.accept("(") {
+		if p.accept(")") {
+			f.anyType = true
+		} else {
+			typ, err := p.name()
+			if err != nil {
+				return filter{}, err
+			}
+			if !p.accept(")") {
+				return filter{}, p.unexpected("after type annotation, expected ')'")
+			}
+			f.typ = &typ
+		}
+	}
+	if r := p.peekRune(); !p.done() && (r == '"' || queryIdentifierCharacter(r)) {
+		name, err := p.name()
+		if err != nil {
+			return filter{}, err
+		}
+		f.name = &name
+	}
+	for p.accept("[") {
+		m, err := p.matcher()
+		if err != nil {
+			return filter{}, err
+		}
+		f.matchers = append(f.matchers, m)
+	}
+	if p.pos == start {
+		return filter{}, p.unexpected("looking for a selector")
+	}
+	return f, nil
+}
+
+func (p *queryParser) peekRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.q[p.pos:])
+	return r
+}
+
+// matcher parses a [] matcher, whose opening bracket has already been
+// read.
+func (p *queryParser) matcher() (matcher, error) {
+	var m matcher
+	p.skipSpace()
+	if p.accept("]") {
+		return m, nil
+	}
+	acc, err := p.accessor()
+	if err != nil {
+		return matcher{}, err
+	}
+	m.acc = acc
+	p.skipSpace()
+	if p.accept("]") {
+		return m, nil
+	}
+	for _, op := range queryOperators {
+		if p.accept(op) {
+			m.op = op
+			break
+		}
+	}
+	if m.op == "" {
+		return matcher{}, p.unexpected("in matcher, expected operator or ']'")
+	}
+	p.skipSpace()
+	if m.val, err = p.value(); err != nil {
+		return matcher{}, err
+	}
+	p.skipSpace()
+	if !p.accept("]") {
+		return matcher{}, p.unexpected("after matcher, expected ']'")
+	}
+	return m, nil
+}
+
+// accessor parses the accessor of a [] matcher.
+func (p *queryParser) accessor() (accessor, error) {
+	start := p.pos
+	key, err := p.name()
+	if err != nil {
+		return accessor{}, err
+	}
+	if !p.accept("(") {
+		return accessor{kind: accessProp, key: key}, nil
+	}
+	switch key {
+	case "name", "tag":
+		if !p.accept(")") {
+			return accessor{}, p.unexpected("after " + key + "(, expected ')'")
+		}
+		if key == "tag" {
+			return accessor{kind: accessTag}, nil
+		}
+		return accessor{kind: accessName}, nil
+	case "val":
+		end := strings.IndexByte(p.q[p.pos:], ')')
+		if end < 0 {
+			return accessor{}, p.unexpected("in val(), expected ')'")
+		}
+		idx := 0
+		if arg := p.q[p.pos : p.pos+end]; arg != "" {
+			if idx, err = strconv.Atoi(arg); err != nil || idx < 0 {
+				return accessor{}, p.errorf("invalid argument index %q", arg)
+			}
+		}
+		p.pos += end + 1
+		return accessor{kind: accessVal, index: idx}, nil
+	case "prop":
+		key, err := p.name()
+		if err != nil {
+			return accessor{}, err
+		}
+		if !p.accept(")") {
+			return accessor{}, p.unexpected("after prop(key, expected ')'")
+		}
+		return accessor{kind: accessProp, key: key}, nil
+	case "values", "props":
+		p.pos = start
+		return accessor{}, p.errorf("accessor %s() is not supported", key)
+	default:
+		p.pos = start
+		return accessor{}, p.errorf("unknown accessor %s()", key)
+	}
+}
+
+// name parses a bare identifier or a quoted string.
+func (p *queryParser) name() (string, error) {
+	if p.lookingAt(`"`) || p.lookingAt(`r"`) || p.lookingAt(`r#`) {
+		start := p.pos
+		v, err := p.value()
+		if err != nil {
+			return "", err
+		}
+		s, ok := v.AsString()
+		if !ok {
+			p.pos = start
+			return "", p.errorf("expected a name, got %s value", v.Kind())
+		}
+		return s, nil
+	}
+	start := p.pos
+	for !p.done() {
+		r, n := utf8.DecodeRuneInString(p.q[p.pos:])
+		if !queryIdentifierCharacter(r) {
+			break
+		}
+		p.pos += n
+	}
+	if p.pos == start {
+		return "", p.unexpected("looking for a name")
+	}
+	return p.q[start:p.pos], nil
+}
+
+// queryIdentifierCharacter reports whether r can appear in a bare
+// identifier in a query. It excludes the characters of KQL's
+// operators and brackets, so names with those characters must be
+// quoted.
+func queryIdentifierCharacter(r rune) bool {
+	return identifierCharacter(r, V1) && !strings.ContainsRune("[]|>+~!^$*", r)
+}
+
+// value parses a KDL value literal at the current position.
+func (p *queryParser) value() (Value, error) {
+	start := p.pos
+	switch {
+	case p.lookingAt(`"`):
+		p.pos++
+		for !p.done() && !p.lookingAt(`"`) {
+			if p.lookingAt(`\`) {
+				p.pos++
+			}
+			p.pos++
+		}
+		p.pos++
+	case p.lookingAt(`r"`) || p.lookingAt(`r#`):
+		p.pos++
+		hashes := 0
+		for p.accept("#") {
+			hashes++
+		}
+		p.accept(`"`)
+		closing := `"` + strings.Repeat("#", hashes)
+		if end := strings.Index(p.q[p.pos:], closing); end >= 0 {
+			p.pos += end + len(closing)
+		} else {
+			p.pos = len(p.q)
+		}
+	default:
+		for !p.done() && !p.lookingAt("]") && !space(p.peekRune()) && !newline(p.peekRune()) {
+			_, n := utf8.DecodeRuneInString(p.q[p.pos:])
+			p.pos += n
+		}
+	}
+	if p.pos > len(p.q) {
+		p.pos = len(p.q)
+	}
+	lit := p.q[start:p.pos]
+	if lit == "" {
+		return Value{}, p.unexpected("looking for value")
+	}
+
+	v, err := ParseValue(lit)
+	if err != nil {
+		var perr *ParseError
+		if errors.As(err, &perr) {
+			err = perr.Err
+		}
+		p.pos = start
+		return Value{}, p.errorf("invalid value %s: %v", lit, err)
+	}
+	return v, nil
+}
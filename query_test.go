@@ -0,0 +1,117 @@
+package kdl
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQuery(t *testing.T) {
+	doc, err := ParseString(`
+package name="app" version=3 {
+    (dep)lib "json" version=1.2 optional=true
+    (dep)lib "http" version=2
+    tool "lint"
+}
+lib "top-level"
+(ci)job "test" {
+    step "build" { script "make" }
+    step "test" timeout=30 { script "make test" }
+}
+"odd name" 0x10
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		q    string
+		want []string // node name and first argument, if any
+	}{
+		{"lib", []string{"lib json", "lib http", "lib top-level"}},
+		{"package > lib", []string{"lib json", "lib http"}},
+		{"top() > lib", []string{"lib top-level"}},
+		{"top()", []string{"package", "lib top-level", "job test", "odd name 16"}},
+		{"top() > []", []string{"package", "lib top-level", "job test", "odd name 16"}},
+		{"top() > [] > []", []string{"lib json", "lib http", "tool lint", "step build", "step test"}},
+		{"job script", []string{"script make", "script make test"}},
+		{"job > script", nil},
+		{"(dep)", []string{"lib json", "lib http"}},
+		{"()", []string{"lib json", "lib http", "job test"}},
+		{"(ci)job > step[timeout] > script", []string{"script make test"}},
+		{"[optional]", []string{"lib json"}},
+		{"lib[val() = \"http\"]", []string{"lib http"}},
+		{"lib[val(0) != \"http\"]", []string{"lib json", "lib top-level"}},
+		{"[version = 3]", []string{"package"}},
+		{"[prop(version) >= 2]", []string{"package", "lib http"}},
+		{"[version < 2]", []string{"lib json"}},
+		{"[name = r\"app\"]", []string{"package"}},
+		{"[val() = 16]", []string{"odd name 16"}},
+		{"\"odd name\"", []string{"odd name 16"}},
+		{"[name() ^= \"s\"]", []string{"step build", "script make", "step test", "script make test"}},
+		{"[val() $= \"test\"]", []string{"job test", "step test", "script make test"}},
+		{"script[val() *= \" \"]", []string{"script make test"}},
+		{"[tag() = \"ci\"]", []string{"job test"}},
+		{"[val(1)]", nil},
+		{"tool || step[timeout] || lib", []string{"lib json", "lib http", "tool lint", "lib top-level", "step test"}},
+		{"job step || step", []string{"step build", "step test"}},
+		{"nope", nil},
+	}
+	for _, test := range tests {
+		got, err := Query(doc, test.q)
+		if err != nil {
+			t.Errorf("Query(%q) failed: %v", test.q, err)
+			continue
+		}
+		var names []string
+		for _, n := range got {
+			s := n.Name
+			if v, ok := n.Arg(0); ok {
+				if str, ok := v.AsString(); ok {
+					s += " " + str
+				} else if i, ok := v.AsInt(); ok {
+					s += " " + strconv.FormatInt(i, 10)
+				}
+			}
+			names = append(names, s)
+		}
+		if diff := cmp.Diff(names, test.want); diff != "" {
+			t.Errorf("wrong result for Query(%q) (-got+want):\n%s", test.q, diff)
+		}
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"", "unexpected end of query"},
+		{"a >", "unexpected end of query"},
+		{"> a", `unexpected '>'`},
+		{"a > > b", `unexpected '>'`},
+		{"a ||", "unexpected end of query"},
+		{"a + b", "sibling combinator '+' is not supported"},
+		{"a ~ b", "sibling combinator '~' is not supported"},
+		{"a top()", "top() is only allowed at the start of a selector"},
+		{"a[b", "unexpected end of query"},
+		{"a[b = ]", "unexpected ']' looking for value"},
+		{"a[b = c]", `bare identifier "c" cannot be used as a value`},
+		{"a[b = 1 2]", "after matcher, expected ']'"},
+		{"a[b ? 1]", "expected operator or ']'"},
+		{"a[values()]", "accessor values() is not supported"},
+		{"a[foo()]", "unknown accessor foo()"},
+		{"a[val(x)]", `invalid argument index "x"`},
+		{"(a", "expected ')'"},
+	}
+	for _, test := range tests {
+		_, err := Query(&Document{}, test.q)
+		if err == nil {
+			t.Errorf("Query(%q) succeeded, want error containing %q", test.q, test.want)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Query(%q) error %q, want error containing %q", test.q, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package kdl
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// UnmarshalOptions configures the behavior of Unmarshal.
+type UnmarshalOptions struct {
+	// DisallowUnknownNodes makes Unmarshal return an error when a
+	// node doesn't map to any struct field. By default, such nodes
+	// are ignored.
+	DisallowUnknownNodes bool
+
+	types map[string]func(*Value) (interface{}, error)
+}
+
+// RegisterType makes Unmarshal decode values with the type annotation
+// name by calling fn, and storing the result in the destination, which
+// it must be assignable to. It takes precedence over the built-in
+// decoding of annotations, but not over Unmarshaler and Value
+// destinations. Copies of o made after the call share its registered
+// types.
+func (o *UnmarshalOptions) RegisterType(name string, fn func(*Value) (interface{}, error)) {
+	if o.types == nil {
+		o.types = map[string]func(*Value) (interface{}, error){}
+	}
+	o.types[name] = fn
+}
+
+// Unmarshal parses the KDL document in data and stores the result in
+// the struct pointed to by v, using the field mapping described in
+// Marshal.
+//
+// A child node decodes into a scalar field from its single argument,
+// into a struct from its arguments, properties and children, and
+// into a slice of structs by appending one element per node of that
+// name. A slice of scalars collects every argument of every node of
+// that name, so colors "red" "green" decodes into a []string. Types
+// whose pointer implements Unmarshaler decode from a node's single
+// argument, using their UnmarshalKDL method.
+//
+// Values with a numeric type annotation, such as (u8) or (f32), must
+// fit in the annotated type as well as the Go type they decode into,
+// and decode into an interface{} as the matching Go type.
+//
+// Numbers also decode into big.Int and big.Float fields. Numbers too
+// large for an int64 or float64, or floats with more digits than a
+// float64 holds, decode into an interface{} as a *big.Int or
+// *big.Float.
+//
+// Strings decode into time.Time fields using the layout picked by
+// their annotation: (date) for 2006-01-02, (time) for 15:04:05, and
+// RFC 3339 otherwise, as for (date-time).
+//
+// If v is a pointer to an interface{}, Unmarshal stores the whole
+// document in it as a map[string]interface{}, in the form documented
+// by ToMap. Values decode as they would into an interface{} field,
+// including with registered types, and a value that doesn't fit its
+// annotation is an error.
+func Unmarshal(data []byte, v interface{}) error {
+	return UnmarshalOptions{}.Unmarshal(data, v)
+}
+
+// Unmarshal is like the top-level Unmarshal, using the options in o.
+func (o UnmarshalOptions) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || (rv.Elem().Kind() != reflect.Struct && rv.Elem().Type() != emptyInterfaceType) {
+		return fmt.Errorf("cannot unmarshal into %T, want a non-nil pointer to struct or interface{}", v)
+	}
+
+	doc, err := ParseBytes(data)
+	if err != nil {
+		return err
+	}
+	if rv.Elem().Kind() == reflect.Interface {
+		m, err := o.nodesToMap(doc.Nodes, false)
+		if err != nil {
+			return err
+		}
+		rv.Elem().Set(reflect.ValueOf(m))
+		return nil
+	}
+	return o.unmarshalStruct(&Node{Children: doc.Nodes}, rv.Elem())
+}
+
+// DecodeFile reads the KDL document in the file at path and stores
+// the result in v, like Unmarshal. Errors are prefixed with path.
+func DecodeFile(path string, v interface{}) error {
+	return UnmarshalOptions{}.DecodeFile(path, v)
+}
+
+// DecodeFile is like the top-level DecodeFile, using the options in
+// o.
+func (o UnmarshalOptions) DecodeFile(path string, v interface{}) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := o.Unmarshal(bs, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// unmarshalStruct decodes n's arguments, properties and children into
+// the fields of struct rv.
+func (o UnmarshalOptions) unmarshalStruct(n *Node, rv reflect.Value) error {
+	fields := structFields(rv.Type())
+	arg := 0
+	for _, f := range fields {
+		fv := rv.Field(f.index)
+		switch f.kind {
+		case fieldArg:
+			if arg >= len(n.Args) {
+				continue
+			}
+			if err := o.unmarshalValue(n.Args[arg], fv); err != nil {
+				return fmt.Errorf("field %s: %w", f.goName, err)
+			}
+			arg++
+		case fieldArgs:
+			if fv.Kind() != reflect.Slice {
+				return fmt.Errorf("field %s: args field must be a slice, not %s", f.goName, fv.Type())
+			}
+			args := n.Args[arg:]
+			arg = len(n.Args)
+			if len(args) == 0 {
+				continue
+			}
+			s := reflect.MakeSlice(fv.Type(), len(args), len(args))
+			for i, v := range args {
+				if err := o.unmarshalValue(v, s.Index(i)); err != nil {
+					return fmt.Errorf("field %s: %w", f.goName, err)
+				}
+			}
+			fv.Set(s)
+		case fieldProp:
+			for _, p := range n.Props {
+				if p.Key != f.name {
+					continue
+				}
+				if err := o.unmarshalValue(p.Value, fv); err != nil {
+					return fmt.Errorf("property %q: %w", p.Key, err)
+				}
+			}
+		}
+	}
+
+	for _, c := range n.Children {
+		f, ok := childField(fields, c.Name)
+		if !ok {
+			if o.DisallowUnknownNodes {
+				return fmt.Errorf("unknown node %q", c.Name)
+			}
+			continue
+		}
+		fv := rv.Field(f.index)
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 && !isUnmarshaler(fv) {
+			if decodesAsValue(fv.Type().Elem()) {
+				// A list of scalars, such as colors "red" "green", possibly
+				// spread across several nodes with the same name.
+				for _, v := range c.Args {
+					elem := reflect.New(fv.Type().Elem()).Elem()
+					if err := o.unmarshalValue(v, elem); err != nil {
+						return fmt.Errorf("node %q: %w", c.Name, err)
+					}
+					fv.Set(reflect.Append(fv, elem))
+				}
+				continue
+			}
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := o.unmarshalNode(c, elem); err != nil {
+				return err
+			}
+			fv.Set(reflect.Append(fv, elem))
+		} else if err := o.unmarshalNode(c, fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// childField returns the field that child nodes called name decode
+// into, preferring an exact match over a case-insensitive one.
+func childField(fields []field, name string) (field, bool) {
+	var fold *field
+	for i, f := range fields {
+		if f.kind != fieldChild {
+			continue
+		}
+		if f.name == name {
+			return f, true
+		}
+		if fold == nil && strings.EqualFold(f.name, name) {
+			fold = &fields[i]
+		}
+	}
+	if fold != nil {
+		return *fold, true
+	}
+	return field{}, false
+}
+
+// decodesAsValue reports whether unmarshalNode decodes a node into a
+// t from its argument, rather than as a struct.
+func decodesAsValue(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() != reflect.Struct || isScalarStruct(t) || reflect.PtrTo(t).Implements(unmarshalerType)
+}
+
+// unmarshalNode decodes n into rv.
+func (o UnmarshalOptions) unmarshalNode(n *Node, rv reflect.Value) error {
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct && !isScalarStruct(rv.Type()) && !isUnmarshaler(rv) {
+		if err := o.unmarshalStruct(n, rv); err != nil {
+			return fmt.Errorf("node %q: %w", n.Name, err)
+		}
+		return nil
+	}
+
+	if len(n.Args) != 1 {
+		return fmt.Errorf("node %q: need exactly one argument to decode into %s, got %d", n.Name, rv.Type(), len(n.Args))
+	}
+	if err := o.unmarshalValue(n.Args[0], rv); err != nil {
+		return fmt.Errorf("node %q: %w", n.Name, err)
+	}
+	return nil
+}
+
+// unmarshalValue decodes v into rv.
+func (o UnmarshalOptions) unmarshalValue(v Value, rv reflect.Value) error {
+	if isUnmarshaler(rv) {
+		return rv.Addr().Interface().(Unmarshaler).UnmarshalKDL(&v)
+	}
+	if rv.Type() == valueType {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+	if rv.Kind() == reflect.Ptr {
+		if v.IsNull() {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return o.unmarshalValue(v, rv.Elem())
+	}
+
+	if fn, ok := o.types[v.TypeAnnotation]; ok && v.TypeAnnotation != "" {
+		x, err := fn(&v)
+		if err != nil {
+			return fmt.Errorf("decoding (%s) value: %w", v.TypeAnnotation, err)
+		}
+		xv := reflect.ValueOf(x)
+		if !xv.IsValid() {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+		if !xv.Type().AssignableTo(rv.Type()) {
+			return fmt.Errorf("cannot decode (%s) value as %s into %s", v.TypeAnnotation, xv.Type(), rv.Type())
+		}
+		rv.Set(xv)
+		return nil
+	}
+
+	if t, ok := numericAnnotations[v.TypeAnnotation]; ok {
+		if err := checkAnnotation(v, t); err != nil {
+			return err
+		}
+		switch {
+		case rv.Kind() == reflect.Interface && rv.NumMethod() == 0:
+			// Decode as the annotated type, rather than the default
+			// int64 or float64.
+			tv := reflect.New(t).Elem()
+			if err := o.unmarshalValue(v, tv); err != nil {
+				return err
+			}
+			rv.Set(tv)
+			return nil
+		case isFloatKind(t.Kind()) && !isFloatKind(rv.Kind()):
+			return fmt.Errorf("cannot decode (%s) value into %s", v.TypeAnnotation, rv.Type())
+		}
+	}
+
+	switch rv.Type() {
+	case bigIntType:
+		if bi, ok := v.AsBigInt(); ok {
+			rv.Addr().Interface().(*big.Int).Set(bi)
+			return nil
+		}
+	case bigFloatType:
+		bf, ok := v.AsBigFloat()
+		if bi, isInt := v.AsBigInt(); isInt {
+			bf, ok = new(big.Float).SetInt(bi), true
+		}
+		if ok {
+			rv.Addr().Interface().(*big.Float).Set(bf)
+			return nil
+		}
+	case timeType:
+		if _, ok := v.AsString(); ok {
+			return unmarshalTime(v, rv)
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			break
+		}
+		if x := v.native(); x == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else {
+			rv.Set(reflect.ValueOf(x))
+		}
+		return nil
+	case reflect.String:
+		if s, ok := v.AsString(); ok {
+			rv.SetString(s)
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := v.AsBool(); ok {
+			rv.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		if ok, err := setNumber(v, rv, rv.Type().String()); ok {
+			return err
+		}
+	}
+	return fmt.Errorf("cannot decode %s value into %s", v.kind, rv.Type())
+}
+
+// timeLayouts maps the type annotations that select a time.Time
+// layout to that layout.
+var timeLayouts = map[string]string{
+	"date":      time.DateOnly,
+	"time":      time.TimeOnly,
+	"date-time": time.RFC3339,
+}
+
+// unmarshalTime parses the time string v into rv, a time.Time.
+func unmarshalTime(v Value, rv reflect.Value) error {
+	layout, ok := timeLayouts[v.TypeAnnotation]
+	if !ok {
+		layout = time.RFC3339
+	}
+	t, err := time.Parse(layout, v.str)
+	if err != nil {
+		if v.TypeAnnotation != "" {
+			return fmt.Errorf("invalid (%s) value %q: %w", v.TypeAnnotation, v.str, err)
+		}
+		return fmt.Errorf("invalid time %q: %w", v.str, err)
+	}
+	rv.Set(reflect.ValueOf(t))
+	return nil
+}
+
+// setNumber stores the number v in rv, which has a numeric kind. It
+// reports whether v is a number that rv can hold, and returns an
+// error naming typ if v is out of rv's range.
+func setNumber(v Value, rv reflect.Value, typ string) (ok bool, err error) {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.kind != KindInt {
+			return false, nil
+		}
+		if v.bi != nil || rv.OverflowInt(v.i) {
+			return true, fmt.Errorf("integer %s overflows %s", numberString(v), typ)
+		}
+		rv.SetInt(v.i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		bi, ok := v.AsBigInt()
+		if !ok {
+			return false, nil
+		}
+		if !bi.IsUint64() || rv.OverflowUint(bi.Uint64()) {
+			return true, fmt.Errorf("integer %s overflows %s", numberString(v), typ)
+		}
+		rv.SetUint(bi.Uint64())
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch {
+		case v.kind == KindFloat && v.bf != nil:
+			f, _ = v.bf.Float64()
+		case v.kind == KindFloat:
+			f = v.f
+		case v.kind == KindInt && v.bi != nil:
+			f, _ = new(big.Float).SetInt(v.bi).Float64()
+		case v.kind == KindInt:
+			f = float64(v.i)
+		default:
+			return false, nil
+		}
+		// Big numbers become infinite if they don't fit in a float64.
+		inf := math.IsInf(f, 0) && (v.bf != nil || v.kind == KindInt)
+		if inf || rv.OverflowFloat(f) {
+			return true, fmt.Errorf("float %s overflows %s", numberString(v), typ)
+		}
+		rv.SetFloat(f)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// numberString formats the number v for error messages.
+func numberString(v Value) string {
+	switch {
+	case v.bi != nil:
+		return v.bi.String()
+	case v.bf != nil:
+		return v.bf.Text('g', 10)
+	case v.kind == KindFloat:
+		return fmt.Sprint(v.f)
+	default:
+		return fmt.Sprint(v.i)
+	}
+}
+
+// numericAnnotations maps KDL's reserved numeric type annotations to
+// the Go types with the same range.
+var numericAnnotations = map[string]reflect.Type{
+	"i8":    reflect.TypeOf(int8(0)),
+	"i16":   reflect.TypeOf(int16(0)),
+	"i32":   reflect.TypeOf(int32(0)),
+	"i64":   reflect.TypeOf(int64(0)),
+	"isize": reflect.TypeOf(int(0)),
+	"u8":    reflect.TypeOf(uint8(0)),
+	"u16":   reflect.TypeOf(uint16(0)),
+	"u32":   reflect.TypeOf(uint32(0)),
+	"u64":   reflect.TypeOf(uint64(0)),
+	"usize": reflect.TypeOf(uint(0)),
+	"f32":   reflect.TypeOf(float32(0)),
+	"f64":   reflect.TypeOf(float64(0)),
+}
+
+// checkAnnotation returns an error if v doesn't fit in t, the type
+// named by its numeric type annotation.
+func checkAnnotation(v Value, t reflect.Type) error {
+	ok, err := setNumber(v, reflect.New(t).Elem(), "("+v.TypeAnnotation+")")
+	if !ok {
+		return fmt.Errorf("(%s) annotation on %s value", v.TypeAnnotation, v.kind)
+	}
+	return err
+}
+
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
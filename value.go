@@ -0,0 +1,377 @@
+package kdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//go:generate stringer -type=Kind -trimprefix=Kind
+
+// Kind is the type of a KDL value.
+type Kind int
+
+const (
+	KindNull Kind = iota
+	KindString
+	KindInt
+	KindFloat
+	KindBool
+)
+
+// Value is a KDL argument or property value. The zero Value is
+// null.
+type Value struct {
+	// TypeAnnotation is the value's (type) annotation, or empty if
+	// it has none.
+	TypeAnnotation string
+
+	kind Kind
+	str  string     // for KindString
+	raw  bool       // for KindString, parsed from a raw string
+	hash int        // for KindString, the number of # around the raw string
+	i    int64      // for KindInt
+	bi   *big.Int   // for KindInt, instead of i if it doesn't fit in an int64
+	lit  string     // for KindInt and KindFloat, the literal it was parsed from, if any
+	f    float64    // for KindFloat
+	bf   *big.Float // for KindFloat, if f is too large or not precise enough for the literal
+	b    bool       // for KindBool
+	span Span       // where v was in the parsed document, if it was
+}
+
+// NullValue returns a null Value.
+func NullValue() Value { return Value{} }
+
+// StringValue returns a string Value.
+func StringValue(s string) Value { return Value{kind: KindString, str: s} }
+
+// IntValue returns an integer Value.
+func IntValue(i int64) Value { return Value{kind: KindInt, i: i} }
+
+// BigIntValue returns an integer Value of any size.
+func BigIntValue(i *big.Int) Value {
+	if i.IsInt64() {
+		return IntValue(i.Int64())
+	}
+	return Value{kind: KindInt, bi: new(big.Int).Set(i)}
+}
+
+// FloatValue returns a floating point Value.
+func FloatValue(f float64) Value { return Value{kind: KindFloat, f: f} }
+
+// BigFloatValue returns a floating point Value of any size and
+// precision.
+func BigFloatValue(f *big.Float) Value {
+	ff, acc := f.Float64()
+	if acc == big.Exact {
+		return FloatValue(ff)
+	}
+	return Value{kind: KindFloat, f: ff, bf: new(big.Float).Copy(f)}
+}
+
+// BoolValue returns a boolean Value.
+func BoolValue(b bool) Value { return Value{kind: KindBool, b: b} }
+
+// Span returns where v was in the parsed document, from its type
+// annotation, if any, to the end of its literal. It returns the zero
+// Span for values that weren't parsed from a document.
+func (v Value) Span() Span { return v.span }
+
+// Kind returns the kind of v.
+func (v Value) Kind() Kind { return v.kind }
+
+// AsString returns v's string, and whether v is a string.
+func (v Value) AsString() (string, bool) {
+	return v.str, v.kind == KindString
+}
+
+// RawHashes reports whether v is a string parsed from a raw string,
+// such as r#"a"b"#, and returns the number of # around it.
+func (v Value) RawHashes() (hashes int, ok bool) {
+	return v.hash, v.kind == KindString && v.raw
+}
+
+// AsInt returns v's integer, and whether v is an integer that fits
+// in an int64.
+func (v Value) AsInt() (int64, bool) {
+	return v.i, v.kind == KindInt && v.bi == nil
+}
+
+// AsBigInt returns v's integer, and whether v is an integer of any
+// size. The returned Int is a copy.
+func (v Value) AsBigInt() (*big.Int, bool) {
+	switch {
+	case v.kind != KindInt:
+		return nil, false
+	case v.bi != nil:
+		return new(big.Int).Set(v.bi), true
+	default:
+		return big.NewInt(v.i), true
+	}
+}
+
+// IntBase returns the radix that v's integer was written in: 2, 8 or
+// 16 for the 0b, 0o and 0x prefixes, and 10 otherwise, including for
+// integers that weren't parsed from a document. It returns 0 if v
+// isn't an integer.
+func (v Value) IntBase() int {
+	if v.kind != KindInt {
+		return 0
+	}
+	_, _, base := splitInt(v.lit)
+	return base
+}
+
+// AsFloat returns v's floating point number, and whether v is a
+// float that a float64 holds without losing any of the digits it was
+// written with. 0.1 is, even though no float64 is exactly one tenth,
+// but 1.0e400 and 0.10000000000000000001 aren't, and AsBigFloat is
+// needed to get at them. For those, the returned float64 is the
+// nearest one, or an infinity.
+func (v Value) AsFloat() (float64, bool) {
+	return v.f, v.kind == KindFloat && v.bf == nil
+}
+
+// AsBigFloat returns v's floating point number, and whether v is a
+// float other than NaN, which big.Float can't represent. The returned
+// Float is a copy.
+func (v Value) AsBigFloat() (*big.Float, bool) {
+	switch {
+	case v.kind != KindFloat || math.IsNaN(v.f):
+		return nil, false
+	case v.bf != nil:
+		return new(big.Float).Copy(v.bf), true
+	default:
+		return big.NewFloat(v.f), true
+	}
+}
+
+// AsBool returns v's boolean, and whether v is a boolean.
+func (v Value) AsBool() (bool, bool) {
+	return v.b, v.kind == KindBool
+}
+
+// IsInteger reports whether v is an integer of any size. Integers
+// and floats are different kinds, even when they're numerically
+// equal: 1 is an integer, but 1.0 is a float.
+func (v Value) IsInteger() bool {
+	return v.kind == KindInt
+}
+
+// IsNull reports whether v is null.
+func (v Value) IsNull() bool {
+	return v.kind == KindNull
+}
+
+// Equal reports whether v and o have the same kind, type annotation
+// and decoded value, such that 0x10 equals 16. Integers and floats
+// are never equal to each other.
+//
+// Equal compares structure rather than following IEEE 754, so NaN
+// equals NaN, and a document containing #nan equals itself. 0.0 and
+// -0.0 are equal.
+func (v Value) Equal(o Value) bool {
+	if v.kind != o.kind || v.TypeAnnotation != o.TypeAnnotation {
+		return false
+	}
+	switch v.kind {
+	case KindString:
+		return v.str == o.str
+	case KindInt:
+		if v.bi != nil || o.bi != nil {
+			vi, _ := v.AsBigInt()
+			oi, _ := o.AsBigInt()
+			return vi.Cmp(oi) == 0
+		}
+		return v.i == o.i
+	case KindFloat:
+		if v.bf != nil || o.bf != nil {
+			vf, vok := v.AsBigFloat()
+			of, ook := o.AsBigFloat()
+			return vok && ook && vf.Cmp(of) == 0
+		}
+		return v.f == o.f || (math.IsNaN(v.f) && math.IsNaN(o.f))
+	case KindBool:
+		return v.b == o.b
+	default:
+		return true
+	}
+}
+
+// AppendText appends the KDL literal form of v, including its type
+// annotation, to b, as the encoder would write it in KDL v2.
+func (v Value) AppendText(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeValue(&buf, v, V2); err != nil {
+		return nil, err
+	}
+	return append(b, buf.Bytes()...), nil
+}
+
+// MarshalText implements encoding.TextMarshaler, returning the KDL
+// literal form of v, such as "foo" with its quotes, 0.5, #true or
+// (u8)255.
+func (v Value) MarshalText() ([]byte, error) {
+	return v.AppendText(nil)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, parsing text
+// with ParseValue.
+func (v *Value) UnmarshalText(text []byte) error {
+	pv, err := ParseValue(string(text))
+	if err != nil {
+		return err
+	}
+	*v = pv
+	return nil
+}
+
+// native returns v as the Go type that Unmarshal decodes it into
+// when the destination is an interface{}, ignoring any type
+// annotation.
+func (v Value) native() interface{} {
+	switch {
+	case v.kind == KindString:
+		return v.str
+	case v.kind == KindInt && v.bi != nil:
+		bi, _ := v.AsBigInt()
+		return bi
+	case v.kind == KindInt:
+		return v.i
+	case v.kind == KindFloat && v.bf != nil:
+		bf, _ := v.AsBigFloat()
+		return bf
+	case v.kind == KindFloat:
+		return v.f
+	case v.kind == KindBool:
+		return v.b
+	default:
+		return nil
+	}
+}
+
+// clone returns a copy of v that doesn't share its big numbers.
+func (v Value) clone() Value {
+	if v.bi != nil {
+		v.bi = new(big.Int).Set(v.bi)
+	}
+	if v.bf != nil {
+		v.bf = new(big.Float).Copy(v.bf)
+	}
+	return v
+}
+
+// parseInt decodes a KDL integer literal, which may have a sign, a
+// radix prefix and underscores.
+func parseInt(lit string) (Value, error) {
+	sign, digits, base := splitInt(lit)
+	i, err := strconv.ParseInt(sign+digits, base, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		bi, err := ParseKDLInt(lit)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{kind: KindInt, bi: bi, lit: lit}, nil
+	} else if err != nil {
+		return Value{}, fmt.Errorf("invalid integer %s", lit)
+	}
+	return Value{kind: KindInt, i: i, lit: lit}, nil
+}
+
+// ParseKDLInt decodes a KDL integer literal, such as -1_000 or 0xff,
+// of any size. It accepts the text of integer tokens, which may have
+// a sign, a 0x, 0o or 0b radix prefix, and underscores between
+// digits.
+func ParseKDLInt(lit string) (*big.Int, error) {
+	sign, digits, base := splitInt(lit)
+	if digits == "" || strings.ContainsAny(digits, "+-") {
+		return nil, fmt.Errorf("invalid integer %s", lit)
+	}
+	i, ok := new(big.Int).SetString(sign+digits, base)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer %s", lit)
+	}
+	return i, nil
+}
+
+// splitInt splits an integer literal into its sign, its digits
+// without underscores, and its base.
+func splitInt(lit string) (sign, digits string, base int) {
+	s := lit
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		sign, s = s[:1], s[1:]
+	}
+	base = 10
+	if len(s) > 2 && s[0] == '0' {
+		switch s[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+		if base != 10 {
+			s = s[2:]
+		}
+	}
+	return sign, strings.ReplaceAll(s, "_", ""), base
+}
+
+// parseFloat decodes a KDL floating point literal, which may have
+// underscores, or be one of the #inf, #-inf and #nan keywords.
+// Literals that are out of range for a float64, or have more
+// significant digits than a float64 can hold, are kept as a
+// big.Float.
+func parseFloat(lit string) (Value, error) {
+	switch lit {
+	case "#inf":
+		return FloatValue(math.Inf(1)), nil
+	case "#-inf":
+		return FloatValue(math.Inf(-1)), nil
+	case "#nan":
+		return FloatValue(math.NaN()), nil
+	}
+	s := strings.ReplaceAll(lit, "_", "")
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return Value{}, fmt.Errorf("invalid float %s", lit)
+	}
+	digits := significantDigits(s)
+	if err == nil && (digits == 0 || digits <= 15 && math.Abs(f) >= 0x1p-1022) {
+		// Any decimal with 15 significant digits survives a round
+		// trip through a normal float64.
+		return Value{kind: KindFloat, f: f, lit: lit}, nil
+	}
+	// Keep at least as many bits as the literal has digits.
+	prec := uint(len(s))*4 + 64
+	bf, _, err := big.ParseFloat(s, 10, prec, big.ToNearestEven)
+	if err != nil {
+		return Value{}, fmt.Errorf("invalid float %s", lit)
+	}
+	if f != 0 && !math.IsInf(f, 0) {
+		// f may still be the literal, written with more digits
+		// than needed, if it formats back to the same number.
+		short, _, _ := big.ParseFloat(strconv.FormatFloat(f, 'g', -1, 64), 10, prec, big.ToNearestEven)
+		if short.Cmp(bf) == 0 {
+			return Value{kind: KindFloat, f: f, lit: lit}, nil
+		}
+	}
+	f, _ = bf.Float64()
+	return Value{kind: KindFloat, f: f, bf: bf, lit: lit}, nil
+}
+
+// significantDigits returns the number of significant digits in the
+// mantissa of the decimal float s, from its first non-zero digit to
+// its last.
+func significantDigits(s string) int {
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.Trim(strings.Replace(strings.TrimLeft(s, "+-"), ".", "", 1), "0")
+	return len(s)
+}
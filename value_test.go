@@ -0,0 +1,447 @@
+package kdl
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// cmpValues compares Values, including their arbitrary-precision
+// numbers. It compares Documents, Nodes and Values field by field,
+// rather than with their Equal methods, so that tests also catch
+// differences in formatting and comments.
+var cmpValues = cmp.Options{
+	cmp.Transformer("raw", func(d *Document) *rawDocument { return (*rawDocument)(d) }),
+	cmp.Transformer("raw", func(n *Node) *rawNode { return (*rawNode)(n) }),
+	cmp.Transformer("raw", func(v Value) rawValue { return rawValue(v) }),
+	cmp.AllowUnexported(rawValue{}),
+	// Tested separately, by TestIntBase, TestRawHashes and TestSpans.
+	cmpopts.IgnoreFields(rawValue{}, "lit", "raw", "hash", "span"),
+	cmpopts.IgnoreFields(rawNode{}, "Span"),
+	cmp.Comparer(func(a, b *big.Int) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && a.Cmp(b) == 0)
+	}),
+	cmp.Comparer(func(a, b *big.Float) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && a.Text('g', 30) == b.Text('g', 30))
+	}),
+}
+
+// Types without Equal methods, for cmpValues.
+type (
+	rawDocument Document
+	rawNode     Node
+	rawValue    Value
+)
+
+func mustBigInt(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("bad big.Int " + s)
+	}
+	return i
+}
+
+func TestParseInt(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Value
+		wantErr bool
+	}{
+		{"0", IntValue(0), false},
+		{"+10", IntValue(10), false},
+		{"-10", IntValue(-10), false},
+		{"1_000_000", IntValue(1000000), false},
+		{"0xff", IntValue(255), false},
+		{"0xFF_FF", IntValue(65535), false},
+		{"-0x10", IntValue(-16), false},
+		{"0o777", IntValue(511), false},
+		{"0b1010", IntValue(10), false},
+		{"0b_1", IntValue(1), false},
+		{"9223372036854775807", IntValue(math.MaxInt64), false},
+		{"-9223372036854775808", IntValue(math.MinInt64), false},
+		{"9223372036854775808", BigIntValue(mustBigInt("9223372036854775808")), false},
+		{"-9223372036854775809", BigIntValue(mustBigInt("-9223372036854775809")), false},
+		{"0x8000000000000000", BigIntValue(mustBigInt("9223372036854775808")), false},
+		{"18446744073709551615", BigIntValue(mustBigInt("18446744073709551615")), false},
+		{"18446744073709551616", BigIntValue(mustBigInt("18446744073709551616")), false},
+		{"0xg", Value{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseInt(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseInt(%q) = %v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInt(%q) failed: %v", test.in, err)
+		} else if diff := cmp.Diff(got, test.want, cmpValues); diff != "" {
+			t.Errorf("parseInt(%q) wrong result (-got+want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestParseFloat(t *testing.T) {
+	huge, _, _ := big.ParseFloat("1.23E+1000", 10, 100, big.ToNearestEven)
+	tests := []struct {
+		in      string
+		want    Value
+		wantErr bool
+	}{
+		{"0.0", FloatValue(0), false},
+		{"-1.5", FloatValue(-1.5), false},
+		{"1_000.5", FloatValue(1000.5), false},
+		{"1.0e-3", FloatValue(0.001), false},
+		{"1E+2", FloatValue(100), false},
+		{"1.23E+1000", BigFloatValue(huge), false},
+		{"#inf", FloatValue(math.Inf(1)), false},
+		{"#-inf", FloatValue(math.Inf(-1)), false},
+		{"1.5x", Value{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseFloat(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseFloat(%q) = %v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFloat(%q) failed: %v", test.in, err)
+		} else if diff := cmp.Diff(got, test.want, cmpValues); diff != "" {
+			t.Errorf("parseFloat(%q) wrong result (-got+want):\n%s", test.in, diff)
+		}
+	}
+
+	if got, err := parseFloat("#nan"); err != nil || !math.IsNaN(got.f) {
+		t.Errorf("parseFloat(\"#nan\") = %v, %v, want NaN", got, err)
+	}
+}
+
+func TestBigValues(t *testing.T) {
+	maxInt := IntValue(math.MaxInt64)
+	if i, ok := maxInt.AsInt(); !ok || i != math.MaxInt64 {
+		t.Errorf("AsInt(MaxInt64) = %d, %v, want %d, true", i, ok, int64(math.MaxInt64))
+	}
+	if bi, ok := maxInt.AsBigInt(); !ok || !bi.IsInt64() || bi.Int64() != math.MaxInt64 {
+		t.Errorf("AsBigInt(MaxInt64) = %s, %v, want %d, true", bi, ok, int64(math.MaxInt64))
+	}
+
+	big1 := BigIntValue(mustBigInt("9223372036854775808"))
+	if _, ok := big1.AsInt(); ok {
+		t.Errorf("AsInt(MaxInt64+1) succeeded, want false")
+	}
+	if bi, ok := big1.AsBigInt(); !ok || bi.String() != "9223372036854775808" {
+		t.Errorf("AsBigInt(MaxInt64+1) = %s, %v, want 9223372036854775808, true", bi, ok)
+	}
+	if got := BigIntValue(big.NewInt(-5)); got.bi != nil {
+		t.Errorf("BigIntValue(-5) kept a big.Int, want an int64")
+	}
+	if got := BigFloatValue(big.NewFloat(0.5)); got.bf != nil {
+		t.Errorf("BigFloatValue(0.5) kept a big.Float, want a float64")
+	}
+
+	// Floats are big if a float64 would lose digits of their literal,
+	// by range or by precision, but not just because they're
+	// decimal.
+	floats := []struct {
+		lit string
+		big bool
+	}{
+		{"0.1", false},
+		{"1.5e400", true},
+		{"-1.5e400", true},
+		{"1.0e-400", true},
+		{"4.9e-324", true},
+		{"0.10000000000000000001", true},
+		{"3.14159265358979323846264338327950288", true},
+		{"0.1000000000000000000000", false},
+		{"0.30000000000000004", false},
+		{"1234567890.123456", false},
+	}
+	for _, test := range floats {
+		v, err := parseFloat(test.lit)
+		if err != nil {
+			t.Errorf("parseFloat(%q) failed: %v", test.lit, err)
+			continue
+		}
+		f, ok := v.AsFloat()
+		if ok == test.big {
+			t.Errorf("AsFloat(%s) = %v, %v, want ok=%v", test.lit, f, ok, !test.big)
+		}
+		if want, _ := strconv.ParseFloat(test.lit, 64); f != want {
+			t.Errorf("AsFloat(%s) = %v, want the nearest float64, %v", test.lit, f, want)
+		}
+		bf, _ := v.AsBigFloat()
+		want, _, _ := big.ParseFloat(test.lit, 10, bf.Prec(), big.ToNearestEven)
+		if test.big && bf.Cmp(want) != 0 {
+			t.Errorf("AsBigFloat(%s) = %s, want %s", test.lit, bf.Text('g', -1), want.Text('g', -1))
+		}
+	}
+
+	in := "node 9223372036854775807 9223372036854775808 -9223372036854775808 -9223372036854775809 18446744073709551616 1.5e400 0.10000000000000000001\n"
+	doc, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	got := b.String()
+	want := "node 9223372036854775807 9223372036854775808 -9223372036854775808 -9223372036854775809 18446744073709551616 1.5e+400 0.10000000000000000001\n"
+	if got != want {
+		t.Errorf("wrong round trip of big numbers:\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestValueKinds(t *testing.T) {
+	doc, err := Parse(strings.NewReader(`node "str" 42 1.5 true null`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := doc.Nodes[0].Args
+	if len(args) != 5 {
+		t.Fatalf("got %d args, want 5", len(args))
+	}
+
+	if s, ok := args[0].AsString(); !ok || s != "str" {
+		t.Errorf("args[0].AsString() = %q, %v, want \"str\", true", s, ok)
+	}
+	if _, ok := args[0].AsInt(); ok {
+		t.Errorf("args[0].AsInt() succeeded on a string")
+	}
+	if i, ok := args[1].AsInt(); !ok || i != 42 {
+		t.Errorf("args[1].AsInt() = %d, %v, want 42, true", i, ok)
+	}
+	if _, ok := args[1].AsFloat(); ok {
+		t.Errorf("args[1].AsFloat() succeeded on an int")
+	}
+	if f, ok := args[2].AsFloat(); !ok || f != 1.5 {
+		t.Errorf("args[2].AsFloat() = %v, %v, want 1.5, true", f, ok)
+	}
+	if b, ok := args[3].AsBool(); !ok || !b {
+		t.Errorf("args[3].AsBool() = %v, %v, want true, true", b, ok)
+	}
+	if !args[4].IsNull() {
+		t.Errorf("args[4].IsNull() = false, want true")
+	}
+	if args[3].IsNull() {
+		t.Errorf("args[3].IsNull() = true, want false")
+	}
+
+	wantKinds := []Kind{KindString, KindInt, KindFloat, KindBool, KindNull}
+	for i, want := range wantKinds {
+		if got := args[i].Kind(); got != want {
+			t.Errorf("args[%d].Kind() = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestIsInteger(t *testing.T) {
+	const in = "node 1 1.0 -0 -0.0 0x10 1_000.5 123456789012345678901234567890 (f64)2.0\n"
+	doc, err := ParseString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := doc.Nodes[0].Args
+	want := []bool{true, false, true, false, true, false, true, false}
+	for i, v := range args {
+		if got := v.IsInteger(); got != want[i] {
+			t.Errorf("args[%d].IsInteger() = %v, want %v", i, got, want[i])
+		}
+	}
+	if args[0].Equal(args[1]) {
+		t.Error("1 equals 1.0, want distinct values")
+	}
+	for _, v := range []Value{StringValue("1"), BoolValue(true), NullValue()} {
+		if v.IsInteger() {
+			t.Errorf("%s value IsInteger() = true, want false", v.Kind())
+		}
+	}
+
+	// Each number re-encodes as the kind it was written as.
+	var b bytes.Buffer
+	if err := NewEncoder(&b).Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+	const wantOut = "node 1 1.0 0 -0.0 16 1000.5 123456789012345678901234567890 (f64)2.0\n"
+	if got := b.String(); got != wantOut {
+		t.Errorf("encoded %q, want %q", got, wantOut)
+	}
+	doc2, err := Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range doc2.Nodes[0].Args {
+		if got := v.IsInteger(); got != want[i] {
+			t.Errorf("after round trip, args[%d].IsInteger() = %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestParseKDLInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // decimal, or empty for an error
+	}{
+		{"0", "0"},
+		{"+10", "10"},
+		{"-1_000", "-1000"},
+		{"0xdead_BEEF", "3735928559"},
+		{"-0o17", "-15"},
+		{"0b1_0", "2"},
+		{"9223372036854775808", "9223372036854775808"},
+		{"-9223372036854775809", "-9223372036854775809"},
+		{"0xABCDEF0123456789abcdef", "207698809136909011942886895"},
+		{"123456789012345678901234567890", "123456789012345678901234567890"},
+		{"", ""},
+		{"-", ""},
+		{"0x", ""},
+		{"--1", ""},
+		{"0xg", ""},
+		{"0b2", ""},
+		{"1.5", ""},
+	}
+
+	for _, test := range tests {
+		got, err := ParseKDLInt(test.in)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("ParseKDLInt(%q) = %s, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseKDLInt(%q) failed: %v", test.in, err)
+		} else if got.String() != test.want {
+			t.Errorf("ParseKDLInt(%q) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestIntBase(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"255", 10},
+		{"-1_000", 10},
+		{"0xFF", 16},
+		{"-0x10", 16},
+		{"0o17", 8},
+		{"+0b1010", 2},
+		{"0x1_0000_0000_0000_0000", 16},
+	}
+	for _, test := range tests {
+		v, err := parseInt(test.in)
+		if err != nil {
+			t.Errorf("parseInt(%q) failed: %v", test.in, err)
+			continue
+		}
+		if got := v.IntBase(); got != test.want {
+			t.Errorf("parseInt(%q).IntBase() = %d, want %d", test.in, got, test.want)
+		}
+	}
+
+	if got := IntValue(16).IntBase(); got != 10 {
+		t.Errorf("IntValue(16).IntBase() = %d, want 10", got)
+	}
+	if got := FloatValue(1).IntBase(); got != 0 {
+		t.Errorf("FloatValue(1).IntBase() = %d, want 0", got)
+	}
+}
+
+func TestRawHashes(t *testing.T) {
+	doc, err := ParseString(`node r#"a"b"# r"x" r##"y"## "z" 1`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	tests := []struct {
+		hashes int
+		raw    bool
+	}{
+		{1, true},
+		{0, true},
+		{2, true},
+		{0, false},
+		{0, false},
+	}
+	for i, test := range tests {
+		hashes, raw := doc.Nodes[0].Args[i].RawHashes()
+		if hashes != test.hashes || raw != test.raw {
+			t.Errorf("arg %d: RawHashes() = %d, %v, want %d, %v", i, hashes, raw, test.hashes, test.raw)
+		}
+	}
+	if _, raw := StringValue("a").RawHashes(); raw {
+		t.Errorf("StringValue reports being a raw string")
+	}
+}
+
+func TestValueText(t *testing.T) {
+	bi, _ := new(big.Int).SetString("18446744073709551616", 10)
+	annotated := IntValue(255)
+	annotated.TypeAnnotation = "u8"
+	tests := []struct {
+		v    Value
+		text string
+	}{
+		{NullValue(), "#null"},
+		{StringValue("foo"), `"foo"`},
+		{StringValue("a\"b\n"), `"a\"b\n"`},
+		{IntValue(-12), "-12"},
+		{BigIntValue(bi), "18446744073709551616"},
+		{FloatValue(0.5), "0.5"},
+		{FloatValue(math.Inf(1)), "#inf"},
+		{BoolValue(true), "#true"},
+		{BoolValue(false), "#false"},
+		{annotated, "(u8)255"},
+	}
+	for _, test := range tests {
+		bs, err := test.v.MarshalText()
+		if err != nil {
+			t.Errorf("MarshalText(%s) failed: %v", test.text, err)
+			continue
+		}
+		if got := string(bs); got != test.text {
+			t.Errorf("MarshalText = %q, want %q", got, test.text)
+		}
+		if got, _ := test.v.AppendText([]byte("x=")); string(got) != "x="+test.text {
+			t.Errorf("AppendText = %q, want %q", got, "x="+test.text)
+		}
+		var v Value
+		if err := v.UnmarshalText(bs); err != nil {
+			t.Errorf("UnmarshalText(%q) failed: %v", bs, err)
+			continue
+		}
+		if !v.Equal(test.v) {
+			t.Errorf("UnmarshalText(%q) = %#v, want %#v", bs, v, test.v)
+		}
+		// The text is KDL v2, not a mix of versions.
+		if _, err := (ParseOptions{LexerOptions: LexerOptions{Version: V2}}).ParseValue(string(bs)); err != nil {
+			t.Errorf("parsing %q as KDL v2 failed: %v", bs, err)
+		}
+	}
+
+	for _, in := range []string{"0xff", "#true", "#null", `r#"a"b"#`, "(date)\"2021-01-01\""} {
+		var v Value
+		if err := v.UnmarshalText([]byte(in)); err != nil {
+			t.Errorf("UnmarshalText(%q) failed: %v", in, err)
+		}
+	}
+	for _, in := range []string{"", "foo", "1 2", "1 ", "(u8)", "a=1", `"unterminated`} {
+		var v Value
+		if err := v.UnmarshalText([]byte(in)); err == nil {
+			t.Errorf("UnmarshalText(%q) = %#v, want error", in, v)
+		}
+	}
+}
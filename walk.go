@@ -0,0 +1,50 @@
+package kdl
+
+import "errors"
+
+// SkipChildren is used as a return value from a WalkFunc to indicate
+// that the children of the node in the call are to be skipped. It is
+// not returned as an error by Walk.
+var SkipChildren = errors.New("skip children")
+
+// SkipAll is used as a return value from a WalkFunc to indicate that
+// all remaining nodes are to be skipped. It is not returned as an
+// error by Walk.
+var SkipAll = errors.New("skip all nodes")
+
+// WalkFunc is the type of the function called by Walk to visit each
+// node. depth is 0 for top-level nodes, 1 for their children, and so
+// on.
+//
+// If the function returns SkipChildren, Walk skips n's children and
+// carries on with its next sibling. If it returns SkipAll, Walk skips
+// all remaining nodes. Any other non-nil error stops Walk, which
+// returns it.
+type WalkFunc func(n *Node, depth int) error
+
+// Walk calls fn for each node in doc, depth-first in document order,
+// visiting each node before its children.
+func Walk(doc *Document, fn WalkFunc) error {
+	if doc == nil {
+		return nil
+	}
+	if err := walkNodes(doc.Nodes, 0, fn); err != nil && err != SkipAll {
+		return err
+	}
+	return nil
+}
+
+func walkNodes(nodes []*Node, depth int, fn WalkFunc) error {
+	for _, n := range nodes {
+		switch err := fn(n, depth); err {
+		case nil:
+			if err := walkNodes(n.Children, depth+1, fn); err != nil {
+				return err
+			}
+		case SkipChildren:
+		default:
+			return err
+		}
+	}
+	return nil
+}
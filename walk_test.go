@@ -0,0 +1,103 @@
+package kdl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const walkDoc = `a {
+    b {
+        c
+    }
+    d
+}
+e {
+    f
+}
+`
+
+func walkNames(t *testing.T, fn func(n *Node, depth int) error) ([]string, error) {
+	t.Helper()
+	doc, err := Parse(strings.NewReader(walkDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = Walk(doc, func(n *Node, depth int) error {
+		got = append(got, fmt.Sprintf("%s@%d", n.Name, depth))
+		return fn(n, depth)
+	})
+	return got, err
+}
+
+func TestWalk(t *testing.T) {
+	got, err := walkNames(t, func(*Node, int) error { return nil })
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	want := []string{"a@0", "b@1", "c@2", "d@1", "e@0", "f@1"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong nodes visited (-got+want):\n%s", diff)
+	}
+
+	if err := Walk(nil, func(*Node, int) error { return errors.New("called") }); err != nil {
+		t.Errorf("Walk(nil) = %v, want nil", err)
+	}
+}
+
+func TestWalkSkip(t *testing.T) {
+	errStop := errors.New("stop")
+	tests := []struct {
+		name    string
+		fn      func(n *Node, depth int) error
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "skip children",
+			fn: func(n *Node, depth int) error {
+				if n.Name == "b" {
+					return SkipChildren
+				}
+				return nil
+			},
+			want: []string{"a@0", "b@1", "d@1", "e@0", "f@1"},
+		},
+		{
+			name: "skip all",
+			fn: func(n *Node, depth int) error {
+				if n.Name == "c" {
+					return SkipAll
+				}
+				return nil
+			},
+			want: []string{"a@0", "b@1", "c@2"},
+		},
+		{
+			name: "error",
+			fn: func(n *Node, depth int) error {
+				if n.Name == "d" {
+					return errStop
+				}
+				return nil
+			},
+			want:    []string{"a@0", "b@1", "c@2", "d@1"},
+			wantErr: errStop,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := walkNames(t, tc.fn)
+			if err != tc.wantErr {
+				t.Errorf("Walk error = %v, want %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("wrong nodes visited (-got+want):\n%s", diff)
+			}
+		})
+	}
+}